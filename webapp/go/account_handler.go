@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const userDeletionSweepInterval = 10 * time.Second
+
+type DeleteUserRequest struct {
+	// Password is non-hashed password.
+	Password string `json:"password"`
+}
+
+type UserDeletionTaskModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Name      string `db:"name"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// removedUserScore は退会するユーザが他人の配信につけたスコア (リアクション数 + チップ合計) の日ごとの合計
+// 日・週のランキングはUTCの0時で区切るので、日の開始時刻で引けば正しい期間から引ける
+type removedUserScore struct {
+	LivestreamID int64 `db:"livestream_id"`
+	OwnerID      int64 `db:"owner_id"`
+	Day          int64 `db:"day"`
+	Score        int64 `db:"score"`
+}
+
+// 退会するユーザ自身が持つ行の削除
+// ユーザに紐づくテーブルを増やしたらここにも追加する
+// tip_ledger は会計の記録なので退会しても残す。消えるコメントのチップは返金を追記しておく
+var userOwnedRowsDeleteQueries = []string{
+	// 自分のコメントに対する報告は、コメントと一緒に消す
+	"DELETE FROM livecomment_reports WHERE livecomment_id IN (SELECT id FROM livecomments WHERE user_id = ?)",
+	"DELETE FROM livecomment_reports WHERE user_id = ?",
+	"DELETE FROM livecomments WHERE user_id = ?",
+	"DELETE FROM reactions WHERE user_id = ?",
+	"DELETE FROM ng_words WHERE user_id = ?",
+	"DELETE FROM livestream_viewers_history WHERE user_id = ?",
+	"DELETE FROM livestream_unique_viewers WHERE user_id = ?",
+	"DELETE FROM watch_history WHERE user_id = ?",
+	"DELETE FROM watch_history_pauses WHERE user_id = ?",
+	"DELETE FROM user_stats WHERE user_id = ?",
+	"DELETE FROM user_emoji_stats WHERE user_id = ?",
+	"DELETE FROM livestream_tippers WHERE user_id = ?",
+	"DELETE FROM held_tips WHERE user_id = ?",
+	"DELETE FROM user_export_jobs WHERE user_id = ?",
+	"DELETE FROM personal_access_tokens WHERE user_id = ?",
+	"DELETE FROM webhook_deliveries WHERE user_id = ?",
+	"DELETE FROM webhook_subscriptions WHERE user_id = ?",
+	"DELETE FROM user_totp WHERE user_id = ?",
+	"DELETE FROM user_recovery_codes WHERE user_id = ?",
+	"DELETE FROM idempotency_keys WHERE user_id = ?",
+	"DELETE FROM follows WHERE follower_id = ?",
+	"DELETE FROM follows WHERE followee_id = ?",
+	"DELETE FROM notifications WHERE user_id = ?",
+	"DELETE FROM notifications WHERE actor_id = ?",
+	"DELETE FROM icons WHERE user_id = ?",
+	"DELETE FROM custom_emojis WHERE user_id = ?",
+	"DELETE FROM themes WHERE user_id = ?",
+	"DELETE FROM users WHERE id = ?",
+}
+
+// 配信に紐づく行の削除 (IN句に配信IDを展開する)
+var livestreamOwnedRowsDeleteQueries = []string{
+	"DELETE FROM livestream_tags WHERE livestream_id IN (?)",
+	"DELETE FROM livecomment_reports WHERE livestream_id IN (?)",
+	"DELETE FROM livecomments WHERE livestream_id IN (?)",
+	"DELETE FROM reactions WHERE livestream_id IN (?)",
+	"DELETE FROM ng_words WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_viewers_history WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_unique_viewers WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_viewer_stats WHERE livestream_id IN (?)",
+	"DELETE FROM watch_history WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_stats WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_tippers WHERE livestream_id IN (?)",
+	"DELETE FROM held_tips WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_minutely_stats WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_minutely_emoji_stats WHERE livestream_id IN (?)",
+	"DELETE FROM notifications WHERE livestream_id IN (?)",
+	"DELETE FROM livestream_start_notifications WHERE livestream_id IN (?)",
+	"DELETE FROM livestreams WHERE id IN (?)",
+}
+
+// userDeletionSweeper は退会処理のうちDB以外の後始末を非同期に行う
+var userDeletionSweeper = &UserDeletionSweeper{
+	wake: make(chan struct{}, 1),
+}
+
+// 退会API
+// DELETE /api/user/me
+func deleteMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := currentUser(c).ID
+
+	req := DeleteUserRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	// パスワードの再確認
+	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid password")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+	}
+
+	// 他の配信に残したコメント・リアクション・報告が消えるので、その配信と配信者の集計を後で作り直す
+	var affectedLivestreamIDs []int64
+	if err := tx.SelectContext(ctx, &affectedLivestreamIDs, `SELECT livestream_id FROM livecomments WHERE user_id = ?
+	UNION SELECT livestream_id FROM reactions WHERE user_id = ?
+	UNION SELECT livestream_id FROM livecomment_reports WHERE user_id = ?`, userID, userID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected livestreams: "+err.Error())
+	}
+	var affectedUserIDs []int64
+	if len(affectedLivestreamIDs) > 0 {
+		query, args, err := sqlx.In("SELECT DISTINCT user_id FROM livestreams WHERE id IN (?)", affectedLivestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &affectedUserIDs, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected users: "+err.Error())
+		}
+	}
+
+	// ランキングとフォロー数のキャッシュはコミット後にここで読んだぶんだけ直す
+	var removedScores []removedUserScore
+	if err := tx.SelectContext(ctx, &removedScores, `SELECT t.livestream_id, l.user_id AS owner_id, t.day, SUM(t.score) AS score FROM (
+		SELECT livestream_id, created_at - created_at % 86400 AS day, COUNT(*) AS score FROM reactions WHERE user_id = ? GROUP BY livestream_id, day
+		UNION ALL
+		SELECT livestream_id, created_at - created_at % 86400 AS day, SUM(tip) AS score FROM livecomments WHERE user_id = ? AND is_deleted = 0 AND tip > 0 GROUP BY livestream_id, day
+	) t INNER JOIN livestreams l ON l.id = t.livestream_id
+	WHERE l.user_id <> ? GROUP BY t.livestream_id, l.user_id, t.day`, userID, userID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get removed scores: "+err.Error())
+	}
+	var followeeIDs, followerIDs []int64
+	if err := tx.SelectContext(ctx, &followeeIDs, "SELECT followee_id FROM follows WHERE follower_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get followees: "+err.Error())
+	}
+	if err := tx.SelectContext(ctx, &followerIDs, "SELECT follower_id FROM follows WHERE followee_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get followers: "+err.Error())
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	if err := deleteLivestreams(ctx, tx, livestreamModels, time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestreams: "+err.Error())
+	}
+
+	// 自分の配信へのコメントは配信と一緒に返金済み
+	if err := refundDeletedLivecomments(ctx, tx, time.Now().Unix(), "lc.user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	for _, query := range userOwnedRowsDeleteQueries {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user data: "+err.Error())
+		}
+	}
+
+	if err := recomputeStats(ctx, tx, affectedLivestreamIDs, affectedUserIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_deletion_tasks (user_id, name, created_at) VALUES (?, ?, ?)", userID, userModel.Name, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user deletion task: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// キャッシュはすぐに直す。ファイルとDNSはsweeperに任せる
+	// 退会はコミット済みなので、ここで失敗してもログに残すだけにする
+	dropUserCaches(userID, userModel.Name)
+	followCountCache.RemoveUser(userID, followeeIDs, followerIDs)
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamIDs[i] = livestreamModel.ID
+	}
+	statsRankings.RemoveUser(userModel.Name, livestreamIDs)
+	for _, score := range removedScores {
+		if err := statsRankings.Add(ctx, &LivestreamModel{ID: score.LivestreamID, UserID: score.OwnerID}, -score.Score, score.Day); err != nil {
+			c.Logger().Errorf("failed to update rankings: %v", err)
+		}
+	}
+	userDeletionSweeper.Wake()
+
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err == nil {
+		sess.Options = &sessions.Options{
+			Domain: "u.isucon.dev",
+			MaxAge: -1,
+			Path:   "/",
+		}
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// deleteLivestreams は配信とそれに紐づく行を消し、まだ始まっていない予約枠を返却する
+func deleteLivestreams(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel, now time.Time) error {
+	if len(livestreamModels) == 0 {
+		return nil
+	}
+
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamIDs[i] = livestreamModel.ID
+	}
+
+	// 同じ時間帯を複数持っていることがあるので1件ずつ返却する
+	for _, startAt := range reservedSlotsToRelease(livestreamModels, now.Unix()) {
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at = ?", startAt); err != nil {
+			return fmt.Errorf("failed to release reservation slot: %w", err)
+		}
+	}
+
+	query, args, err := sqlx.In("lc.livestream_id IN (?)", livestreamIDs)
+	if err != nil {
+		return fmt.Errorf("failed to construct IN query: %w", err)
+	}
+	if err := refundDeletedLivecomments(ctx, tx, now.Unix(), query, args...); err != nil {
+		return err
+	}
+
+	for _, q := range livestreamOwnedRowsDeleteQueries {
+		query, args, err := sqlx.In(q, livestreamIDs)
+		if err != nil {
+			return fmt.Errorf("failed to construct IN query: %w", err)
+		}
+		query = tx.Rebind(query)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to delete livestream data: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// reservedSlotsToRelease は退会で空ける予約枠 (これから始まる1時間枠) の開始時刻を返す
+// 中止・終了した配信の枠は状態を変えたときに空けているので、ここでは空けない
+func reservedSlotsToRelease(livestreamModels []*LivestreamModel, now int64) []int64 {
+	var slots []int64
+	for _, livestreamModel := range livestreamModels {
+		if livestreamModel.State == LivestreamStateCancelled || livestreamModel.State == LivestreamStateEnded {
+			continue
+		}
+		for startAt := livestreamModel.StartAt; startAt+3600 <= livestreamModel.EndAt; startAt += 3600 {
+			if startAt >= now {
+				slots = append(slots, startAt)
+			}
+		}
+	}
+	return slots
+}
+
+func dropUserCaches(userID int64, username string) {
+	iconHashCache.Delete(username)
+	userCache.Delete(userID)
+	themeCache.Delete(userID)
+}
+
+type UserDeletionSweeper struct {
+	wake chan struct{}
+}
+
+func (s *UserDeletionSweeper) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run は user_deletion_tasks を定期的に処理する。失敗したタスクは残して次回やり直す
+func (s *UserDeletionSweeper) Run(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(userDeletionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+
+		if err := s.sweep(ctx); err != nil {
+			logger.Warnf("failed to sweep deleted users: %v", err)
+		}
+	}
+}
+
+func (s *UserDeletionSweeper) sweep(ctx context.Context) error {
+	var tasks []*UserDeletionTaskModel
+	if err := dbConn.SelectContext(ctx, &tasks, "SELECT * FROM user_deletion_tasks ORDER BY id LIMIT 100"); err != nil {
+		return fmt.Errorf("failed to get user deletion tasks: %w", err)
+	}
+
+	for _, task := range tasks {
+		if err := os.Remove(iconFilePath(task.UserID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove icon file: %w", err)
+		}
+		if err := os.RemoveAll(customEmojiUserDir(task.UserID)); err != nil {
+			return fmt.Errorf("failed to remove custom emoji files: %w", err)
+		}
+
+		exportFiles, err := filepath.Glob(exportFileGlob(task.UserID))
+		if err != nil {
+			return fmt.Errorf("failed to find export files: %w", err)
+		}
+		for _, exportFile := range exportFiles {
+			if err := os.Remove(exportFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove export file: %w", err)
+			}
+		}
+
+		// 同じ名前で再登録されていたらDNSレコードは残す
+		var reusedCount int64
+		if err := dbConn.GetContext(ctx, &reusedCount, "SELECT COUNT(*) FROM users WHERE name = ?", task.Name); err != nil {
+			return fmt.Errorf("failed to count users: %w", err)
+		}
+		if reusedCount == 0 {
+			if err := dnsRecordManager.DeleteRecord(ctx, task.Name); err != nil {
+				return fmt.Errorf("failed to delete dns record: %w", err)
+			}
+			unregisterDNSName(task.Name)
+		}
+
+		// 退会処理と並行して読み込まれたキャッシュも消しておく
+		dropUserCaches(task.UserID, task.Name)
+
+		if _, err := dbConn.ExecContext(ctx, "DELETE FROM user_deletion_tasks WHERE id = ?", task.ID); err != nil {
+			return fmt.Errorf("failed to delete user deletion task: %w", err)
+		}
+	}
+	return nil
+}
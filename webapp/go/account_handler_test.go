@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservedSlotsToRelease(t *testing.T) {
+	const now = 10 * 3600
+	livestreamModels := []*LivestreamModel{
+		// 始まる前の2時間枠は両方空ける
+		{ID: 1, StartAt: 12 * 3600, EndAt: 14 * 3600, State: LivestreamStateScheduled},
+		// 配信中なら残りの枠だけ
+		{ID: 2, StartAt: 9 * 3600, EndAt: 12 * 3600, State: LivestreamStateLive},
+		// 中止・早期終了した配信は空け済み
+		{ID: 3, StartAt: 20 * 3600, EndAt: 22 * 3600, State: LivestreamStateCancelled},
+		{ID: 4, StartAt: 9 * 3600, EndAt: 9*3600 + 1800, State: LivestreamStateEnded},
+	}
+
+	assert.Equal(t, []int64{12 * 3600, 13 * 3600, 10 * 3600, 11 * 3600}, reservedSlotsToRelease(livestreamModels, now))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	principalContextKey         = "principal"
+	currentUserContextKey       = "current_user"
+	currentLivestreamContextKey = "current_livestream"
+	authErrorContextKey         = "auth_error"
+)
+
+// authenticationMiddleware はトークンかセッションでリクエストを認証し、ユーザをcontextに入れる
+// セッションで認証できなくてもここでは弾かず、ロールごとのミドルウェア (requireRole) が判断する
+func authenticationMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var principal *Principal
+		if authorization := c.Request().Header.Get(echo.HeaderAuthorization); authorization != "" {
+			// 不正なトークンは公開APIでもエラーにする
+			p, err := authenticateToken(c, authorization)
+			if err != nil {
+				return err
+			}
+			principal = p
+		} else {
+			userID, err := authenticateSession(c)
+			if err != nil {
+				c.Set(authErrorContextKey, err)
+				return next(c)
+			}
+			principal = &Principal{UserID: userID}
+		}
+
+		userModel, err := userCache.Get(c.Request().Context(), principal.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 退会済みのユーザ
+			c.Set(authErrorContextKey, echo.NewHTTPError(http.StatusUnauthorized, "not found user that has the userid in session"))
+			return next(c)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		principal.Admin = principal.Token == nil && isAdminUsername(userModel.Name)
+		c.Set(principalContextKey, principal)
+		c.Set(currentUserContextKey, userModel)
+		return next(c)
+	}
+}
+
+func authenticateToken(c echo.Context, authorization string) (*Principal, error) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || !strings.HasPrefix(token, personalAccessTokenPrefix) {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization header")
+	}
+
+	tokenModel, err := findPersonalAccessToken(c.Request().Context(), token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{UserID: tokenModel.UserID, Token: tokenModel}, nil
+}
+
+func authenticateSession(c echo.Context) (int64, error) {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+
+	sessionExpires, ok := sess.Values[defaultSessionExpiresKey]
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
+	}
+
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
+	}
+
+	now := time.Now()
+	if now.Unix() > sessionExpires.(int64) {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+	}
+
+	return userID, nil
+}
+
+// requireRole はロールを満たさないリクエストを弾く
+// 配信者・モデレータのロールではパスの配信を読み込み、currentLivestream で取り出せるようにする
+func requireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, _ := c.Get(principalContextKey).(*Principal)
+			if principal == nil && role != RolePublic {
+				if err, ok := c.Get(authErrorContextKey).(error); ok {
+					return err
+				}
+			}
+
+			if principal != nil && principal.Token != nil && role != RolePublic {
+				if err := authorizeTokenRoute(principal.Token, c.Request().Method, c.Path()); err != nil {
+					return err
+				}
+			}
+
+			var livestreamModel *LivestreamModel
+			if principal != nil && (role == RoleLivestreamOwner || role == RoleModerator) {
+				livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+				}
+				livestreamModel = &LivestreamModel{}
+				if err := dbConn.GetContext(c.Request().Context(), livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+					if errors.Is(err, sql.ErrNoRows) {
+						return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+					}
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+				}
+				c.Set(currentLivestreamContextKey, livestreamModel)
+			}
+
+			if err := authorize(role, principal, livestreamModel); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// currentUser はログイン中のユーザを返す
+// RoleUser 以上のルートでは必ずnilでない
+func currentUser(c echo.Context) *UserModel {
+	userModel, _ := c.Get(currentUserContextKey).(*UserModel)
+	return userModel
+}
+
+// currentLivestream は RoleLivestreamOwner, RoleModerator のルートで対象の配信を返す
+func currentLivestream(c echo.Context) *LivestreamModel {
+	livestreamModel, _ := c.Get(currentLivestreamContextKey).(*LivestreamModel)
+	return livestreamModel
+}
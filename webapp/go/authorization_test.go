@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertHTTPStatus(t *testing.T, code int, err error) {
+	t.Helper()
+	var httpErr *echo.HTTPError
+	if assert.ErrorAs(t, err, &httpErr) {
+		assert.Equal(t, code, httpErr.Code)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	owner := &Principal{UserID: 1}
+	viewer := &Principal{UserID: 2}
+	livestream := &LivestreamModel{ID: 10, UserID: 1}
+
+	assert.NoError(t, authorize(RolePublic, nil, nil))
+	assertHTTPStatus(t, http.StatusUnauthorized, authorize(RoleUser, nil, nil))
+	assert.NoError(t, authorize(RoleUser, viewer, nil))
+
+	assert.NoError(t, authorize(RoleLivestreamOwner, owner, livestream))
+	assertHTTPStatus(t, http.StatusForbidden, authorize(RoleLivestreamOwner, viewer, livestream))
+	assertHTTPStatus(t, http.StatusUnauthorized, authorize(RoleLivestreamOwner, nil, livestream))
+
+	assert.NoError(t, authorize(RoleModerator, owner, livestream))
+	// 他の配信者の配信の moderate はもとのAPIと同じ400
+	assertHTTPStatus(t, http.StatusBadRequest, authorize(RoleModerator, viewer, livestream))
+
+	// トークンの場合はmoderateスコープも必要
+	readOnly := &Principal{UserID: 1, Token: &PersonalAccessTokenModel{UserID: 1, Scopes: scopeLivecommentRead}}
+	moderator := &Principal{UserID: 1, Token: &PersonalAccessTokenModel{UserID: 1, Scopes: scopeLivecommentRead + "," + scopeModerate}}
+	assert.NoError(t, authorize(RoleLivestreamOwner, readOnly, livestream))
+	assertHTTPStatus(t, http.StatusForbidden, authorize(RoleModerator, readOnly, livestream))
+	assert.NoError(t, authorize(RoleModerator, moderator, livestream))
+
+	// 運営はセッションでのみ
+	admin := &Principal{UserID: 3, Admin: true}
+	assert.NoError(t, authorize(RoleAdmin, admin, nil))
+	assertHTTPStatus(t, http.StatusForbidden, authorize(RoleAdmin, owner, nil))
+	assertHTTPStatus(t, http.StatusForbidden, authorize(RoleAdmin, &Principal{UserID: 3, Admin: true, Token: &PersonalAccessTokenModel{UserID: 3}}, nil))
+	assertHTTPStatus(t, http.StatusUnauthorized, authorize(RoleAdmin, nil, nil))
+}
+
+func TestLoadAdminUsernames(t *testing.T) {
+	assert.Equal(t, map[string]struct{}{"alice": {}, "bob": {}}, loadAdminUsernames(" alice,,bob "))
+	assert.Empty(t, loadAdminUsernames(""))
+}
+
+func TestAuthorizeTokenRoute(t *testing.T) {
+	token := &PersonalAccessTokenModel{Scopes: scopeLivecommentRead + "," + scopeLivecommentWrite}
+
+	assert.NoError(t, authorizeTokenRoute(token, http.MethodGet, "/api/livestream/:livestream_id/livecomment"))
+	assert.NoError(t, authorizeTokenRoute(token, http.MethodPost, "/api/livestream/:livestream_id/livecomment"))
+	// 報告は視聴者の操作なので moderate スコープはいらない
+	assert.NoError(t, authorizeTokenRoute(token, http.MethodPost, "/api/livestream/:livestream_id/livecomment/:livecomment_id/report"))
+	assertHTTPStatus(t, http.StatusForbidden, authorizeTokenRoute(token, http.MethodPost, "/api/livestream/:livestream_id/moderate"))
+	// セッション専用のAPIはスコープに関係なく呼び出せない
+	assertHTTPStatus(t, http.StatusForbidden, authorizeTokenRoute(token, http.MethodDelete, "/api/user/me"))
+	assertHTTPStatus(t, http.StatusForbidden, authorizeTokenRoute(token, http.MethodPost, "/api/user/me/tokens"))
+}
+
+func TestRequireRoleChecksTokenRoute(t *testing.T) {
+	e := echo.New()
+	token := &PersonalAccessTokenModel{UserID: 1, Scopes: scopeLivecommentRead}
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+
+	newContext := func(method, path string) echo.Context {
+		c := e.NewContext(httptest.NewRequest(method, "/", nil), httptest.NewRecorder())
+		c.SetPath(path)
+		c.Set(principalContextKey, &Principal{UserID: 1, Token: token})
+		return c
+	}
+
+	// セッション専用のAPIはトークンでは呼び出せない
+	assertHTTPStatus(t, http.StatusForbidden, requireRole(RoleUser)(ok)(newContext(http.MethodGet, "/api/user/me")))
+	assert.NoError(t, requireRole(RoleUser)(ok)(newContext(http.MethodGet, "/api/livestream/:livestream_id/livecomment")))
+}
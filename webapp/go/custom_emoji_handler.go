@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// カスタム絵文字の画像は icons の下に配信者ごとに置く
+const customEmojiDir = iconDir + "/emoji"
+
+const (
+	maxCustomEmojiBytes     = 256 * 1024
+	maxCustomEmojiDimension = 128
+	maxCustomEmojisPerUser  = 50
+)
+
+var customEmojiShortcodePattern = regexp.MustCompile(`^:[a-z0-9_+-]{2,32}:$`)
+
+// 画像の形式 (image.DecodeConfig の結果) ごとの Content-Type
+var customEmojiContentTypes = map[string]string{
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"jpeg": "image/jpeg",
+}
+
+type CustomEmojiModel struct {
+	ID          int64  `db:"id"`
+	UserID      int64  `db:"user_id"`
+	Name        string `db:"name"`
+	ContentType string `db:"content_type"`
+	Image       []byte `db:"image"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
+type CustomEmoji struct {
+	ID int64 `json:"id"`
+	// Shortcode はリアクションの emoji_name にそのまま使う
+	Shortcode string `json:"shortcode"`
+	ImageURL  string `json:"image_url"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type PostCustomEmojiRequest struct {
+	Shortcode string `json:"shortcode"`
+	Image     []byte `json:"image"`
+}
+
+func customEmojiUserDir(userID int64) string {
+	return fmt.Sprintf("%s/%d", customEmojiDir, userID)
+}
+
+func customEmojiFilePath(userID, emojiID int64) string {
+	return fmt.Sprintf("%s/%d", customEmojiUserDir(userID), emojiID)
+}
+
+func isCustomEmojiShortcode(name string) bool {
+	return customEmojiShortcodePattern.MatchString(name)
+}
+
+// validateCustomEmojiImage は画像の大きさと形式を確かめ、Content-Type を返す
+func validateCustomEmojiImage(img []byte) (string, error) {
+	if len(img) == 0 {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "image is required")
+	}
+	if len(img) > maxCustomEmojiBytes {
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("image must be at most %d bytes", maxCustomEmojiBytes))
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "image must be png, gif or jpeg")
+	}
+	contentType, ok := customEmojiContentTypes[format]
+	if !ok {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "image must be png, gif or jpeg")
+	}
+	if config.Width > maxCustomEmojiDimension || config.Height > maxCustomEmojiDimension {
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("image must be at most %dx%d pixels", maxCustomEmojiDimension, maxCustomEmojiDimension))
+	}
+	return contentType, nil
+}
+
+// customEmojiExists は配信者がその絵文字を登録しているかを返す
+func customEmojiExists(ctx context.Context, tx sqlx.QueryerContext, userID int64, name string) (bool, error) {
+	var exists bool
+	if err := sqlx.GetContext(ctx, tx, &exists, "SELECT EXISTS(SELECT 1 FROM custom_emojis WHERE user_id = ? AND name = ?)", userID, name); err != nil {
+		return false, fmt.Errorf("failed to get custom emoji: %w", err)
+	}
+	return exists, nil
+}
+
+func fillCustomEmojiResponse(username string, customEmojiModel CustomEmojiModel) CustomEmoji {
+	return CustomEmoji{
+		ID:        customEmojiModel.ID,
+		Shortcode: customEmojiModel.Name,
+		ImageURL:  fmt.Sprintf("/api/user/%s/emoji/%d", username, customEmojiModel.ID),
+		CreatedAt: customEmojiModel.CreatedAt,
+	}
+}
+
+// カスタム絵文字の登録API
+// POST /api/user/me/emoji
+func postCustomEmojiHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	user := currentUser(c)
+
+	var req *PostCustomEmojiRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if !isCustomEmojiShortcode(req.Shortcode) {
+		return echo.NewHTTPError(http.StatusBadRequest, "shortcode must be like :name: with 2-32 characters of a-z, 0-9, _, + and -")
+	}
+	// 標準の絵文字と紛らわしい名前は使わせない
+	if isCatalogEmoji(strings.Trim(req.Shortcode, ":")) {
+		return echo.NewHTTPError(http.StatusBadRequest, "shortcode is used by a standard emoji")
+	}
+	contentType, err := validateCustomEmojiImage(req.Image)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM custom_emojis WHERE user_id = ? FOR UPDATE", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count custom emojis: "+err.Error())
+	}
+	if count >= maxCustomEmojisPerUser {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("cannot register more than %d custom emojis", maxCustomEmojisPerUser))
+	}
+
+	customEmojiModel := CustomEmojiModel{
+		UserID:      user.ID,
+		Name:        req.Shortcode,
+		ContentType: contentType,
+		Image:       req.Image,
+		CreatedAt:   time.Now().Unix(),
+	}
+	rs, err := tx.ExecContext(ctx, "INSERT INTO custom_emojis (user_id, name, content_type, image, created_at) VALUES (?, ?, ?, ?, ?)",
+		customEmojiModel.UserID, customEmojiModel.Name, customEmojiModel.ContentType, customEmojiModel.Image, customEmojiModel.CreatedAt)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntryNum {
+			return echo.NewHTTPError(http.StatusConflict, "shortcode is already registered")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert custom emoji: "+err.Error())
+	}
+	customEmojiModel.ID, err = rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted custom emoji id: "+err.Error())
+	}
+
+	filePath := customEmojiFilePath(user.ID, customEmojiModel.ID)
+	if err := os.MkdirAll(customEmojiUserDir(user.ID), 0755); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create custom emoji directory: "+err.Error())
+	}
+	if err := os.WriteFile(filePath, customEmojiModel.Image, 0644); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to write custom emoji file: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		os.Remove(filePath)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, fillCustomEmojiResponse(user.Name, customEmojiModel))
+}
+
+// カスタム絵文字の削除API
+// DELETE /api/user/me/emoji/:emoji_id
+// これまでのリアクションは消さない
+func deleteCustomEmojiHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	emojiID, err := strconv.ParseInt(c.Param("emoji_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM custom_emojis WHERE id = ? AND user_id = ?", emojiID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete custom emoji: "+err.Error())
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "custom emoji not found")
+	}
+	if err := os.Remove(customEmojiFilePath(userID, emojiID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to remove custom emoji file: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信者のカスタム絵文字一覧API
+// GET /api/user/:username/emoji
+func getCustomEmojisHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	username := c.Param("username")
+
+	var userModel UserModel
+	if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	var customEmojiModels []CustomEmojiModel
+	if err := dbConn.SelectContext(ctx, &customEmojiModels, "SELECT id, user_id, name, content_type, created_at FROM custom_emojis WHERE user_id = ? ORDER BY name", userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get custom emojis: "+err.Error())
+	}
+
+	customEmojis := make([]CustomEmoji, len(customEmojiModels))
+	for i := range customEmojiModels {
+		customEmojis[i] = fillCustomEmojiResponse(userModel.Name, customEmojiModels[i])
+	}
+
+	return c.JSON(http.StatusOK, customEmojis)
+}
+
+// カスタム絵文字の画像取得API
+// GET /api/user/:username/emoji/:emoji_id
+func getCustomEmojiImageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	username := c.Param("username")
+	emojiID, err := strconv.ParseInt(c.Param("emoji_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji_id in path must be integer")
+	}
+
+	var customEmojiModel CustomEmojiModel
+	if err := dbConn.GetContext(ctx, &customEmojiModel, `SELECT e.id, e.user_id, e.name, e.content_type, e.created_at FROM custom_emojis e
+	INNER JOIN users u ON u.id = e.user_id WHERE e.id = ? AND u.name = ?`, emojiID, username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "custom emoji not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get custom emoji: "+err.Error())
+	}
+
+	// ファイルがなければDBから書き戻す
+	filePath := customEmojiFilePath(customEmojiModel.UserID, customEmojiModel.ID)
+	img, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read custom emoji file: "+err.Error())
+	}
+	if len(img) == 0 {
+		if err := dbConn.GetContext(ctx, &img, "SELECT image FROM custom_emojis WHERE id = ?", customEmojiModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get custom emoji image: "+err.Error())
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err == nil {
+			os.WriteFile(filePath, img, 0644)
+		}
+	}
+
+	return c.Blob(http.StatusOK, customEmojiModel.ContentType, img)
+}
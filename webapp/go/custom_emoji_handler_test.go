@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))))
+	return buf.Bytes()
+}
+
+func TestIsCustomEmojiShortcode(t *testing.T) {
+	assert.True(t, isCustomEmojiShortcode(":party_parrot:"))
+	assert.True(t, isCustomEmojiShortcode(":+1-isu:"))
+	assert.False(t, isCustomEmojiShortcode("party_parrot"))
+	assert.False(t, isCustomEmojiShortcode(":Parrot:"))
+	assert.False(t, isCustomEmojiShortcode(":a:"))
+	assert.False(t, isCustomEmojiShortcode(":party parrot:"))
+	// 標準の絵文字の名前とは重ならない
+	assert.False(t, isCatalogEmoji(":chair:"))
+}
+
+func TestValidateCustomEmojiImage(t *testing.T) {
+	contentType, err := validateCustomEmojiImage(encodePNG(t, 64, 64))
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+
+	tooLarge := make([]byte, maxCustomEmojiBytes+1)
+	for name, img := range map[string][]byte{
+		"empty":        nil,
+		"too many px":  encodePNG(t, 256, 64),
+		"too large":    tooLarge,
+		"not an image": []byte("<svg></svg>"),
+	} {
+		_, err := validateCustomEmojiImage(img)
+		var httpErr *echo.HTTPError
+		require.ErrorAs(t, err, &httpErr, name)
+		assert.Equal(t, http.StatusBadRequest, httpErr.Code, name)
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+const (
+	powerDNSZoneName = "u.isucon.dev"
+
+	dnsRecordBackendEnvKey   = "ISUCON13_DNS_RECORD_BACKEND"
+	powerDNSHostEnvKey       = "ISUCON13_POWERDNS_HOST"
+	powerDNSAPIPortEnvKey    = "ISUCON13_POWERDNS_API_PORT"
+	powerDNSAPIKeyEnvKey     = "ISUCON13_POWERDNS_API_KEY"
+	powerDNSDisabledEnvKey   = "ISUCON13_POWERDNS_DISABLED"
+	powerDNSDBUserEnvKey     = "ISUCON13_POWERDNS_DB_USER"
+	powerDNSDBPasswordEnvKey = "ISUCON13_POWERDNS_DB_PASSWORD"
+	powerDNSDBNameEnvKey     = "ISUCON13_POWERDNS_DB_DATABASE"
+
+	// init.sh に pdnsutil でのゾーンの初期化を飛ばさせる
+	skipZoneInitEnvKey = "ISUCON13_SKIP_ZONE_INIT"
+
+	dnsRecordBackendMySQL = "mysql"
+	dnsRecordBackendAPI   = "api"
+
+	dnsRecordCreateMaxAttempts = 5
+	dnsRecordCreateRetryWait   = 200 * time.Millisecond
+)
+
+type DNSRecord struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     int64  `json:"ttl"`
+}
+
+// DNSRecordManager は配信者サブドメインのAレコードを管理する
+// name は "<username>" のようなゾーン内の相対名で扱う
+// CreateRecord はリトライされるので、同じ名前で何度呼んでもレコードは1つになる
+type DNSRecordManager interface {
+	CreateRecord(ctx context.Context, name string, addr string) error
+	DeleteRecord(ctx context.Context, name string) error
+	ListRecords(ctx context.Context) ([]DNSRecord, error)
+	// ResetRecords はゾーンを records だけにする (初期化用)
+	ResetRecords(ctx context.Context, records []DNSRecord) error
+}
+
+var dnsRecordManager DNSRecordManager = &noopDNSRecordManager{}
+
+func recordFQDN(name string) string {
+	if name == "" || name == "@" {
+		return powerDNSZoneName
+	}
+	return name + "." + powerDNSZoneName
+}
+
+func recordRelativeName(fqdn string) string {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if fqdn == powerDNSZoneName {
+		return "@"
+	}
+	return strings.TrimSuffix(fqdn, "."+powerDNSZoneName)
+}
+
+// loadZoneFileRecords はゾーンファイルからSOA/NS/Aレコードを読み込む
+// 内容はPowerDNSのrecordsテーブルと同じ表記 (名前の末尾のドットなし) にする
+func loadZoneFileRecords(path string, addr string) ([]DNSRecord, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+	content := strings.ReplaceAll(string(b), dnsZoneAddressHolder, addr)
+
+	var records []DNSRecord
+	zp := dns.NewZoneParser(strings.NewReader(content), dns.Fqdn(powerDNSZoneName), path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		record := DNSRecord{
+			Name: recordRelativeName(rr.Header().Name),
+			TTL:  int64(rr.Header().Ttl),
+		}
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			record.Type = "SOA"
+			record.Content = fmt.Sprintf("%s %s %d %d %d %d %d", strings.TrimSuffix(rr.Ns, "."), strings.TrimSuffix(rr.Mbox, "."), rr.Serial, rr.Refresh, rr.Retry, rr.Expire, rr.Minttl)
+		case *dns.NS:
+			record.Type = "NS"
+			record.Content = strings.TrimSuffix(rr.Ns, ".")
+		case *dns.A:
+			record.Type = "A"
+			record.Content = rr.A.String()
+		default:
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	return records, nil
+}
+
+// MySQLDNSRecordManager はPowerDNSのgmysqlバックエンドが参照する isudns スキーマに直接書き込む
+type MySQLDNSRecordManager struct {
+	db *sqlx.DB
+}
+
+func NewMySQLDNSRecordManager(db *sqlx.DB) *MySQLDNSRecordManager {
+	return &MySQLDNSRecordManager{db: db}
+}
+
+func (m *MySQLDNSRecordManager) domainID(ctx context.Context) (int64, error) {
+	var domainID int64
+	if err := m.db.GetContext(ctx, &domainID, "SELECT id FROM domains WHERE name = ?", powerDNSZoneName); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("zone %s is not found", powerDNSZoneName)
+		}
+		return 0, fmt.Errorf("failed to get domain id: %w", err)
+	}
+	return domainID, nil
+}
+
+func insertPowerDNSRecord(ctx context.Context, tx sqlx.ExecerContext, domainID int64, record DNSRecord) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO records (domain_id, name, type, content, ttl, prio, disabled, auth) VALUES (?, ?, ?, ?, ?, 0, 0, 1)", domainID, recordFQDN(record.Name), record.Type, record.Content, record.TTL); err != nil {
+		return fmt.Errorf("failed to insert record: %w", err)
+	}
+	return nil
+}
+
+// CreateRecord はrecordsテーブルに一意制約がないので、同じ名前のAレコードを消してから入れる
+func (m *MySQLDNSRecordManager) CreateRecord(ctx context.Context, name string, addr string) error {
+	domainID, err := m.domainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE domain_id = ? AND name = ? AND type = 'A'", domainID, recordFQDN(name)); err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	if err := insertPowerDNSRecord(ctx, tx, domainID, DNSRecord{Name: name, Type: "A", Content: addr}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQLDNSRecordManager) DeleteRecord(ctx context.Context, name string) error {
+	domainID, err := m.domainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM records WHERE domain_id = ? AND name = ? AND type = 'A'", domainID, recordFQDN(name)); err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQLDNSRecordManager) ListRecords(ctx context.Context) ([]DNSRecord, error) {
+	domainID, err := m.domainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Name    string `db:"name"`
+		Type    string `db:"type"`
+		Content string `db:"content"`
+		TTL     int64  `db:"ttl"`
+	}
+	if err := m.db.SelectContext(ctx, &rows, "SELECT name, type, content, IFNULL(ttl, 0) AS ttl FROM records WHERE domain_id = ? AND type = 'A' AND disabled = 0 ORDER BY id", domainID); err != nil {
+		return nil, fmt.Errorf("failed to get records: %w", err)
+	}
+
+	records := make([]DNSRecord, len(rows))
+	for i := range rows {
+		records[i] = DNSRecord{
+			Name:    recordRelativeName(rows[i].Name),
+			Type:    rows[i].Type,
+			Content: rows[i].Content,
+			TTL:     rows[i].TTL,
+		}
+	}
+	return records, nil
+}
+
+func (m *MySQLDNSRecordManager) ResetRecords(ctx context.Context, records []DNSRecord) error {
+	domainID, err := m.domainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE domain_id = ?", domainID); err != nil {
+		return fmt.Errorf("failed to delete records: %w", err)
+	}
+	for _, record := range records {
+		if err := insertPowerDNSRecord(ctx, tx, domainID, record); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// APIDNSRecordManager はPowerDNSのHTTP APIを使ってレコードを管理する
+// https://doc.powerdns.com/authoritative/http-api/zone.html
+type APIDNSRecordManager struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+func NewAPIDNSRecordManager(baseURL string, apiKey string) *APIDNSRecordManager {
+	return &APIDNSRecordManager{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+type powerDNSRRSet struct {
+	Name       string              `json:"name"`
+	Type       string              `json:"type"`
+	TTL        int64               `json:"ttl"`
+	ChangeType string              `json:"changetype,omitempty"`
+	Records    []powerDNSRRSetItem `json:"records"`
+}
+
+type powerDNSRRSetItem struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type powerDNSZone struct {
+	RRSets []powerDNSRRSet `json:"rrsets"`
+}
+
+func (m *APIDNSRecordManager) zoneURL() string {
+	return m.baseURL + "/api/v1/servers/localhost/zones/" + powerDNSZoneName + "."
+}
+
+func (m *APIDNSRecordManager) do(ctx context.Context, method string, body any, dest any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, m.zoneURL(), reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("X-API-Key", m.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request PowerDNS API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PowerDNS API returned %d: %s", resp.StatusCode, string(msg))
+	}
+	if dest != nil {
+		if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+			return fmt.Errorf("failed to decode PowerDNS API response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *APIDNSRecordManager) patch(ctx context.Context, rrsets ...powerDNSRRSet) error {
+	return m.do(ctx, http.MethodPatch, powerDNSZone{RRSets: rrsets}, nil)
+}
+
+func (m *APIDNSRecordManager) CreateRecord(ctx context.Context, name string, addr string) error {
+	return m.patch(ctx, powerDNSRRSet{
+		Name:       recordFQDN(name) + ".",
+		Type:       "A",
+		TTL:        0,
+		ChangeType: "REPLACE",
+		Records:    []powerDNSRRSetItem{{Content: addr}},
+	})
+}
+
+func (m *APIDNSRecordManager) DeleteRecord(ctx context.Context, name string) error {
+	return m.patch(ctx, powerDNSRRSet{
+		Name:       recordFQDN(name) + ".",
+		Type:       "A",
+		ChangeType: "DELETE",
+		Records:    []powerDNSRRSetItem{},
+	})
+}
+
+func (m *APIDNSRecordManager) ListRecords(ctx context.Context) ([]DNSRecord, error) {
+	var zone powerDNSZone
+	if err := m.do(ctx, http.MethodGet, nil, &zone); err != nil {
+		return nil, err
+	}
+
+	records := make([]DNSRecord, 0, len(zone.RRSets))
+	for _, rrset := range zone.RRSets {
+		if rrset.Type != "A" {
+			continue
+		}
+		for _, item := range rrset.Records {
+			if item.Disabled {
+				continue
+			}
+			records = append(records, DNSRecord{
+				Name:    recordRelativeName(rrset.Name),
+				Type:    rrset.Type,
+				Content: item.Content,
+				TTL:     rrset.TTL,
+			})
+		}
+	}
+	return records, nil
+}
+
+// ResetRecords は records にないAレコードを消し、records の名前と種類ごとに置き換える
+func (m *APIDNSRecordManager) ResetRecords(ctx context.Context, records []DNSRecord) error {
+	var zone powerDNSZone
+	if err := m.do(ctx, http.MethodGet, nil, &zone); err != nil {
+		return err
+	}
+
+	type rrsetKey struct{ name, typ string }
+	var (
+		rrsets []powerDNSRRSet
+		index  = make(map[rrsetKey]int)
+	)
+	for _, record := range records {
+		key := rrsetKey{name: recordFQDN(record.Name) + ".", typ: record.Type}
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, powerDNSRRSet{Name: key.name, Type: key.typ, TTL: record.TTL, ChangeType: "REPLACE"})
+		}
+		rrsets[i].Records = append(rrsets[i].Records, powerDNSRRSetItem{Content: powerDNSAPIContent(record.Type, record.Content)})
+	}
+	for _, rrset := range zone.RRSets {
+		if _, ok := index[rrsetKey{name: rrset.Name, typ: rrset.Type}]; ok || rrset.Type != "A" {
+			continue
+		}
+		rrsets = append(rrsets, powerDNSRRSet{Name: rrset.Name, Type: rrset.Type, ChangeType: "DELETE", Records: []powerDNSRRSetItem{}})
+	}
+	if len(rrsets) == 0 {
+		return nil
+	}
+	return m.patch(ctx, rrsets...)
+}
+
+// powerDNSAPIContent はrecordsテーブルの表記の内容を、SOA/NSの名前を完全修飾にしたAPIの表記にする
+func powerDNSAPIContent(typ, content string) string {
+	var n int
+	switch typ {
+	case "SOA":
+		n = 2
+	case "NS":
+		n = 1
+	default:
+		return content
+	}
+	fields := strings.Fields(content)
+	for i := 0; i < n && i < len(fields); i++ {
+		fields[i] = dns.Fqdn(fields[i])
+	}
+	return strings.Join(fields, " ")
+}
+
+// noopDNSRecordManager はPowerDNSを使わない環境(ISUCON13_POWERDNS_DISABLED)向け
+type noopDNSRecordManager struct{}
+
+func (m *noopDNSRecordManager) CreateRecord(ctx context.Context, name string, addr string) error {
+	return nil
+}
+
+func (m *noopDNSRecordManager) DeleteRecord(ctx context.Context, name string) error {
+	return nil
+}
+
+func (m *noopDNSRecordManager) ListRecords(ctx context.Context) ([]DNSRecord, error) {
+	return []DNSRecord{}, nil
+}
+
+func (m *noopDNSRecordManager) ResetRecords(ctx context.Context, records []DNSRecord) error {
+	return nil
+}
+
+func connectPowerDNSDB() (*sqlx.DB, error) {
+	const (
+		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
+		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
+		portEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_PORT"
+	)
+
+	conf := mysql.NewConfig()
+
+	// PowerDNSのgmysqlバックエンドと同じ接続先をデフォルトにする
+	conf.Net = "tcp"
+	conf.Addr = net.JoinHostPort("127.0.0.1", "3306")
+	conf.User = "isudns"
+	conf.Passwd = "isudns"
+	conf.DBName = "isudns"
+
+	if v, ok := os.LookupEnv(networkTypeEnvKey); ok {
+		conf.Net = v
+	}
+	if addr, ok := os.LookupEnv(addrEnvKey); ok {
+		if port, ok2 := os.LookupEnv(portEnvKey); ok2 {
+			conf.Addr = net.JoinHostPort(addr, port)
+		} else {
+			conf.Addr = net.JoinHostPort(addr, "3306")
+		}
+	}
+	if v, ok := os.LookupEnv(powerDNSDBUserEnvKey); ok {
+		conf.User = v
+	}
+	if v, ok := os.LookupEnv(powerDNSDBPasswordEnvKey); ok {
+		conf.Passwd = v
+	}
+	if v, ok := os.LookupEnv(powerDNSDBNameEnvKey); ok {
+		conf.DBName = v
+	}
+	conf.InterpolateParams = true
+
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func newDNSRecordManager() (DNSRecordManager, error) {
+	if v, ok := os.LookupEnv(powerDNSDisabledEnvKey); ok {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", powerDNSDisabledEnvKey, err)
+		}
+		if disabled {
+			return &noopDNSRecordManager{}, nil
+		}
+	}
+
+	backend := dnsRecordBackendMySQL
+	if v, ok := os.LookupEnv(dnsRecordBackendEnvKey); ok {
+		backend = v
+	}
+
+	switch backend {
+	case dnsRecordBackendMySQL:
+		db, err := connectPowerDNSDB()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect PowerDNS db: %w", err)
+		}
+		return NewMySQLDNSRecordManager(db), nil
+	case dnsRecordBackendAPI:
+		host := "127.0.0.1"
+		if v, ok := os.LookupEnv(powerDNSHostEnvKey); ok {
+			host = v
+		}
+		port := "8081"
+		if v, ok := os.LookupEnv(powerDNSAPIPortEnvKey); ok {
+			port = v
+		}
+		apiKey := "isudns"
+		if v, ok := os.LookupEnv(powerDNSAPIKeyEnvKey); ok {
+			apiKey = v
+		}
+		return NewAPIDNSRecordManager("http://"+net.JoinHostPort(host, port), apiKey), nil
+	default:
+		return nil, fmt.Errorf("unknown dns record backend: %s", backend)
+	}
+}
+
+// createDNSRecordWithRetry はレコード作成を試み、失敗した場合はバックグラウンドでリトライする
+// ユーザ登録自体はDNSの失敗で失敗させない
+func createDNSRecordWithRetry(ctx context.Context, logger echo.Logger, name string, addr string) {
+	err := dnsRecordManager.CreateRecord(ctx, name, addr)
+	if err == nil {
+		return
+	}
+	logger.Warnf("failed to create dns record for %s (attempt 1/%d): %v", name, dnsRecordCreateMaxAttempts, err)
+
+	go func() {
+		wait := dnsRecordCreateRetryWait
+		for attempt := 2; attempt <= dnsRecordCreateMaxAttempts; attempt++ {
+			time.Sleep(wait)
+			wait *= 2
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			err := dnsRecordManager.CreateRecord(ctx, name, addr)
+			cancel()
+			if err == nil {
+				return
+			}
+			logger.Warnf("failed to create dns record for %s (attempt %d/%d): %v", name, attempt, dnsRecordCreateMaxAttempts, err)
+		}
+		logger.Errorf("gave up creating dns record for %s", name)
+	}()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePowerDNSDB は MySQLDNSRecordManager が発行するクエリだけを解釈する database/sql のドライバ
+// isudns スキーマの domains と records をメモリ上に持つ
+type fakePowerDNSDB struct {
+	mu       sync.Mutex
+	domainID int64
+	records  []fakePowerDNSRecord
+}
+
+type fakePowerDNSRecord struct {
+	domainID int64
+	name     string
+	typ      string
+	content  string
+	ttl      int64
+}
+
+func newFakePowerDNSDB(t *testing.T) (*fakePowerDNSDB, *sqlx.DB) {
+	fake := &fakePowerDNSDB{domainID: 1}
+	db := sqlx.NewDb(sql.OpenDB(fake), "mysql")
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+func (f *fakePowerDNSDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakePowerDNSConn{db: f}, nil
+}
+func (f *fakePowerDNSDB) Driver() driver.Driver            { return f }
+func (f *fakePowerDNSDB) Open(string) (driver.Conn, error) { return &fakePowerDNSConn{db: f}, nil }
+
+func (f *fakePowerDNSDB) recordsOf(typ string) []fakePowerDNSRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var records []fakePowerDNSRecord
+	for _, r := range f.records {
+		if r.typ == typ {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+type fakePowerDNSConn struct {
+	db *fakePowerDNSDB
+	// tx はトランザクション中なら開始時点の records
+	tx []fakePowerDNSRecord
+}
+
+func (c *fakePowerDNSConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare is not supported: %s", query)
+}
+func (c *fakePowerDNSConn) Close() error { return nil }
+func (c *fakePowerDNSConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.tx = append([]fakePowerDNSRecord{}, c.db.records...)
+	return c, nil
+}
+
+func (c *fakePowerDNSConn) Commit() error {
+	c.tx = nil
+	return nil
+}
+
+func (c *fakePowerDNSConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.records = c.tx
+	c.tx = nil
+	return nil
+}
+
+func (c *fakePowerDNSConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	var affected int64
+	switch {
+	case query == "DELETE FROM records WHERE domain_id = ? AND name = ? AND type = 'A'":
+		c.db.records = deleteFakeRecords(c.db.records, &affected, func(r fakePowerDNSRecord) bool {
+			return r.domainID == args[0].Value && r.name == args[1].Value && r.typ == "A"
+		})
+	case query == "DELETE FROM records WHERE domain_id = ?":
+		c.db.records = deleteFakeRecords(c.db.records, &affected, func(r fakePowerDNSRecord) bool {
+			return r.domainID == args[0].Value
+		})
+	case strings.HasPrefix(query, "INSERT INTO records (domain_id, name, type, content, ttl, prio, disabled, auth) VALUES (?, ?, ?, ?, ?, 0, 0, 1)"):
+		c.db.records = append(c.db.records, fakePowerDNSRecord{
+			domainID: args[0].Value.(int64),
+			name:     args[1].Value.(string),
+			typ:      args[2].Value.(string),
+			content:  args[3].Value.(string),
+			ttl:      args[4].Value.(int64),
+		})
+		affected = 1
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func deleteFakeRecords(records []fakePowerDNSRecord, affected *int64, match func(fakePowerDNSRecord) bool) []fakePowerDNSRecord {
+	kept := records[:0:0]
+	for _, r := range records {
+		if match(r) {
+			*affected++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+func (c *fakePowerDNSConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	switch query {
+	case "SELECT id FROM domains WHERE name = ?":
+		rows := &fakeRows{columns: []string{"id"}}
+		if args[0].Value == powerDNSZoneName && c.db.domainID != 0 {
+			rows.values = append(rows.values, []driver.Value{c.db.domainID})
+		}
+		return rows, nil
+	case "SELECT name, type, content, IFNULL(ttl, 0) AS ttl FROM records WHERE domain_id = ? AND type = 'A' AND disabled = 0 ORDER BY id":
+		rows := &fakeRows{columns: []string{"name", "type", "content", "ttl"}}
+		for _, r := range c.db.records {
+			if r.domainID == args[0].Value && r.typ == "A" {
+				rows.values = append(rows.values, []driver.Value{r.name, r.typ, r.content, r.ttl})
+			}
+		}
+		return rows, nil
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestMySQLDNSRecordManager(t *testing.T) {
+	ctx := context.Background()
+	fake, db := newFakePowerDNSDB(t)
+	m := NewMySQLDNSRecordManager(db)
+
+	// リトライで同じ名前を2回作ってもレコードは1つ
+	require.NoError(t, m.CreateRecord(ctx, "alice", "192.0.2.1"))
+	require.NoError(t, m.CreateRecord(ctx, "alice", "192.0.2.1"))
+	require.NoError(t, m.CreateRecord(ctx, "bob", "192.0.2.1"))
+
+	records, err := m.ListRecords(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []DNSRecord{
+		{Name: "alice", Type: "A", Content: "192.0.2.1"},
+		{Name: "bob", Type: "A", Content: "192.0.2.1"},
+	}, records)
+
+	require.NoError(t, m.DeleteRecord(ctx, "alice"))
+	records, err = m.ListRecords(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []DNSRecord{{Name: "bob", Type: "A", Content: "192.0.2.1"}}, records)
+
+	// 初期化ではユーザのレコードが消え、ゾーンファイルのレコードだけになる
+	require.NoError(t, m.ResetRecords(ctx, []DNSRecord{
+		{Name: "@", Type: "SOA", Content: "ns1.u.isucon.dev hostmaster.u.isucon.dev 0 10800 3600 604800 3600", TTL: 3600},
+		{Name: "pipe", Type: "A", Content: "192.0.2.1"},
+	}))
+	records, err = m.ListRecords(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []DNSRecord{{Name: "pipe", Type: "A", Content: "192.0.2.1"}}, records)
+	require.Len(t, fake.recordsOf("SOA"), 1)
+	assert.Equal(t, "u.isucon.dev", fake.recordsOf("SOA")[0].name)
+
+	// ゾーンがなければエラー
+	fake.domainID = 0
+	assert.Error(t, m.CreateRecord(ctx, "carol", "192.0.2.1"))
+}
+
+// fakePowerDNSAPI はPowerDNSのゾーンAPIのGETとPATCHだけを実装する
+type fakePowerDNSAPI struct {
+	mu     sync.Mutex
+	rrsets map[string]powerDNSRRSet
+}
+
+func newFakePowerDNSAPI(t *testing.T) (*fakePowerDNSAPI, *httptest.Server) {
+	fake := &fakePowerDNSAPI{rrsets: make(map[string]powerDNSRRSet)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func (f *fakePowerDNSAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-API-Key") != "isudns" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/api/v1/servers/localhost/zones/u.isucon.dev." {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		zone := powerDNSZone{RRSets: []powerDNSRRSet{}}
+		for _, rrset := range f.rrsets {
+			zone.RRSets = append(zone.RRSets, rrset)
+		}
+		json.NewEncoder(w).Encode(zone)
+	case http.MethodPatch:
+		var zone powerDNSZone
+		if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rrset := range zone.RRSets {
+			key := rrset.Name + "/" + rrset.Type
+			switch rrset.ChangeType {
+			case "REPLACE":
+				rrset.ChangeType = ""
+				f.rrsets[key] = rrset
+			case "DELETE":
+				delete(f.rrsets, key)
+			default:
+				http.Error(w, "unknown changetype", http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPIDNSRecordManager(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakePowerDNSAPI(t)
+	m := NewAPIDNSRecordManager(srv.URL+"/", "isudns")
+
+	require.NoError(t, m.CreateRecord(ctx, "alice", "192.0.2.1"))
+	require.NoError(t, m.CreateRecord(ctx, "alice", "192.0.2.1"))
+	records, err := m.ListRecords(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []DNSRecord{{Name: "alice", Type: "A", Content: "192.0.2.1"}}, records)
+
+	require.NoError(t, m.DeleteRecord(ctx, "alice"))
+	records, err = m.ListRecords(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	require.NoError(t, m.CreateRecord(ctx, "bob", "192.0.2.1"))
+	require.NoError(t, m.ResetRecords(ctx, []DNSRecord{
+		{Name: "@", Type: "SOA", Content: "ns1.u.isucon.dev hostmaster.u.isucon.dev 0 10800 3600 604800 3600", TTL: 3600},
+		{Name: "@", Type: "NS", Content: "ns1.u.isucon.dev"},
+		{Name: "pipe", Type: "A", Content: "192.0.2.1"},
+	}))
+	records, err = m.ListRecords(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []DNSRecord{{Name: "pipe", Type: "A", Content: "192.0.2.1"}}, records)
+	assert.Equal(t, "ns1.u.isucon.dev. hostmaster.u.isucon.dev. 0 10800 3600 604800 3600", fake.rrsets["u.isucon.dev./SOA"].Records[0].Content)
+	assert.Equal(t, "ns1.u.isucon.dev.", fake.rrsets["u.isucon.dev./NS"].Records[0].Content)
+
+	// APIキーが違えばエラー
+	assert.Error(t, NewAPIDNSRecordManager(srv.URL, "wrong").CreateRecord(ctx, "carol", "192.0.2.1"))
+}
+
+func TestLoadZoneFileRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "u.isucon.dev.zone")
+	require.NoError(t, os.WriteFile(path, []byte(`$TTL 3600
+@   SOA  ns1 hostmaster.u.isucon.dev. ( 0 10800 3600 604800 3600 )
+@        0 IN NS ns1.u.isucon.dev.
+@        0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
+pipe     0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
+`), 0644))
+
+	records, err := loadZoneFileRecords(path, "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, []DNSRecord{
+		{Name: "@", Type: "SOA", Content: "ns1.u.isucon.dev hostmaster.u.isucon.dev 0 10800 3600 604800 3600", TTL: 3600},
+		{Name: "@", Type: "NS", Content: "ns1.u.isucon.dev"},
+		{Name: "@", Type: "A", Content: "192.0.2.1"},
+		{Name: "pipe", Type: "A", Content: "192.0.2.1"},
+	}, records)
+}
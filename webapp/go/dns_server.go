@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/isucon/isucon13/webapp/go/dnsguard"
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+const (
+	embeddedDNSAddressEnvKey = "ISUCON13_EMBEDDED_DNS_ADDRESS"
+	dnsGuardDisabledEnvKey   = "ISUCON13_DNSGUARD_DISABLED"
+	dnsGuardAddressEnvKey    = "ISUCON13_DNSGUARD_ADDRESS"
+	dnsGuardUpstreamEnvKey   = "ISUCON13_DNSGUARD_UPSTREAM"
+	dnsZoneFilePath          = "../pdns/u.isucon.dev.zone"
+	dnsZoneAddressHolder     = "<ISUCON_SUBDOMAIN_ADDRESS>"
+)
+
+var (
+	// embeddedDNSZone は nil でなければ組み込みDNSサーバが有効
+	embeddedDNSZone *DNSZone
+	// dnsGuard は nil でなければDNSの水責め対策が有効
+	dnsGuard *dnsguard.Guard
+)
+
+// DNSZone は u.isucon.dev ゾーンの名前をメモリ上に保持する
+// 未登録の名前にはDBを見ずにNXDOMAINを返す
+type DNSZone struct {
+	mu     *sync.RWMutex
+	origin string
+	addr   net.IP
+	names  map[string]struct{}
+	soa    *dns.SOA
+	ns     []dns.RR
+	// pending は Reset 中に追加・削除された名前 (true なら追加)。作り直した集合に反映する
+	pending map[string]bool
+}
+
+func NewDNSZone(addr string) *DNSZone {
+	origin := dns.Fqdn(powerDNSZoneName)
+	return &DNSZone{
+		mu:     new(sync.RWMutex),
+		origin: origin,
+		addr:   net.ParseIP(addr).To4(),
+		names:  make(map[string]struct{}, 10000),
+		soa: &dns.SOA{
+			Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "ns1." + origin,
+			Mbox:    "hostmaster." + origin,
+			Refresh: 10800,
+			Retry:   3600,
+			Expire:  604800,
+			Minttl:  3600,
+		},
+		ns: []dns.RR{
+			&dns.NS{
+				Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 0},
+				Ns:  "ns1." + origin,
+			},
+		},
+	}
+}
+
+// dnsZoneFile はゾーンファイルから読み込んだSOA/NSと静的なAレコードの名前
+type dnsZoneFile struct {
+	soa   *dns.SOA
+	ns    []dns.RR
+	names map[string]struct{}
+}
+
+// parseZoneFile はPowerDNSと同じゾーンファイルを読み込む。ゾーンには触らないのでロックは要らない
+func (z *DNSZone) parseZoneFile(path string) (*dnsZoneFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+	content := strings.ReplaceAll(string(b), dnsZoneAddressHolder, z.addr.String())
+
+	f := &dnsZoneFile{names: make(map[string]struct{})}
+	zp := dns.NewZoneParser(strings.NewReader(content), z.origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			f.soa = rr
+		case *dns.NS:
+			f.ns = append(f.ns, rr)
+		case *dns.A:
+			f.names[z.relativeName(rr.Hdr.Name)] = struct{}{}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	return f, nil
+}
+
+func (z *DNSZone) relativeName(fqdn string) string {
+	fqdn = strings.ToLower(dns.Fqdn(fqdn))
+	if fqdn == z.origin {
+		return "@"
+	}
+	return strings.TrimSuffix(fqdn, "."+z.origin)
+}
+
+func (z *DNSZone) Add(name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	name = strings.ToLower(name)
+	z.names[name] = struct{}{}
+	if z.pending != nil {
+		z.pending[name] = true
+	}
+}
+
+func (z *DNSZone) Remove(name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	name = strings.ToLower(name)
+	delete(z.names, name)
+	if z.pending != nil {
+		z.pending[name] = false
+	}
+}
+
+func (z *DNSZone) Has(name string) bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	_, ok := z.names[name]
+	return ok
+}
+
+// Reset はゾーンファイルとusersテーブルから名前の集合を作り直す
+func (z *DNSZone) Reset(ctx context.Context, zoneFilePath string) error {
+	z.beginReset()
+	defer z.endReset()
+
+	var usernames []string
+	if err := dbConn.SelectContext(ctx, &usernames, "SELECT name FROM users"); err != nil {
+		return fmt.Errorf("failed to get usernames: %w", err)
+	}
+	return z.reset(zoneFilePath, usernames)
+}
+
+// beginReset から endReset までの Add/Remove を控えておき、usersテーブルを読んだ後の変更を取りこぼさないようにする
+func (z *DNSZone) beginReset() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.pending = make(map[string]bool)
+}
+
+func (z *DNSZone) endReset() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.pending = nil
+}
+
+// reset は新しい名前の集合を作ってから入れ替える。作っている間も古い集合で応答できる
+func (z *DNSZone) reset(zoneFilePath string, usernames []string) error {
+	f, err := z.parseZoneFile(zoneFilePath)
+	if err != nil {
+		return err
+	}
+	names := f.names
+	for _, name := range usernames {
+		names[strings.ToLower(name)] = struct{}{}
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for name, added := range z.pending {
+		if added {
+			names[name] = struct{}{}
+		} else {
+			delete(names, name)
+		}
+	}
+	z.names = names
+	if f.soa != nil {
+		z.soa = f.soa
+	}
+	if len(f.ns) > 0 {
+		z.ns = f.ns
+	}
+	return nil
+}
+
+func (z *DNSZone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = soa.Minttl
+	return soa
+}
+
+func (z *DNSZone) aRecord(fqdn string) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   z.addr,
+	}
+}
+
+func (z *DNSZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	qname := strings.ToLower(q.Name)
+	if qname != z.origin && !strings.HasSuffix(qname, "."+z.origin) {
+		m.Authoritative = false
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	name := z.relativeName(qname)
+	if name == "@" {
+		z.mu.RLock()
+		switch q.Qtype {
+		case dns.TypeSOA:
+			m.Answer = append(m.Answer, dns.Copy(z.soa))
+		case dns.TypeNS:
+			for _, ns := range z.ns {
+				m.Answer = append(m.Answer, dns.Copy(ns))
+			}
+		case dns.TypeA, dns.TypeANY:
+			m.Answer = append(m.Answer, z.aRecord(q.Name))
+		default:
+			m.Ns = append(m.Ns, z.negativeSOA())
+		}
+		z.mu.RUnlock()
+		w.WriteMsg(m)
+		return
+	}
+
+	if !z.Has(name) {
+		m.SetRcode(r, dns.RcodeNameError)
+		z.mu.RLock()
+		m.Ns = append(m.Ns, z.negativeSOA())
+		z.mu.RUnlock()
+		w.WriteMsg(m)
+		return
+	}
+
+	z.mu.RLock()
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeANY:
+		m.Answer = append(m.Answer, z.aRecord(q.Name))
+	default:
+		// NODATA
+		m.Ns = append(m.Ns, z.negativeSOA())
+	}
+	z.mu.RUnlock()
+	w.WriteMsg(m)
+}
+
+// startEmbeddedDNSServer はUDPとTCPで組み込みDNSサーバを起動する
+func startEmbeddedDNSServer(logger echo.Logger, addr string, handler dns.Handler) {
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: handler,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				logger.Errorf("failed to start embedded DNS server (%s): %v", server.Net, err)
+			}
+		}()
+	}
+}
+
+func dnsGuardEnabled() (bool, error) {
+	v, ok := os.LookupEnv(dnsGuardDisabledEnvKey)
+	if !ok {
+		return true, nil
+	}
+	disabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", dnsGuardDisabledEnvKey, err)
+	}
+	return !disabled, nil
+}
+
+// setupDNSServers は組み込みDNSサーバ、またはPowerDNSの前段に置くdnsguardのプロキシを起動する
+func setupDNSServers(logger echo.Logger) error {
+	guardEnabled, err := dnsGuardEnabled()
+	if err != nil {
+		return err
+	}
+
+	if dnsAddr, ok := os.LookupEnv(embeddedDNSAddressEnvKey); ok {
+		zone := NewDNSZone(powerDNSSubdomainAddress)
+		if err := zone.Reset(context.Background(), dnsZoneFilePath); err != nil {
+			return fmt.Errorf("failed to load dns zone: %w", err)
+		}
+		embeddedDNSZone = zone
+
+		var handler dns.Handler = zone
+		if guardEnabled {
+			dnsGuard = dnsguard.New(zone, dnsguard.DefaultConfig())
+			handler = dnsGuard
+		}
+		startEmbeddedDNSServer(logger, dnsAddr, handler)
+		return nil
+	}
+
+	guardAddr, ok := os.LookupEnv(dnsGuardAddressEnvKey)
+	if !ok || !guardEnabled {
+		return nil
+	}
+	upstream, ok := os.LookupEnv(dnsGuardUpstreamEnvKey)
+	if !ok {
+		return fmt.Errorf("environ %s must be provided with %s", dnsGuardUpstreamEnvKey, dnsGuardAddressEnvKey)
+	}
+	dnsGuard = dnsguard.New(dnsguard.NewForwarder(upstream), dnsguard.DefaultConfig())
+	startEmbeddedDNSServer(logger, guardAddr, dnsGuard)
+	return nil
+}
+
+// registerDNSName は新規ユーザの名前を組み込みゾーンに追加し、ネガティブキャッシュから消す
+func registerDNSName(name string) {
+	if embeddedDNSZone != nil {
+		embeddedDNSZone.Add(name)
+	}
+	if dnsGuard != nil {
+		dnsGuard.Forget(recordFQDN(name))
+	}
+}
+
+// unregisterDNSName は組み込みゾーンから名前を消す
+func unregisterDNSName(name string) {
+	if embeddedDNSZone != nil {
+		embeddedDNSZone.Remove(name)
+	}
+}
+
+// DNS水責め対策のメトリクス
+// GET /debug/dnsguard
+func getDNSGuardMetricsHandler(c echo.Context) error {
+	if dnsGuard == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "dnsguard is not enabled")
+	}
+	return c.JSON(http.StatusOK, dnsGuard.Metrics())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDNSWriter struct {
+	written []*dns.Msg
+}
+
+func (w *testDNSWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *testDNSWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000}
+}
+func (w *testDNSWriter) WriteMsg(m *dns.Msg) error   { w.written = append(w.written, m); return nil }
+func (w *testDNSWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testDNSWriter) Close() error                { return nil }
+func (w *testDNSWriter) TsigStatus() error           { return nil }
+func (w *testDNSWriter) TsigTimersOnly(bool)         {}
+func (w *testDNSWriter) Hijack()                     {}
+
+func writeTestZoneFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "u.isucon.dev.zone")
+	require.NoError(t, os.WriteFile(path, []byte(`$TTL 3600
+@   SOA  ns1 hostmaster.u.isucon.dev. ( 0 10800 3600 604800 60 )
+@        0 IN NS ns1.u.isucon.dev.
+@        0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
+ns1      0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
+pipe     0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
+`), 0644))
+	return path
+}
+
+func TestDNSZoneReset(t *testing.T) {
+	zonePath := writeTestZoneFile(t)
+	z := NewDNSZone("192.0.2.10")
+
+	require.NoError(t, z.reset(zonePath, []string{"Alice"}))
+	assert.True(t, z.Has("pipe"))
+	assert.True(t, z.Has("alice"))
+	assert.Equal(t, uint32(60), z.soa.Minttl)
+
+	// 作り直すと消えたユーザはなくなる
+	z.Add("bob")
+	require.NoError(t, z.reset(zonePath, []string{"alice"}))
+	assert.False(t, z.Has("bob"))
+
+	// usersテーブルを読んだ後の追加・削除は作り直した集合にも残す
+	z.beginReset()
+	z.Add("carol")
+	z.Remove("alice")
+	require.NoError(t, z.reset(zonePath, []string{"alice"}))
+	z.endReset()
+	assert.True(t, z.Has("carol"))
+	assert.False(t, z.Has("alice"))
+
+	// ゾーンファイルが読めなければ今の集合のまま
+	assert.Error(t, z.reset(filepath.Join(t.TempDir(), "missing.zone"), nil))
+	assert.True(t, z.Has("carol"))
+}
+
+func TestDNSZoneServeDNS(t *testing.T) {
+	z := NewDNSZone("192.0.2.10")
+	require.NoError(t, z.reset(writeTestZoneFile(t), []string{"alice"}))
+
+	lookup := func(name string, qtype uint16) *dns.Msg {
+		w := &testDNSWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		z.ServeDNS(w, m)
+		require.Len(t, w.written, 1)
+		return w.written[0]
+	}
+
+	res := lookup("Alice.u.isucon.dev.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.Len(t, res.Answer, 1)
+	assert.Equal(t, "192.0.2.10", res.Answer[0].(*dns.A).A.String())
+
+	res = lookup("missing.u.isucon.dev.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Len(t, res.Ns, 1)
+	assert.Equal(t, uint32(60), res.Ns[0].Header().Ttl)
+
+	// 名前はあるがAレコード以外はNODATA
+	res = lookup("alice.u.isucon.dev.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+	assert.Len(t, res.Ns, 1)
+
+	res = lookup("u.isucon.dev.", dns.TypeNS)
+	require.Len(t, res.Answer, 1)
+	assert.Equal(t, "ns1.u.isucon.dev.", res.Answer[0].(*dns.NS).Ns)
+
+	res = lookup("example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+}
@@ -0,0 +1,173 @@
+package dnsguard
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type negativeCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type negativeCacheEntry struct {
+	msg      *dns.Msg
+	storedAt time.Time
+	expireAt time.Time
+}
+
+// negativeCache はNXDOMAIN/NODATA応答をSOAのminimumに従ってキャッシュする (RFC 2308)
+type negativeCache struct {
+	mu      sync.RWMutex
+	entries map[negativeCacheKey]*negativeCacheEntry
+	// qtypes は名前ごとにキャッシュしているqtype。名前でまとめて消すのに使う
+	qtypes     map[string][]uint16
+	maxEntries int
+	maxTTL     time.Duration
+}
+
+func newNegativeCache(maxEntries int, maxTTL time.Duration) *negativeCache {
+	return &negativeCache{
+		entries:    make(map[negativeCacheKey]*negativeCacheEntry, maxEntries),
+		qtypes:     make(map[string][]uint16, maxEntries),
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+	}
+}
+
+func cacheKey(q dns.Question) negativeCacheKey {
+	return negativeCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+}
+
+// negativeTTL は権威セクションのSOAから min(SOA TTL, MINIMUM) を求める
+func negativeTTL(msg *dns.Msg) (time.Duration, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+func isNegative(msg *dns.Msg) bool {
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+	return msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0
+}
+
+func (c *negativeCache) get(q dns.Question, now time.Time) (*dns.Msg, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[cacheKey(q)]
+	c.mu.RUnlock()
+	if !ok || !now.Before(entry.expireAt) {
+		return nil, false
+	}
+
+	// 残りTTLに合わせて権威セクションのTTLを減らして返す
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.storedAt) / time.Second)
+	for _, rr := range msg.Ns {
+		if rr.Header().Ttl > elapsed {
+			rr.Header().Ttl -= elapsed
+		} else {
+			rr.Header().Ttl = 0
+		}
+	}
+	return msg, true
+}
+
+func (c *negativeCache) set(q dns.Question, msg *dns.Msg, now time.Time) {
+	if !isNegative(msg) {
+		return
+	}
+	ttl, ok := negativeTTL(msg)
+	if !ok || ttl <= 0 {
+		return
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.evictLocked(now)
+	}
+	key := cacheKey(q)
+	if _, ok := c.entries[key]; !ok {
+		c.qtypes[key.name] = append(c.qtypes[key.name], key.qtype)
+	}
+	c.entries[key] = &negativeCacheEntry{
+		msg:      msg.Copy(),
+		storedAt: now,
+		expireAt: now.Add(ttl),
+	}
+}
+
+func (c *negativeCache) deleteLocked(key negativeCacheKey) {
+	delete(c.entries, key)
+	qtypes := slices.DeleteFunc(c.qtypes[key.name], func(qtype uint16) bool { return qtype == key.qtype })
+	if len(qtypes) == 0 {
+		delete(c.qtypes, key.name)
+	} else {
+		c.qtypes[key.name] = qtypes
+	}
+}
+
+// forget は名前のエントリをqtypeごとにキーで消す
+func (c *negativeCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, qtype := range c.qtypes[name] {
+		delete(c.entries, negativeCacheKey{name: name, qtype: qtype})
+	}
+	delete(c.qtypes, name)
+}
+
+func (c *negativeCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[negativeCacheKey]*negativeCacheEntry, c.maxEntries)
+	c.qtypes = make(map[string][]uint16, c.maxEntries)
+}
+
+// evictLocked は期限切れのエントリを消し、それでも溢れる場合は任意の1件を消す
+func (c *negativeCache) evictLocked(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expireAt) {
+			c.deleteLocked(key)
+		}
+	}
+	if len(c.entries) < c.maxEntries {
+		return
+	}
+	for key := range c.entries {
+		c.deleteLocked(key)
+		return
+	}
+}
+
+func (c *negativeCache) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expireAt) {
+			c.deleteLocked(key)
+		}
+	}
+}
+
+func (c *negativeCache) len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
@@ -0,0 +1,247 @@
+// Package dnsguard は権威DNSサーバの前段に置く水責め(ランダムサブドメイン)攻撃対策
+//
+// 送信元ごとの応答レート制限(RRL)、SOA minimum に従った積極的なネガティブキャッシュ、
+// 同一ゾーンへのNXDOMAINを大量に受けている送信元へのslip(TC応答)/破棄を行う。
+// 存在する名前への肯定応答はNXDOMAINの判定とは別枠で扱うので、攻撃中も正規の名前解決は遅くならない。
+package dnsguard
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type Config struct {
+	// ResponsesPerSecond, Burst は送信元ごとの肯定応答の上限
+	ResponsesPerSecond float64
+	Burst              int
+	// ErrorsPerSecond, ErrorBurst は送信元ごとのNXDOMAIN/NODATA応答の上限
+	ErrorsPerSecond float64
+	ErrorBurst      int
+	// Slip は制限に掛かったUDP応答のうち何件に1件をTC付きで返すか (0なら全て破棄、1なら全てTC)
+	Slip int
+
+	// NXDomainWindow の間に同一送信元・同一ゾーンへ NXDomainThreshold を超えるNXDOMAINを返したら
+	// PenaltyDuration の間その送信元へのNXDOMAINをslip対象にする
+	NXDomainWindow    time.Duration
+	NXDomainThreshold int
+	PenaltyDuration   time.Duration
+
+	NegativeCacheSize int
+	MaxNegativeTTL    time.Duration
+	SweepInterval     time.Duration
+
+	// Now はテスト用に時刻を差し替えるためのもの
+	Now func() time.Time
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ResponsesPerSecond: 1000,
+		Burst:              2000,
+		ErrorsPerSecond:    50,
+		ErrorBurst:         100,
+		Slip:               2,
+		NXDomainWindow:     time.Second,
+		NXDomainThreshold:  20,
+		PenaltyDuration:    30 * time.Second,
+		NegativeCacheSize:  100000,
+		MaxNegativeTTL:     time.Hour,
+		SweepInterval:      10 * time.Second,
+		Now:                time.Now,
+	}
+}
+
+// Guard は dns.Handler をラップして攻撃対策を行う
+type Guard struct {
+	next      dns.Handler
+	cfg       Config
+	cache     *negativeCache
+	positive  *rateLimiter
+	negative  *rateLimiter
+	nxdomains *nxdomainTracker
+	metrics   *Metrics
+
+	slipCount atomic.Uint64
+	lastSweep atomic.Int64
+}
+
+func New(next dns.Handler, cfg Config) *Guard {
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	g := &Guard{
+		next:      next,
+		cfg:       cfg,
+		cache:     newNegativeCache(cfg.NegativeCacheSize, cfg.MaxNegativeTTL),
+		positive:  newRateLimiter(cfg.ResponsesPerSecond, cfg.Burst),
+		negative:  newRateLimiter(cfg.ErrorsPerSecond, cfg.ErrorBurst),
+		nxdomains: newNXDomainTracker(cfg.NXDomainWindow, cfg.NXDomainThreshold, cfg.PenaltyDuration),
+		metrics:   &Metrics{},
+	}
+	g.lastSweep.Store(cfg.Now().UnixNano())
+	return g
+}
+
+// Metrics は現在のカウンタを返す
+func (g *Guard) Metrics() MetricsSnapshot {
+	s := g.metrics.snapshot()
+	s.CacheEntries = g.cache.len()
+	s.TrackedSources = g.nxdomains.len()
+	return s
+}
+
+// Forget は名前が新しく登録されたときにネガティブキャッシュから消す
+func (g *Guard) Forget(name string) {
+	g.cache.forget(strings.ToLower(dns.Fqdn(name)))
+}
+
+// Flush はネガティブキャッシュを全て消す
+func (g *Guard) Flush() {
+	g.cache.flush()
+}
+
+func (g *Guard) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	now := g.cfg.Now()
+	g.metrics.queries.Add(1)
+	g.maybeSweep(now)
+
+	if len(r.Question) != 1 {
+		g.next.ServeDNS(w, r)
+		return
+	}
+	q := r.Question[0]
+
+	resp, ok := g.cache.get(q, now)
+	if ok {
+		g.metrics.cacheHits.Add(1)
+		resp.Id = r.Id
+		resp.Question = r.Question
+		resp.RecursionDesired = r.RecursionDesired
+	} else {
+		g.metrics.cacheMisses.Add(1)
+		cw := &captureWriter{ResponseWriter: w}
+		g.next.ServeDNS(cw, r)
+		if cw.msg == nil {
+			return
+		}
+		resp = cw.msg
+		g.cache.set(q, resp, now)
+	}
+
+	src := sourceKey(w.RemoteAddr())
+	udp := isUDP(w.RemoteAddr())
+
+	limited := false
+	if isNegative(resp) {
+		if resp.Rcode == dns.RcodeNameError {
+			g.metrics.nxdomains.Add(1)
+			flagged, newlyFlagged := g.nxdomains.observe(src, zoneOf(q.Name, resp), now)
+			if newlyFlagged {
+				g.metrics.suspiciousSource.Add(1)
+			}
+			limited = flagged
+		}
+		if !g.negative.allow(src, now) {
+			limited = true
+		}
+	} else if !g.positive.allow(src, now) {
+		limited = true
+	}
+
+	// TCPは送信元が詐称できないので制限しない
+	if limited && udp {
+		g.metrics.rateLimited.Add(1)
+		g.slip(w, r)
+		return
+	}
+
+	if err := w.WriteMsg(resp); err == nil {
+		g.metrics.answered.Add(1)
+	}
+}
+
+// slip は Slip 件に1件だけTC付きの空応答を返してTCPでの再問い合わせを促し、残りは破棄する
+func (g *Guard) slip(w dns.ResponseWriter, r *dns.Msg) {
+	if g.cfg.Slip > 0 && g.slipCount.Add(1)%uint64(g.cfg.Slip) == 0 {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		if err := w.WriteMsg(m); err == nil {
+			g.metrics.truncated.Add(1)
+		}
+		return
+	}
+	g.metrics.dropped.Add(1)
+}
+
+func (g *Guard) maybeSweep(now time.Time) {
+	last := g.lastSweep.Load()
+	if now.UnixNano()-last < int64(g.cfg.SweepInterval) {
+		return
+	}
+	if !g.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	g.cache.sweep(now)
+	g.positive.sweep(now, g.cfg.SweepInterval)
+	g.negative.sweep(now, g.cfg.SweepInterval)
+	g.nxdomains.sweep(now)
+}
+
+// zoneOf は応答のSOAの所有者名をゾーンとみなす。無ければ問い合わせ名の親
+func zoneOf(qname string, resp *dns.Msg) string {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(soa.Hdr.Name)
+		}
+	}
+	qname = strings.ToLower(qname)
+	if i := strings.IndexByte(qname, '.'); i >= 0 && i+1 < len(qname) {
+		return qname[i+1:]
+	}
+	return qname
+}
+
+func isUDP(addr net.Addr) bool {
+	_, ok := addr.(*net.UDPAddr)
+	return ok
+}
+
+// captureWriter は次のハンドラの応答を書き込まずに受け取る
+type captureWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Forwarder は問い合わせをそのまま上流の権威サーバ(PowerDNSなど)に転送する
+type Forwarder struct {
+	Upstream string
+	Client   *dns.Client
+}
+
+func NewForwarder(upstream string) *Forwarder {
+	return &Forwarder{
+		Upstream: upstream,
+		Client:   &dns.Client{Net: "udp", Timeout: time.Second},
+	}
+}
+
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	resp, _, err := f.Client.Exchange(r, f.Upstream)
+	if err != nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	w.WriteMsg(resp)
+}
@@ -0,0 +1,178 @@
+package dnsguard
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type testWriter struct {
+	remote  net.Addr
+	written []*dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.written = append(w.written, m); return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// testZone は "exists.u.isucon.dev." だけを持つゾーン
+type testZone struct {
+	calls int
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	z.calls++
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.Question[0].Name == "exists.u.isucon.dev." {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	} else {
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "u.isucon.dev.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns1.u.isucon.dev.",
+			Mbox:   "hostmaster.u.isucon.dev.",
+			Minttl: 60,
+		})
+	}
+	w.WriteMsg(m)
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func newTestGuard(zone dns.Handler) (*Guard, *testClock) {
+	clock := &testClock{now: time.Date(2023, 11, 25, 10, 0, 0, 0, time.UTC)}
+	cfg := DefaultConfig()
+	cfg.Now = clock.Now
+	return New(zone, cfg), clock
+}
+
+func query(g *Guard, w *testWriter, name string) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	g.ServeDNS(w, m)
+}
+
+func TestNegativeCache(t *testing.T) {
+	zone := &testZone{}
+	g, clock := newTestGuard(zone)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000}}
+
+	query(g, w, "missing.u.isucon.dev.")
+	query(g, w, "missing.u.isucon.dev.")
+	assert.Equal(t, 1, zone.calls)
+	assert.Len(t, w.written, 2)
+	assert.Equal(t, dns.RcodeNameError, w.written[1].Rcode)
+
+	// SOAのminimum(60秒)を過ぎたら再度問い合わせる
+	clock.now = clock.now.Add(61 * time.Second)
+	query(g, w, "missing.u.isucon.dev.")
+	assert.Equal(t, 2, zone.calls)
+
+	// 登録された名前はキャッシュから消える
+	g.Forget("missing.u.isucon.dev")
+	query(g, w, "missing.u.isucon.dev.")
+	assert.Equal(t, 3, zone.calls)
+
+	metrics := g.Metrics()
+	assert.Equal(t, uint64(4), metrics.Queries)
+	assert.Equal(t, uint64(1), metrics.CacheHits)
+}
+
+func TestNegativeCacheForget(t *testing.T) {
+	zone := &testZone{}
+	g, clock := newTestGuard(zone)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000}}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX} {
+		m := new(dns.Msg)
+		m.SetQuestion("missing.u.isucon.dev.", qtype)
+		g.ServeDNS(w, m)
+	}
+	query(g, w, "other.u.isucon.dev.")
+	assert.Equal(t, 4, g.cache.len())
+
+	// 同じ名前のqtypeはすべて消え、他の名前は残る
+	g.Forget("MISSING.u.isucon.dev")
+	assert.Equal(t, 1, g.cache.len())
+	assert.NotContains(t, g.cache.qtypes, "missing.u.isucon.dev.")
+
+	// 期限切れで消えたエントリは名前ごとのqtypeからも消える
+	clock.now = clock.now.Add(time.Hour)
+	g.cache.sweep(clock.now)
+	assert.Equal(t, 0, g.cache.len())
+	assert.Empty(t, g.cache.qtypes)
+}
+
+func TestWaterTortureSlip(t *testing.T) {
+	zone := &testZone{}
+	g, _ := newTestGuard(zone)
+	attacker := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000}}
+
+	for i := 0; i < 100; i++ {
+		query(g, attacker, fmt.Sprintf("random%d.u.isucon.dev.", i))
+	}
+
+	truncated := 0
+	for _, m := range attacker.written {
+		if m.Truncated {
+			truncated++
+		}
+	}
+	metrics := g.Metrics()
+	assert.Equal(t, uint64(1), metrics.SuspiciousSources)
+	assert.Greater(t, truncated, 0)
+	assert.Less(t, len(attacker.written), 100)
+	assert.Equal(t, uint64(100-len(attacker.written)), metrics.Dropped)
+
+	// 同じ送信元からでも存在する名前は解決できる
+	attacker.written = nil
+	query(g, attacker, "exists.u.isucon.dev.")
+	assert.Len(t, attacker.written, 1)
+	assert.False(t, attacker.written[0].Truncated)
+	assert.Len(t, attacker.written[0].Answer, 1)
+
+	// TCPでの問い合わせは制限しない
+	tcp := &testWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10001}}
+	query(g, tcp, "random-tcp.u.isucon.dev.")
+	assert.Len(t, tcp.written, 1)
+	assert.Equal(t, dns.RcodeNameError, tcp.written[0].Rcode)
+}
+
+func TestRateLimitPerSource(t *testing.T) {
+	zone := &testZone{}
+	g, clock := newTestGuard(zone)
+	g.positive = newRateLimiter(1, 2)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000}}
+	other := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 10000}}
+
+	for i := 0; i < 4; i++ {
+		query(g, w, "exists.u.isucon.dev.")
+	}
+	query(g, other, "exists.u.isucon.dev.")
+	assert.Equal(t, uint64(2), g.Metrics().RateLimited)
+	assert.Len(t, other.written, 1)
+
+	// トークンが回復すれば再び応答する
+	clock.now = clock.now.Add(time.Second)
+	w.written = nil
+	query(g, w, "exists.u.isucon.dev.")
+	assert.Len(t, w.written, 1)
+	assert.False(t, w.written[0].Truncated)
+}
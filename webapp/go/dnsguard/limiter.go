@@ -0,0 +1,156 @@
+package dnsguard
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// sourceKey は送信元をIPv4なら/24、IPv6なら/56に丸めたもの (BINDのRRLと同じ粒度)
+func sourceKey(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return addr.String()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter は送信元ごとのトークンバケット
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rate    float64
+	burst   float64
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*bucket, 1024),
+		rate:    rate,
+		burst:   float64(burst),
+	}
+}
+
+func (l *rateLimiter) allow(src string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[src]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[src] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) sweep(now time.Time, idle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for src, b := range l.buckets {
+		if now.Sub(b.updated) > idle {
+			delete(l.buckets, src)
+		}
+	}
+}
+
+type nxdomainKey struct {
+	src  string
+	zone string
+}
+
+type nxdomainCounter struct {
+	windowStart time.Time
+	count       int
+	flaggedAt   time.Time
+}
+
+// nxdomainTracker は送信元×ゾーンごとのNXDOMAIN数を固定ウィンドウで数え、
+// 閾値を超えた送信元をランダムサブドメイン攻撃とみなす
+type nxdomainTracker struct {
+	mu        sync.Mutex
+	counters  map[nxdomainKey]*nxdomainCounter
+	window    time.Duration
+	threshold int
+	penalty   time.Duration
+}
+
+func newNXDomainTracker(window time.Duration, threshold int, penalty time.Duration) *nxdomainTracker {
+	return &nxdomainTracker{
+		counters:  make(map[nxdomainKey]*nxdomainCounter, 1024),
+		window:    window,
+		threshold: threshold,
+		penalty:   penalty,
+	}
+}
+
+// observe はNXDOMAINを1件記録し、送信元が攻撃中とみなされるかを返す
+// newlyFlagged は今回の記録で閾値を超えた場合にtrue
+func (t *nxdomainTracker) observe(src, zone string, now time.Time) (flagged bool, newlyFlagged bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := nxdomainKey{src: src, zone: zone}
+	c, ok := t.counters[key]
+	if !ok {
+		c = &nxdomainCounter{windowStart: now}
+		t.counters[key] = c
+	}
+	if now.Sub(c.windowStart) >= t.window {
+		c.windowStart = now
+		c.count = 0
+	}
+	c.count++
+
+	if c.count > t.threshold {
+		newlyFlagged = c.flaggedAt.IsZero() || now.Sub(c.flaggedAt) >= t.penalty
+		c.flaggedAt = now
+		return true, newlyFlagged
+	}
+	return !c.flaggedAt.IsZero() && now.Sub(c.flaggedAt) < t.penalty, false
+}
+
+func (t *nxdomainTracker) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, c := range t.counters {
+		if now.Sub(c.windowStart) >= t.window && (c.flaggedAt.IsZero() || now.Sub(c.flaggedAt) >= t.penalty) {
+			delete(t.counters, key)
+		}
+	}
+}
+
+func (t *nxdomainTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.counters)
+}
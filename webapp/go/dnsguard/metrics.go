@@ -0,0 +1,44 @@
+package dnsguard
+
+import "sync/atomic"
+
+// Metrics はGuardが処理したクエリの累計カウンタ
+type Metrics struct {
+	queries          atomic.Uint64
+	answered         atomic.Uint64
+	cacheHits        atomic.Uint64
+	cacheMisses      atomic.Uint64
+	nxdomains        atomic.Uint64
+	rateLimited      atomic.Uint64
+	dropped          atomic.Uint64
+	truncated        atomic.Uint64
+	suspiciousSource atomic.Uint64
+}
+
+type MetricsSnapshot struct {
+	Queries           uint64 `json:"queries"`
+	Answered          uint64 `json:"answered"`
+	CacheHits         uint64 `json:"cache_hits"`
+	CacheMisses       uint64 `json:"cache_misses"`
+	NXDomains         uint64 `json:"nxdomains"`
+	RateLimited       uint64 `json:"rate_limited"`
+	Dropped           uint64 `json:"dropped"`
+	Truncated         uint64 `json:"truncated"`
+	SuspiciousSources uint64 `json:"suspicious_sources"`
+	CacheEntries      int    `json:"cache_entries"`
+	TrackedSources    int    `json:"tracked_sources"`
+}
+
+func (m *Metrics) snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Queries:           m.queries.Load(),
+		Answered:          m.answered.Load(),
+		CacheHits:         m.cacheHits.Load(),
+		CacheMisses:       m.cacheMisses.Load(),
+		NXDomains:         m.nxdomains.Load(),
+		RateLimited:       m.rateLimited.Load(),
+		Dropped:           m.dropped.Load(),
+		Truncated:         m.truncated.Load(),
+		SuspiciousSources: m.suspiciousSource.Load(),
+	}
+}
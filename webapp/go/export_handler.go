@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	exportDir = "./exports"
+
+	exportStatusPending = "pending"
+	exportStatusRunning = "running"
+	exportStatusDone    = "done"
+	exportStatusFailed  = "failed"
+
+	exportMaxConcurrency = 2
+)
+
+type UserExportJobModel struct {
+	ID         int64  `db:"id"`
+	UserID     int64  `db:"user_id"`
+	Status     string `db:"status"`
+	FilePath   string `db:"file_path"`
+	Error      string `db:"error"`
+	CreatedAt  int64  `db:"created_at"`
+	FinishedAt int64  `db:"finished_at"`
+}
+
+type UserExportJob struct {
+	ID         int64  `json:"id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+}
+
+// エクスポートの各行。JSONのキーはAPIのレスポンスに合わせる
+type exportProfile struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	DarkMode    bool   `json:"dark_mode"`
+}
+
+type exportLivestream struct {
+	ID           int64  `db:"id" json:"id"`
+	Title        string `db:"title" json:"title"`
+	Description  string `db:"description" json:"description"`
+	PlaylistUrl  string `db:"playlist_url" json:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
+	StartAt      int64  `db:"start_at" json:"start_at"`
+	EndAt        int64  `db:"end_at" json:"end_at"`
+	Tags         string `db:"tags" json:"tags"`
+}
+
+type exportLivecomment struct {
+	ID           int64  `db:"id" json:"id"`
+	UserID       int64  `db:"user_id" json:"user_id"`
+	LivestreamID int64  `db:"livestream_id" json:"livestream_id"`
+	Comment      string `db:"comment" json:"comment"`
+	Tip          int64  `db:"tip" json:"tip"`
+	IsDeleted    bool   `db:"is_deleted" json:"is_deleted"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+}
+
+type exportReaction struct {
+	ID           int64  `db:"id" json:"id"`
+	UserID       int64  `db:"user_id" json:"user_id"`
+	LivestreamID int64  `db:"livestream_id" json:"livestream_id"`
+	EmojiName    string `db:"emoji_name" json:"emoji_name"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+}
+
+type exportTip struct {
+	LivecommentID int64 `db:"livecomment_id" json:"livecomment_id"`
+	LivestreamID  int64 `db:"livestream_id" json:"livestream_id"`
+	TipperID      int64 `db:"tipper_id" json:"tipper_id"`
+	Tip           int64 `db:"tip" json:"tip"`
+	CreatedAt     int64 `db:"created_at" json:"created_at"`
+}
+
+type exportReport struct {
+	ID            int64 `db:"id" json:"id"`
+	UserID        int64 `db:"user_id" json:"user_id"`
+	LivestreamID  int64 `db:"livestream_id" json:"livestream_id"`
+	LivecommentID int64 `db:"livecomment_id" json:"livecomment_id"`
+	CreatedAt     int64 `db:"created_at" json:"created_at"`
+}
+
+type exportWatchHistory struct {
+	LivestreamID   int64 `db:"livestream_id" json:"livestream_id"`
+	FirstWatchedAt int64 `db:"first_watched_at" json:"first_watched_at"`
+	LastWatchedAt  int64 `db:"last_watched_at" json:"last_watched_at"`
+	WatchSeconds   int64 `db:"watch_seconds" json:"watch_seconds"`
+}
+
+type exportFollow struct {
+	Username  string `db:"name" json:"username"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+// exportEntry はzipに含めるJSONLファイル1つ分
+type exportEntry struct {
+	filename string
+	query    string
+	write    func(ctx context.Context, zw *zip.Writer, filename, query string, userID int64) error
+}
+
+var exportEntries = []exportEntry{
+	{"livestreams.jsonl", `SELECT l.id, l.title, l.description, l.playlist_url, l.thumbnail_url, l.start_at, l.end_at, IFNULL(GROUP_CONCAT(t.name ORDER BY t.id), '') AS tags
+	FROM livestreams l
+	LEFT JOIN livestream_tags lt ON lt.livestream_id = l.id
+	LEFT JOIN tags t ON t.id = lt.tag_id
+	WHERE l.user_id = ?
+	GROUP BY l.id
+	ORDER BY l.id`, writeJSONLines[exportLivestream]},
+	{"livecomments_sent.jsonl", "SELECT id, user_id, livestream_id, comment, tip, is_deleted, created_at FROM livecomments WHERE user_id = ? ORDER BY id", writeJSONLines[exportLivecomment]},
+	{"livecomments_received.jsonl", `SELECT lc.id, lc.user_id, lc.livestream_id, lc.comment, lc.tip, lc.is_deleted, lc.created_at
+	FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id
+	WHERE l.user_id = ? ORDER BY lc.id`, writeJSONLines[exportLivecomment]},
+	{"reactions_sent.jsonl", "SELECT id, user_id, livestream_id, emoji_name, created_at FROM reactions WHERE user_id = ? ORDER BY id", writeJSONLines[exportReaction]},
+	{"reactions_received.jsonl", `SELECT r.id, r.user_id, r.livestream_id, r.emoji_name, r.created_at
+	FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id
+	WHERE l.user_id = ? ORDER BY r.id`, writeJSONLines[exportReaction]},
+	{"tips_earned.jsonl", `SELECT lc.id AS livecomment_id, lc.livestream_id, lc.user_id AS tipper_id, lc.tip, lc.created_at
+	FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id
+	WHERE l.user_id = ? AND lc.tip > 0 AND lc.is_deleted = 0 ORDER BY lc.id`, writeJSONLines[exportTip]},
+	{"reports_sent.jsonl", "SELECT id, user_id, livestream_id, livecomment_id, created_at FROM livecomment_reports WHERE user_id = ? ORDER BY id", writeJSONLines[exportReport]},
+	{"reports_received.jsonl", `SELECT r.id, r.user_id, r.livestream_id, r.livecomment_id, r.created_at
+	FROM livecomment_reports r INNER JOIN livestreams l ON l.id = r.livestream_id
+	WHERE l.user_id = ? ORDER BY r.id`, writeJSONLines[exportReport]},
+	{"ng_words.jsonl", "SELECT id, user_id, livestream_id, word, created_at FROM ng_words WHERE user_id = ? ORDER BY id", writeJSONLines[NGWord]},
+	{"following.jsonl", "SELECT u.name, f.created_at FROM follows f INNER JOIN users u ON u.id = f.followee_id WHERE f.follower_id = ? ORDER BY f.created_at", writeJSONLines[exportFollow]},
+	{"watch_history.jsonl", "SELECT livestream_id, first_watched_at, last_watched_at, watch_seconds FROM watch_history WHERE user_id = ? ORDER BY last_watched_at", writeJSONLines[exportWatchHistory]},
+}
+
+// exportSemaphore で同時に作るアーカイブの数を絞る
+var exportSemaphore = make(chan struct{}, exportMaxConcurrency)
+
+func exportFilePath(userID, jobID int64) string {
+	return filepath.Join(exportDir, fmt.Sprintf("%d-%d.zip", userID, jobID))
+}
+
+func exportFileGlob(userID int64) string {
+	return filepath.Join(exportDir, fmt.Sprintf("%d-*.zip", userID))
+}
+
+func fillUserExportJobResponse(jobModel UserExportJobModel) UserExportJob {
+	return UserExportJob{
+		ID:         jobModel.ID,
+		Status:     jobModel.Status,
+		Error:      jobModel.Error,
+		CreatedAt:  jobModel.CreatedAt,
+		FinishedAt: jobModel.FinishedAt,
+	}
+}
+
+// 個人データのエクスポート開始API
+// POST /api/user/me/export
+func postExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	jobModel := UserExportJobModel{
+		UserID:    userID,
+		Status:    exportStatusPending,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := dbConn.ExecContext(ctx, "INSERT INTO user_export_jobs (user_id, status, error, created_at) VALUES (?, ?, '', ?)", jobModel.UserID, jobModel.Status, jobModel.CreatedAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert export job: "+err.Error())
+	}
+	jobID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted export job id: "+err.Error())
+	}
+	jobModel.ID = jobID
+
+	go runExportJob(context.Background(), c.Logger(), jobModel)
+
+	return c.JSON(http.StatusAccepted, fillUserExportJobResponse(jobModel))
+}
+
+func getExportJob(c echo.Context) (UserExportJobModel, error) {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	jobID, err := strconv.ParseInt(c.Param("export_id"), 10, 64)
+	if err != nil {
+		return UserExportJobModel{}, echo.NewHTTPError(http.StatusBadRequest, "export_id in path must be integer")
+	}
+
+	var jobModel UserExportJobModel
+	if err := dbConn.GetContext(ctx, &jobModel, "SELECT * FROM user_export_jobs WHERE id = ? AND user_id = ?", jobID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserExportJobModel{}, echo.NewHTTPError(http.StatusNotFound, "export job not found")
+		}
+		return UserExportJobModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get export job: "+err.Error())
+	}
+	return jobModel, nil
+}
+
+// エクスポートの状態取得API
+// GET /api/user/me/export/:export_id
+func getExportHandler(c echo.Context) error {
+	jobModel, err := getExportJob(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, fillUserExportJobResponse(jobModel))
+}
+
+// エクスポートのダウンロードAPI
+// GET /api/user/me/export/:export_id/download
+func downloadExportHandler(c echo.Context) error {
+	jobModel, err := getExportJob(c)
+	if err != nil {
+		return err
+	}
+	if jobModel.Status != exportStatusDone {
+		return echo.NewHTTPError(http.StatusConflict, "export is not ready: "+jobModel.Status)
+	}
+
+	return c.Attachment(jobModel.FilePath, fmt.Sprintf("isupipe-export-%s-%d.zip", currentUser(c).Name, jobModel.ID))
+}
+
+// resumeExportJobs は再起動で中断したジョブをやり直す
+func resumeExportJobs(ctx context.Context, logger echo.Logger) error {
+	var jobModels []UserExportJobModel
+	if err := dbConn.SelectContext(ctx, &jobModels, "SELECT * FROM user_export_jobs WHERE status IN (?, ?) ORDER BY id", exportStatusPending, exportStatusRunning); err != nil {
+		return fmt.Errorf("failed to get export jobs: %w", err)
+	}
+	for _, jobModel := range jobModels {
+		go runExportJob(ctx, logger, jobModel)
+	}
+	return nil
+}
+
+func runExportJob(ctx context.Context, logger echo.Logger, jobModel UserExportJobModel) {
+	exportSemaphore <- struct{}{}
+	defer func() { <-exportSemaphore }()
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE user_export_jobs SET status = ? WHERE id = ?", exportStatusRunning, jobModel.ID); err != nil {
+		logger.Errorf("failed to update export job %d: %v", jobModel.ID, err)
+		return
+	}
+
+	filePath := exportFilePath(jobModel.UserID, jobModel.ID)
+	if err := buildExportArchive(ctx, jobModel.UserID, filePath); err != nil {
+		logger.Warnf("failed to build export %d: %v", jobModel.ID, err)
+		os.Remove(filePath)
+		if _, err := dbConn.ExecContext(ctx, "UPDATE user_export_jobs SET status = ?, error = ?, finished_at = ? WHERE id = ?", exportStatusFailed, err.Error(), time.Now().Unix(), jobModel.ID); err != nil {
+			logger.Errorf("failed to update export job %d: %v", jobModel.ID, err)
+		}
+		return
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE user_export_jobs SET status = ?, file_path = ?, finished_at = ? WHERE id = ?", exportStatusDone, filePath, time.Now().Unix(), jobModel.ID); err != nil {
+		logger.Errorf("failed to update export job %d: %v", jobModel.ID, err)
+	}
+}
+
+func buildExportArchive(ctx context.Context, userID int64, filePath string) error {
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+
+	userModel := UserModel{}
+	if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	w, err := zw.Create("profile.json")
+	if err != nil {
+		return fmt.Errorf("failed to create profile.json: %w", err)
+	}
+	if err := json.NewEncoder(w).Encode(exportProfile{
+		ID:          userModel.ID,
+		Name:        userModel.Name,
+		DisplayName: userModel.DisplayName,
+		Description: userModel.Description,
+		DarkMode:    themeCache.Get(userModel.ID),
+	}); err != nil {
+		return fmt.Errorf("failed to write profile.json: %w", err)
+	}
+
+	for _, entry := range exportEntries {
+		if err := entry.write(ctx, zw, entry.filename, entry.query, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := writeExportIcon(ctx, zw, userID); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to close zip: %w", err)
+	}
+	return f.Close()
+}
+
+// writeJSONLines はクエリ結果を1行ずつJSONLとして書き出す。全件をメモリに載せない
+func writeJSONLines[T any](ctx context.Context, zw *zip.Writer, filename, query string, userID int64) error {
+	w, err := zw.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filename, err)
+	}
+
+	rows, err := dbConn.QueryxContext(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", filename, err)
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var row T
+		if err := rows.StructScan(&row); err != nil {
+			return fmt.Errorf("failed to scan %s: %w", filename, err)
+		}
+		if err := enc.Encode(row); err != nil {
+			return fmt.Errorf("failed to write %s: %w", filename, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return nil
+}
+
+func writeExportIcon(ctx context.Context, zw *zip.Writer, userID int64) error {
+	image, err := os.ReadFile(iconFilePath(userID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read icon file: %w", err)
+	}
+	if len(image) == 0 {
+		if err := dbConn.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("failed to get icon: %w", err)
+		}
+	}
+
+	w, err := zw.Create("icon.jpg")
+	if err != nil {
+		return fmt.Errorf("failed to create icon.jpg: %w", err)
+	}
+	if _, err := w.Write(image); err != nil {
+		return fmt.Errorf("failed to write icon.jpg: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultFeedLimit = 20
+	maxFeedLimit     = 100
+	maxFollowLimit   = 1000
+)
+
+type FollowModel struct {
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+}
+
+type FeedResponse struct {
+	Livestreams []Livestream `json:"livestreams"`
+	// NextCursor が空なら続きはない
+	NextCursor string `json:"next_cursor"`
+}
+
+type followCount struct {
+	followers int64
+	following int64
+}
+
+// FollowCountCache はユーザごとのフォロワー数・フォロー数を保持する
+// ユーザのレスポンスを作るたびに集計しないようにする
+type FollowCountCache struct {
+	mu *sync.RWMutex
+	m  map[int64]*followCount
+}
+
+func (c *FollowCountCache) Get(userID int64) (followers int64, following int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if count, ok := c.m[userID]; ok {
+		return count.followers, count.following
+	}
+	return 0, 0
+}
+
+// Add はフォローの増減を反映する
+func (c *FollowCountCache) Add(followerID, followeeID int64, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[followerID]; !ok {
+		c.m[followerID] = &followCount{}
+	}
+	if _, ok := c.m[followeeID]; !ok {
+		c.m[followeeID] = &followCount{}
+	}
+	c.m[followerID].following += delta
+	c.m[followeeID].followers += delta
+}
+
+// RemoveUser は退会したユーザを消し、フォローしていた相手とフォローされていた相手の数を減らす
+func (c *FollowCountCache) RemoveUser(userID int64, followeeIDs, followerIDs []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, userID)
+	for _, followeeID := range followeeIDs {
+		if count, ok := c.m[followeeID]; ok {
+			count.followers--
+		}
+	}
+	for _, followerID := range followerIDs {
+		if count, ok := c.m[followerID]; ok {
+			count.following--
+		}
+	}
+}
+
+// Load はfollowsテーブルから集計し直す
+func (c *FollowCountCache) Load(ctx context.Context) error {
+	var rows []struct {
+		UserID int64 `db:"user_id"`
+		Count  int64 `db:"cnt"`
+	}
+	m := make(map[int64]*followCount, 1000)
+
+	if err := dbConn.SelectContext(ctx, &rows, "SELECT followee_id AS user_id, COUNT(*) AS cnt FROM follows GROUP BY followee_id"); err != nil {
+		return fmt.Errorf("failed to count followers: %w", err)
+	}
+	for _, row := range rows {
+		m[row.UserID] = &followCount{followers: row.Count}
+	}
+
+	rows = rows[:0]
+	if err := dbConn.SelectContext(ctx, &rows, "SELECT follower_id AS user_id, COUNT(*) AS cnt FROM follows GROUP BY follower_id"); err != nil {
+		return fmt.Errorf("failed to count following: %w", err)
+	}
+	for _, row := range rows {
+		if _, ok := m[row.UserID]; !ok {
+			m[row.UserID] = &followCount{}
+		}
+		m[row.UserID].following = row.Count
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = m
+	return nil
+}
+
+var followCountCache = &FollowCountCache{
+	mu: new(sync.RWMutex),
+	m:  make(map[int64]*followCount, 1000),
+}
+
+func getUserByName(ctx context.Context, tx SqlxConn, username string) (UserModel, error) {
+	var userModel UserModel
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserModel{}, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	return userModel, nil
+}
+
+// フォローAPI
+// POST /api/user/:username/follow
+func followHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	followee, err := getUserByName(ctx, dbConn, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if followee.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)", userID, followee.ID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected > 0 {
+		followCountCache.Add(userID, followee.ID, 1)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロー解除API
+// DELETE /api/user/:username/follow
+func unfollowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	followee, err := getUserByName(ctx, dbConn, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followee.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected > 0 {
+		followCountCache.Add(userID, followee.ID, -1)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロワー一覧API
+// GET /api/user/:username/followers
+func getFollowersHandler(c echo.Context) error {
+	return getFollowUsers(c, "SELECT u.* FROM follows f INNER JOIN users u ON u.id = f.follower_id WHERE f.followee_id = ? ORDER BY f.created_at DESC, f.follower_id DESC LIMIT ?")
+}
+
+// フォロー中の配信者一覧API
+// GET /api/user/:username/following
+func getFollowingHandler(c echo.Context) error {
+	return getFollowUsers(c, "SELECT u.* FROM follows f INNER JOIN users u ON u.id = f.followee_id WHERE f.follower_id = ? ORDER BY f.created_at DESC, f.followee_id DESC LIMIT ?")
+}
+
+func getFollowUsers(c echo.Context, query string) error {
+	ctx := c.Request().Context()
+
+	limit := maxFollowLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxFollowLimit)
+	}
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	userModel, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, userModel.ID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get follows: "+err.Error())
+	}
+
+	users, err := fillUserResponses(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// pageCursor はページングの位置 (並び順のキー, id) を表す
+type pageCursor struct {
+	Key int64
+	ID  int64
+}
+
+func (f pageCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", f.Key, f.ID)))
+}
+
+func decodePageCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, err
+	}
+	key, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return pageCursor{}, fmt.Errorf("malformed cursor")
+	}
+	cursor := pageCursor{}
+	if cursor.Key, err = strconv.ParseInt(key, 10, 64); err != nil {
+		return pageCursor{}, err
+	}
+	if cursor.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return pageCursor{}, err
+	}
+	return cursor, nil
+}
+
+// フォロー中の配信者の配信予定・配信中一覧API
+// GET /api/feed
+func getFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	limit := defaultFeedLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxFeedLimit)
+	}
+
+	// 終了・中止した配信は出さない
+	now := livestreamClock().Unix()
+	query := "SELECT l.* FROM livestreams l INNER JOIN follows f ON f.followee_id = l.user_id WHERE f.follower_id = ? AND l.end_at > ? AND l.state IN (?, ?)"
+	args := []interface{}{userID, now, LivestreamStateScheduled, LivestreamStateLive}
+	if state := c.QueryParam("state"); state != "" {
+		if state != LivestreamStateScheduled && state != LivestreamStateLive {
+			return echo.NewHTTPError(http.StatusBadRequest, "state must be scheduled or live")
+		}
+		cond, condArgs := livestreamStateCondition("l.", state, now)
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	// 視聴済みの配信を除く
+	if c.QueryParam("exclude_watched") == "true" {
+		query += " AND NOT EXISTS (SELECT 1 FROM watch_history w WHERE w.user_id = f.follower_id AND w.livestream_id = l.id)"
+	}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodePageCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		query += " AND (l.start_at > ? OR (l.start_at = ? AND l.id > ?))"
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	// 続きがあるかを知るため1件多く取る
+	query += " ORDER BY l.start_at ASC, l.id ASC LIMIT ?"
+	args = append(args, limit+1)
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	res := FeedResponse{}
+	if len(livestreamModels) > limit {
+		livestreamModels = livestreamModels[:limit]
+		last := livestreamModels[limit-1]
+		res.NextCursor = pageCursor{Key: last.StartAt, ID: last.ID}.Encode()
+	}
+
+	res.Livestreams, err = fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultHeldTipsLimit = 50
+	maxHeldTipsLimit     = 100
+)
+
+type HeldTipModel struct {
+	ID            int64  `db:"id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	UserID        int64  `db:"user_id"`
+	Amount        int64  `db:"amount"`
+	Reason        string `db:"reason"`
+	Status        string `db:"status"`
+	CreatedAt     int64  `db:"created_at"`
+	ReviewedBy    int64  `db:"reviewed_by"`
+	ReviewedAt    int64  `db:"reviewed_at"`
+}
+
+type HeldTip struct {
+	ID int64 `json:"id"`
+	// Livecomment の tip は承認されるまで0
+	Livecomment Livecomment `json:"livecomment"`
+	Amount      int64       `json:"amount"`
+	Reason      string      `json:"reason"`
+	Status      string      `json:"status"`
+	CreatedAt   int64       `json:"created_at"`
+	ReviewedAt  int64       `json:"reviewed_at"`
+}
+
+// 保留中のチップ一覧API
+// GET /api/admin/held_tips
+func getHeldTipsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = heldTipStatusPending
+	}
+	if status != heldTipStatusPending && status != heldTipStatusApproved && status != heldTipStatusRejected {
+		return echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be pending, approved or rejected")
+	}
+
+	limit := defaultHeldTipsLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxHeldTipsLimit)
+	}
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	// 古いものから審査する
+	var heldTipModels []HeldTipModel
+	if err := tx.SelectContext(ctx, &heldTipModels, "SELECT * FROM held_tips WHERE status = ? ORDER BY id LIMIT ?", status, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get held tips: "+err.Error())
+	}
+
+	heldTips := make([]HeldTip, 0, len(heldTipModels))
+	for _, heldTipModel := range heldTipModels {
+		heldTip, err := fillHeldTipResponse(c, tx, heldTipModel)
+		if err != nil {
+			return err
+		}
+		heldTips = append(heldTips, heldTip)
+	}
+
+	return c.JSON(http.StatusOK, heldTips)
+}
+
+// 保留中のチップの承認API
+// POST /api/admin/held_tips/:held_tip_id/approve
+func approveHeldTipHandler(c echo.Context) error {
+	return reviewHeldTip(c, heldTipStatusApproved)
+}
+
+// 保留中のチップの却下API
+// POST /api/admin/held_tips/:held_tip_id/reject
+// 却下してもコメントは残り、チップだけ載らない
+func rejectHeldTipHandler(c echo.Context) error {
+	return reviewHeldTip(c, heldTipStatusRejected)
+}
+
+func reviewHeldTip(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	reviewerID := currentUser(c).ID
+
+	heldTipID, err := strconv.Atoi(c.Param("held_tip_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "held_tip_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var heldTipModel HeldTipModel
+	if err := tx.GetContext(ctx, &heldTipModel, "SELECT * FROM held_tips WHERE id = ? FOR UPDATE", heldTipID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "held tip not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get held tip: "+err.Error())
+	}
+	if heldTipModel.Status != heldTipStatusPending {
+		return echo.NewHTTPError(http.StatusConflict, "held tip is already reviewed")
+	}
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? FOR UPDATE", heldTipModel.LivecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", heldTipModel.LivestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	if status == heldTipStatusApproved {
+		// 非表示のコメントにチップを載せると返金と食い違うので、却下してもらう
+		if livecommentModel.IsDeleted {
+			return echo.NewHTTPError(http.StatusConflict, "livecomment is hidden")
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET tip = ? WHERE id = ?", heldTipModel.Amount, livecommentModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livecomment: "+err.Error())
+		}
+		livecommentModel.Tip = heldTipModel.Amount
+
+		if err := addTipStats(ctx, tx, &livestreamModel, livecommentModel.Tip); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if err := addTipper(ctx, tx, livestreamModel.ID, livecommentModel.UserID, livecommentModel.Tip, livecommentModel.CreatedAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if err := appendTipLedger(ctx, tx, tipLedgerEntries(tipLedgerKindTip, &livestreamModel, []*LivecommentModel{&livecommentModel}, now)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		// 配信者への通知は承認してから送る
+		if err := insertNotifications(ctx, tx, []NotificationModel{{
+			UserID:        livestreamModel.UserID,
+			Type:          notificationTypeTipReceived,
+			ActorID:       livecommentModel.UserID,
+			LivestreamID:  livestreamModel.ID,
+			LivecommentID: livecommentModel.ID,
+			Amount:        livecommentModel.Tip,
+			CreatedAt:     now,
+		}}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to notify tip: "+err.Error())
+		}
+		if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, webhookEventTipReceived, TipReceivedWebhookData{
+			LivestreamID:  livestreamModel.ID,
+			LivecommentID: livecommentModel.ID,
+			UserID:        livecommentModel.UserID,
+			Comment:       livecommentModel.Comment,
+			Tip:           livecommentModel.Tip,
+		}, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE held_tips SET status = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ?", status, reviewerID, now, heldTipModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update held tip: "+err.Error())
+	}
+	heldTipModel.Status = status
+	heldTipModel.ReviewedBy = reviewerID
+	heldTipModel.ReviewedAt = now
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	if status == heldTipStatusApproved {
+		webhookDispatcher.Wake()
+		statsRollupWriter.AddTip(livestreamModel.ID, livecommentModel.CreatedAt, livecommentModel.Tip)
+		if err := statsRankings.Add(ctx, &livestreamModel, livecommentModel.Tip, livecommentModel.CreatedAt); err != nil {
+			c.Logger().Errorf("failed to update rankings: %v", err)
+		}
+	}
+
+	conn, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer conn.Close()
+	heldTip, err := fillHeldTipResponse(c, conn, heldTipModel)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, heldTip)
+}
+
+func fillHeldTipResponse(c echo.Context, tx SqlxConn, heldTipModel HeldTipModel) (HeldTip, error) {
+	ctx := c.Request().Context()
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", heldTipModel.LivecommentID); err != nil {
+		return HeldTip{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	if err != nil {
+		return HeldTip{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	return HeldTip{
+		ID:          heldTipModel.ID,
+		Livecomment: livecomment,
+		Amount:      heldTipModel.Amount,
+		Reason:      heldTipModel.Reason,
+		Status:      heldTipModel.Status,
+		CreatedAt:   heldTipModel.CreatedAt,
+		ReviewedAt:  heldTipModel.ReviewedAt,
+	}, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sort"
+)
+
+// HighlightPoint は1分ぶんのリアクション数とチップ合計
+type HighlightPoint struct {
+	// Minute は分の開始時刻
+	Minute    int64
+	Reactions int64
+	Tips      int64
+}
+
+// HighlightWindow は盛り上がった時間帯 [StartAt, EndAt)
+type HighlightWindow struct {
+	StartAt   int64
+	EndAt     int64
+	Reactions int64
+	Tips      int64
+	// Score は基準に対して何倍盛り上がったか (期間内の最大値)
+	Score float64
+}
+
+// HighlightDetector は直前の数分を基準にして、リアクションかチップが跳ね上がった時間帯を探す
+type HighlightDetector struct {
+	// BaselineMinutes は基準にする直前の分数
+	BaselineMinutes int
+	// Threshold は基準の何倍で盛り上がりとみなすか
+	Threshold float64
+	// MinReactions, MinTips はこれ未満の分は基準に関係なく盛り上がりとみなさない
+	MinReactions int64
+	MinTips      int64
+	// MaxHighlights は返す件数の上限 (スコアの高い順に選ぶ)
+	MaxHighlights int
+}
+
+var defaultHighlightDetector = HighlightDetector{
+	BaselineMinutes: 10,
+	Threshold:       3,
+	MinReactions:    10,
+	MinTips:         1000,
+	MaxHighlights:   5,
+}
+
+// Detect は分ごとの点から盛り上がった時間帯を開始時刻順に返す
+// points は Minute の昇順で、抜けている分は0として扱う
+func (d HighlightDetector) Detect(points []HighlightPoint) []HighlightWindow {
+	if len(points) == 0 {
+		return []HighlightWindow{}
+	}
+
+	// 基準は直前 windowSize 分の平均
+	// 盛り上がった分は基準に入れると後に続く盛り上がりを見逃すので、その時点の平均で置き換える
+	// 基準は直前 windowSize 分だけを輪にして持ち、抜けている分は埋めずに0として進める
+	var (
+		windows    []HighlightWindow
+		current    *HighlightWindow
+		windowSize = int64(max(d.BaselineMinutes, 1))
+		baseReact  = make([]float64, windowSize)
+		baseTips   = make([]float64, windowSize)
+		sumReact   float64
+		sumTips    float64
+		// quiet は盛り上がりでない0の分が続いている分数
+		quiet int64
+	)
+	step := func(i int64, p HighlightPoint) {
+		n := min(i, windowSize)
+		var meanReact, meanTips float64
+		if n > 0 {
+			meanReact, meanTips = sumReact/float64(n), sumTips/float64(n)
+		}
+
+		var react, tips float64
+		score := d.score(p, meanReact, meanTips, int(n))
+		if score > 0 {
+			if current == nil {
+				current = &HighlightWindow{StartAt: p.Minute}
+			}
+			current.EndAt = p.Minute + 60
+			current.Reactions += p.Reactions
+			current.Tips += p.Tips
+			current.Score = max(current.Score, score)
+			react, tips = meanReact, meanTips
+		} else {
+			if current != nil {
+				windows = append(windows, *current)
+				current = nil
+			}
+			react, tips = float64(p.Reactions), float64(p.Tips)
+		}
+		if score == 0 && p.Reactions == 0 && p.Tips == 0 {
+			quiet++
+		} else {
+			quiet = 0
+		}
+
+		// 輪の i の位置には windowSize 分前の基準が入っている
+		slot := i % windowSize
+		sumReact += react
+		sumTips += tips
+		if i >= windowSize {
+			sumReact -= baseReact[slot]
+			sumTips -= baseTips[slot]
+		}
+		baseReact[slot], baseTips[slot] = react, tips
+	}
+
+	first := points[0].Minute
+	var i int64
+	for k := 0; k < len(points); i++ {
+		// 同じ分の点はまとめる
+		p := HighlightPoint{Minute: points[k].Minute}
+		for ; k < len(points) && points[k].Minute == p.Minute; k++ {
+			p.Reactions += points[k].Reactions
+			p.Tips += points[k].Tips
+		}
+
+		// 抜けている分は0として進める。基準がすべて0になったら、残りの抜けは何も変えないので飛ばす
+		next := (p.Minute - first) / 60
+		for ; i < next; i++ {
+			if current == nil && quiet >= windowSize {
+				i = next
+				sumReact, sumTips = 0, 0
+				break
+			}
+			step(i, HighlightPoint{Minute: first + i*60})
+		}
+		step(i, p)
+	}
+	if current != nil {
+		windows = append(windows, *current)
+	}
+
+	if d.MaxHighlights > 0 && len(windows) > d.MaxHighlights {
+		sort.SliceStable(windows, func(i, j int) bool { return windows[i].Score > windows[j].Score })
+		windows = windows[:d.MaxHighlights]
+		sort.Slice(windows, func(i, j int) bool { return windows[i].StartAt < windows[j].StartAt })
+	}
+	if windows == nil {
+		return []HighlightWindow{}
+	}
+	return windows
+}
+
+// score は基準に対する跳ね上がりの倍率を返す。盛り上がりでなければ0
+// 最初の1分は基準がないので盛り上がりとみなさない。基準が1未満なら1として比べる
+func (d HighlightDetector) score(p HighlightPoint, meanReact, meanTips float64, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	var score float64
+	if p.Reactions >= d.MinReactions {
+		baseline := max(meanReact, 1)
+		if r := float64(p.Reactions) / baseline; r >= d.Threshold {
+			score = max(score, r)
+		}
+	}
+	if p.Tips >= d.MinTips {
+		baseline := max(meanTips, 1)
+		if r := float64(p.Tips) / baseline; r >= d.Threshold {
+			score = max(score, r)
+		}
+	}
+	return score
+}
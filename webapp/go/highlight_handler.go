@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ハイライトごとに添えるライブコメントの件数
+const highlightSampleLivecomments = 3
+
+type Highlight struct {
+	// Offset は配信開始からの秒数
+	Offset    int64   `json:"offset"`
+	StartAt   int64   `json:"start_at"`
+	Duration  int64   `json:"duration"`
+	Reactions int64   `json:"reactions"`
+	Tips      int64   `json:"tips"`
+	Score     float64 `json:"score"`
+	// PeakEmoji はその時間帯に一番多かった絵文字。リアクションがなければ空
+	PeakEmoji    string        `json:"peak_emoji"`
+	Livecomments []Livecomment `json:"livecomments"`
+}
+
+// newHighlight は検出した時間帯をハイライトにする
+// 集計は分単位なので、配信開始が分の途中なら最初の分は配信開始からに切り詰める
+func newHighlight(window HighlightWindow, livestreamStartAt int64) Highlight {
+	startAt := max(window.StartAt, livestreamStartAt)
+	return Highlight{
+		Offset:    startAt - livestreamStartAt,
+		StartAt:   startAt,
+		Duration:  window.EndAt - startAt,
+		Reactions: window.Reactions,
+		Tips:      window.Tips,
+		Score:     window.Score,
+	}
+}
+
+// ハイライトAPI
+// GET /api/livestream/:livestream_id/highlights
+func getLivestreamHighlightsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// 1分ごとの集計から探す。配信開始からの静かな時間も基準に含め、配信終了より後の集計は見ない
+	var statsModels []LivestreamMinutelyStatsModel
+	if err := tx.SelectContext(ctx, &statsModels, "SELECT * FROM livestream_minutely_stats WHERE livestream_id = ? AND minute >= ? AND minute < ? ORDER BY minute", livestreamModel.ID, rollupMinute(livestreamModel.StartAt), livestreamModel.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get minutely stats: "+err.Error())
+	}
+	points := make([]HighlightPoint, 0, len(statsModels)+1)
+	points = append(points, HighlightPoint{Minute: rollupMinute(livestreamModel.StartAt)})
+	for _, statsModel := range statsModels {
+		points = append(points, HighlightPoint{
+			Minute:    statsModel.Minute,
+			Reactions: statsModel.Reactions,
+			Tips:      statsModel.Tips,
+		})
+	}
+
+	highlights := []Highlight{}
+	for _, window := range defaultHighlightDetector.Detect(points) {
+		highlight := newHighlight(window, livestreamModel.StartAt)
+
+		if err := tx.GetContext(ctx, &highlight.PeakEmoji, `SELECT emoji_name FROM livestream_minutely_emoji_stats
+		WHERE livestream_id = ? AND minute >= ? AND minute < ?
+		GROUP BY emoji_name ORDER BY SUM(count) DESC, emoji_name DESC LIMIT 1`, livestreamModel.ID, window.StartAt, window.EndAt); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to find peak emoji: "+err.Error())
+		}
+
+		// チップの大きいコメントを優先して添える
+		var livecommentModels []LivecommentModel
+		if err := tx.SelectContext(ctx, &livecommentModels, `SELECT * FROM livecomments
+		WHERE livestream_id = ? AND is_deleted = 0 AND created_at >= ? AND created_at < ?
+		ORDER BY tip DESC, id LIMIT ?`, livestreamModel.ID, window.StartAt, window.EndAt, highlightSampleLivecomments); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		highlight.Livecomments, err = fillLivecommentResponses(ctx, tx, livecommentModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error())
+		}
+
+		highlights = append(highlights, highlight)
+	}
+
+	return c.JSON(http.StatusOK, highlights)
+}
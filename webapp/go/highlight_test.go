@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timeline は分ごとのリアクション数とチップから点を作る。0の分は省く
+func timeline(start int64, reactions []int64, tips []int64) []HighlightPoint {
+	var points []HighlightPoint
+	for i := range reactions {
+		p := HighlightPoint{Minute: start + int64(i)*60, Reactions: reactions[i]}
+		if tips != nil {
+			p.Tips = tips[i]
+		}
+		if p.Reactions == 0 && p.Tips == 0 {
+			continue
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+func TestHighlightDetectorFindsReactionBurst(t *testing.T) {
+	// 毎分5件程度のところ、4-5分目だけ跳ね上がる
+	points := timeline(6000, []int64{5, 6, 4, 5, 40, 35, 6, 5, 4, 5}, nil)
+
+	windows := defaultHighlightDetector.Detect(points)
+	require.Len(t, windows, 1)
+	assert.Equal(t, int64(6000+4*60), windows[0].StartAt)
+	assert.Equal(t, int64(6000+6*60), windows[0].EndAt)
+	assert.Equal(t, int64(75), windows[0].Reactions)
+	assert.InDelta(t, 40.0/5.0, windows[0].Score, 0.01)
+}
+
+func TestHighlightDetectorFindsTipBurstAfterSilence(t *testing.T) {
+	// 抜けている分は0として基準に入る
+	points := []HighlightPoint{
+		{Minute: 0},
+		{Minute: 600, Tips: 5000},
+	}
+
+	windows := defaultHighlightDetector.Detect(points)
+	require.Len(t, windows, 1)
+	assert.Equal(t, int64(600), windows[0].StartAt)
+	assert.Equal(t, int64(5000), windows[0].Tips)
+}
+
+func TestHighlightDetectorSkipsLongGaps(t *testing.T) {
+	// 2年ぶんの抜けがあっても、抜けの前の盛り上がりと後の跳ね上がりを拾う
+	const gap = 2 * 365 * 24 * 60 * 60
+	points := append(timeline(0, []int64{5, 5, 40, 5}, nil),
+		HighlightPoint{Minute: gap, Reactions: 5},
+		HighlightPoint{Minute: gap, Reactions: 15},
+		HighlightPoint{Minute: gap + 60, Reactions: 3},
+	)
+
+	windows := defaultHighlightDetector.Detect(points)
+	require.Len(t, windows, 2)
+	assert.Equal(t, int64(2*60), windows[0].StartAt)
+	assert.Equal(t, int64(gap), windows[1].StartAt)
+	assert.Equal(t, int64(gap+60), windows[1].EndAt)
+	assert.Equal(t, int64(20), windows[1].Reactions)
+}
+
+func TestHighlightDetectorIgnoresSteadyAndSmallActivity(t *testing.T) {
+	// 一定の盛り上がりと、最低件数に届かない跳ね上がりは拾わない
+	steady := timeline(0, []int64{50, 50, 50, 50, 50, 50}, nil)
+	assert.Empty(t, defaultHighlightDetector.Detect(steady))
+
+	small := timeline(0, []int64{0, 1, 0, 9, 0}, nil)
+	assert.Empty(t, defaultHighlightDetector.Detect(small))
+
+	assert.Empty(t, defaultHighlightDetector.Detect(nil))
+}
+
+func TestHighlightDetectorKeepsTopScores(t *testing.T) {
+	d := defaultHighlightDetector
+	d.MaxHighlights = 2
+	// 3回跳ね上がり、スコアの高い2つが開始時刻順に残る
+	points := timeline(0, []int64{1, 20, 1, 1, 1, 90, 1, 1, 1, 50, 1}, nil)
+
+	windows := d.Detect(points)
+	require.Len(t, windows, 2)
+	assert.Equal(t, int64(5*60), windows[0].StartAt)
+	assert.Equal(t, int64(9*60), windows[1].StartAt)
+}
+
+func TestNewHighlightClampsToLivestreamStart(t *testing.T) {
+	// 配信開始 (6030) が分の途中で、最初の分がハイライトになった
+	window := HighlightWindow{StartAt: 6000, EndAt: 6120, Reactions: 30, Score: 6}
+	highlight := newHighlight(window, 6030)
+	assert.Equal(t, int64(0), highlight.Offset)
+	assert.Equal(t, int64(6030), highlight.StartAt)
+	assert.Equal(t, int64(90), highlight.Duration)
+
+	highlight = newHighlight(HighlightWindow{StartAt: 6240, EndAt: 6360}, 6030)
+	assert.Equal(t, int64(210), highlight.Offset)
+	assert.Equal(t, int64(120), highlight.Duration)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+type WatchHistoryModel struct {
+	UserID         int64 `db:"user_id"`
+	LivestreamID   int64 `db:"livestream_id"`
+	FirstWatchedAt int64 `db:"first_watched_at"`
+	LastWatchedAt  int64 `db:"last_watched_at"`
+	WatchSeconds   int64 `db:"watch_seconds"`
+	// EnteredAt は入室中なら入室した時刻、退室したら0
+	EnteredAt int64 `db:"entered_at"`
+}
+
+type WatchHistoryEntry struct {
+	Livestream     Livestream `json:"livestream"`
+	FirstWatchedAt int64      `json:"first_watched_at"`
+	LastWatchedAt  int64      `json:"last_watched_at"`
+	WatchSeconds   int64      `json:"watch_seconds"`
+}
+
+type WatchHistoryResponse struct {
+	History []WatchHistoryEntry `json:"history"`
+	// NextCursor が空なら続きはない
+	NextCursor string `json:"next_cursor"`
+	Paused     bool   `json:"paused"`
+}
+
+type PutWatchHistorySettingsRequest struct {
+	Paused bool `json:"paused"`
+}
+
+// recordWatch は入室とハートビートで視聴を記録し、前回の記録からの時間を視聴時間に足す
+// 前回からハートビートの期限より空いていたら、その間は視聴していなかったとみなす
+// 入室なら退室 (finishWatch) まで entered_at を残す
+// 履歴を一時停止しているユーザは記録しない
+func recordWatch(ctx context.Context, tx sqlx.ExecerContext, userID, livestreamID int64, now int64, enter bool) error {
+	ttl := int64(viewerPresenceTTL / time.Second)
+	var enteredAt int64
+	if enter {
+		enteredAt = now
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO watch_history (user_id, livestream_id, first_watched_at, last_watched_at, entered_at)
+	SELECT ?, ?, ?, ?, ? FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM watch_history_pauses WHERE user_id = ?)
+	ON DUPLICATE KEY UPDATE
+		watch_seconds = watch_seconds + IF(? - last_watched_at BETWEEN 0 AND ?, ? - last_watched_at, 0),
+		last_watched_at = GREATEST(last_watched_at, ?),
+		entered_at = IF(?, ?, entered_at)`,
+		userID, livestreamID, now, now, enteredAt, userID,
+		now, ttl, now,
+		now,
+		enter, now); err != nil {
+		return fmt.Errorf("failed to record watch history: %w", err)
+	}
+	return nil
+}
+
+// finishWatch は退室したときに、最後の記録からの時間を視聴時間に足す
+// 入室からハートビートがなくても、ハートビートの期限までは視聴していたとみなす
+// 入室していない配信の履歴は作らない
+func finishWatch(ctx context.Context, tx sqlx.ExecerContext, userID, livestreamID int64, now int64) error {
+	ttl := int64(viewerPresenceTTL / time.Second)
+	if _, err := tx.ExecContext(ctx, `UPDATE watch_history SET
+		watch_seconds = watch_seconds + LEAST(GREATEST(? - last_watched_at, 0), ?),
+		last_watched_at = GREATEST(last_watched_at, ?),
+		entered_at = 0
+	WHERE user_id = ? AND livestream_id = ? AND entered_at > 0
+		AND NOT EXISTS (SELECT 1 FROM watch_history_pauses WHERE user_id = ?)`,
+		now, ttl, now, userID, livestreamID, userID); err != nil {
+		return fmt.Errorf("failed to finish watch history: %w", err)
+	}
+	return nil
+}
+
+// 視聴履歴API
+// GET /api/user/me/history
+func getWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	limit := defaultHistoryLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxHistoryLimit)
+	}
+
+	query := "SELECT * FROM watch_history WHERE user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodePageCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		query += " AND (last_watched_at < ? OR (last_watched_at = ? AND livestream_id < ?))"
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	// 続きがあるかを知るため1件多く取る
+	query += " ORDER BY last_watched_at DESC, livestream_id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var historyModels []WatchHistoryModel
+	if err := tx.SelectContext(ctx, &historyModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+
+	res := WatchHistoryResponse{History: []WatchHistoryEntry{}}
+	if err := tx.GetContext(ctx, &res.Paused, "SELECT EXISTS(SELECT 1 FROM watch_history_pauses WHERE user_id = ?)", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history settings: "+err.Error())
+	}
+
+	if len(historyModels) > limit {
+		historyModels = historyModels[:limit]
+		last := historyModels[limit-1]
+		res.NextCursor = pageCursor{Key: last.LastWatchedAt, ID: last.LivestreamID}.Encode()
+	}
+	if len(historyModels) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	livestreamIDs := make([]int64, len(historyModels))
+	for i := range historyModels {
+		livestreamIDs[i] = historyModels[i].LivestreamID
+	}
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+	livestreamMap := make(map[int64]Livestream, len(livestreams))
+	for _, livestream := range livestreams {
+		livestreamMap[livestream.ID] = livestream
+	}
+
+	for _, historyModel := range historyModels {
+		livestream, ok := livestreamMap[historyModel.LivestreamID]
+		if !ok {
+			continue
+		}
+		res.History = append(res.History, WatchHistoryEntry{
+			Livestream:     livestream,
+			FirstWatchedAt: historyModel.FirstWatchedAt,
+			LastWatchedAt:  historyModel.LastWatchedAt,
+			WatchSeconds:   historyModel.WatchSeconds,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 視聴履歴の削除API
+// DELETE /api/user/me/history
+func deleteWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM watch_history WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete watch history: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 視聴履歴の一時停止・再開API
+// PUT /api/user/me/history/settings
+func putWatchHistorySettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := currentUser(c).ID
+
+	var req *PutWatchHistorySettingsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if req.Paused {
+		if _, err := dbConn.ExecContext(ctx, "INSERT IGNORE INTO watch_history_pauses (user_id, created_at) VALUES (?, ?)", userID, time.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to pause watch history: "+err.Error())
+		}
+	} else {
+		if _, err := dbConn.ExecContext(ctx, "DELETE FROM watch_history_pauses WHERE user_id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to resume watch history: "+err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyKeyRetention   = 24 * time.Hour
+	idempotencySweepInterval  = 10 * time.Minute
+	mysqlErrDuplicateEntryNum = 1062
+)
+
+type IdempotencyKeyModel struct {
+	UserID         int64  `db:"user_id"`
+	IdempotencyKey string `db:"idempotency_key"`
+	RequestHash    string `db:"request_hash"`
+	StatusCode     int    `db:"status_code"`
+	ContentType    string `db:"content_type"`
+	ResponseBody   []byte `db:"response_body"`
+	CreatedAt      int64  `db:"created_at"`
+}
+
+// idempotencyRequest はミドルウェアがハンドラに渡すキー
+type idempotencyRequest struct {
+	UserID      int64
+	Key         string
+	RequestHash string
+}
+
+const idempotencyRequestContextKey = "idempotency_request"
+
+// errIdempotencyKeyUsed は同じキーのリクエストが先にコミットされたことを表す
+var errIdempotencyKeyUsed = errors.New("idempotency key is already used")
+
+// idempotencyRequestHash は同じキーで別のリクエストが来ていないかを見るためのハッシュ
+// パスも含めるので、同じキーを別の配信に使うと不一致になる
+func idempotencyRequestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, method+" "+path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// requireIdempotency は Idempotency-Key ヘッダのついたリクエストを一度だけ処理する
+// 再送には保存したレスポンスを返し、同じキーで中身が違えば422にする
+// レスポンスはハンドラが saveIdempotentResponse でトランザクションの中に保存する
+// コミットされなかったリクエストは何も残らないので、同じキーでやり直せる
+// ユーザごとにキーを持つので requireUser の後に置く
+func requireIdempotency(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+		}
+
+		ctx := c.Request().Context()
+		userID := currentUser(c).ID
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body")
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := idempotencyRequestHash(c.Request().Method, c.Request().URL.Path, body)
+
+		keyModel, err := getIdempotencyKey(ctx, userID, key)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if keyModel != nil {
+			return replayIdempotentResponse(c, keyModel, requestHash)
+		}
+
+		c.Set(idempotencyRequestContextKey, &idempotencyRequest{UserID: userID, Key: key, RequestHash: requestHash})
+		handlerErr := next(c)
+		if !errors.Is(handlerErr, errIdempotencyKeyUsed) {
+			return handlerErr
+		}
+
+		// 同時に来た同じキーのリクエストが先にコミットされたので、その結果を返す
+		keyModel, err = getIdempotencyKey(ctx, userID, key)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if keyModel == nil {
+			return echo.NewHTTPError(http.StatusConflict, "request with the same Idempotency-Key is in progress")
+		}
+		return replayIdempotentResponse(c, keyModel, requestHash)
+	}
+}
+
+// idempotencyKeyExpiredBefore はこの時刻より前に作られたキーを期限切れとする
+func idempotencyKeyExpiredBefore(now time.Time) int64 {
+	return now.Add(-idempotencyKeyRetention).Unix()
+}
+
+// getIdempotencyKey は保持期間内のキーを返す。sweeper が消す前の期限切れのキーはないものとして扱う
+func getIdempotencyKey(ctx context.Context, userID int64, key string) (*IdempotencyKeyModel, error) {
+	var keyModel IdempotencyKeyModel
+	if err := dbConn.GetContext(ctx, &keyModel, "SELECT * FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND created_at >= ?", userID, key, idempotencyKeyExpiredBefore(time.Now())); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	return &keyModel, nil
+}
+
+// saveIdempotentResponse はハンドラのトランザクションの中でレスポンスを保存する
+// キーのないリクエストでは何もしない。コミットの前に呼ぶ
+// 同じキーのリクエストが先にコミットされていれば errIdempotencyKeyUsed を返すので、そのままミドルウェアに返す
+func saveIdempotentResponse(c echo.Context, tx sqlx.ExecerContext, status int, v any) error {
+	r, ok := c.Get(idempotencyRequestContextKey).(*idempotencyRequest)
+	if !ok {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	now := time.Now()
+	body, err := json.Marshal(v)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode idempotent response: "+err.Error())
+	}
+	// 期限切れで残っている同じキーは上書きする
+	if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND created_at < ?", r.UserID, r.Key, idempotencyKeyExpiredBefore(now)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete expired idempotency key: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, status_code, content_type, response_body, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		r.UserID, r.Key, r.RequestHash, status, echo.MIMEApplicationJSON, body, now.Unix()); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntryNum {
+			return errIdempotencyKeyUsed
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save idempotent response: "+err.Error())
+	}
+	return nil
+}
+
+func replayIdempotentResponse(c echo.Context, keyModel *IdempotencyKeyModel, requestHash string) error {
+	if keyModel.RequestHash != requestHash {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Idempotency-Key is already used for a different request")
+	}
+
+	c.Response().Header().Set(idempotentReplayedHeader, "true")
+	return c.Blob(keyModel.StatusCode, keyModel.ContentType, keyModel.ResponseBody)
+}
+
+// IdempotencyKeySweeper は保持期間を過ぎたキーを定期的に消す
+type IdempotencyKeySweeper struct {
+	retention time.Duration
+}
+
+var idempotencyKeySweeper = &IdempotencyKeySweeper{
+	retention: idempotencyKeyRetention,
+}
+
+func (s *IdempotencyKeySweeper) Run(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.sweep(ctx, time.Now()); err != nil {
+			logger.Warnf("failed to sweep idempotency keys: %v", err)
+		}
+	}
+}
+
+func (s *IdempotencyKeySweeper) sweep(ctx context.Context, now time.Time) error {
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", now.Add(-s.retention).Unix()); err != nil {
+		return fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+	return nil
+}
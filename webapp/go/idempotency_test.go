@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyRequestHash(t *testing.T) {
+	body := []byte(`{"comment":"hi","tip":100}`)
+	hash := idempotencyRequestHash(http.MethodPost, "/api/livestream/1/livecomment", body)
+
+	assert.Equal(t, hash, idempotencyRequestHash(http.MethodPost, "/api/livestream/1/livecomment", []byte(`{"comment":"hi","tip":100}`)))
+	// 中身か宛先が違えば別のリクエスト
+	assert.NotEqual(t, hash, idempotencyRequestHash(http.MethodPost, "/api/livestream/1/livecomment", []byte(`{"comment":"hi","tip":1000}`)))
+	assert.NotEqual(t, hash, idempotencyRequestHash(http.MethodPost, "/api/livestream/2/livecomment", body))
+}
+
+func TestReplayIdempotentResponse(t *testing.T) {
+	keyModel := &IdempotencyKeyModel{
+		RequestHash:  "hash",
+		StatusCode:   http.StatusCreated,
+		ContentType:  echo.MIMEApplicationJSON,
+		ResponseBody: []byte(`{"id":1}`),
+	}
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+	require.NoError(t, replayIdempotentResponse(c, keyModel, "hash"))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get(idempotentReplayedHeader))
+	assert.JSONEq(t, `{"id":1}`, rec.Body.String())
+
+	// 同じキーで中身が違う
+	c = e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder())
+	err := replayIdempotentResponse(c, keyModel, "other")
+	var httpErr *echo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, httpErr.Code)
+}
+
+func TestSaveIdempotentResponseWithoutKey(t *testing.T) {
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder())
+
+	// キーのないリクエストではトランザクションに触らない
+	assert.NoError(t, saveIdempotentResponse(c, nil, http.StatusCreated, map[string]int64{"id": 1}))
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -38,6 +37,8 @@ type Livecomment struct {
 	Comment    string     `json:"comment"`
 	Tip        int64      `json:"tip"`
 	CreatedAt  int64      `json:"created_at"`
+	// HeldTip は投稿直後のレスポンスだけに入る、保留になったチップの額
+	HeldTip int64 `json:"held_tip,omitempty"`
 }
 
 type LivecommentReport struct {
@@ -70,11 +71,6 @@ type NGWord struct {
 func getLivecommentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -115,19 +111,8 @@ func getLivecommentsHandler(c echo.Context) error {
 func getNgwords(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
-	}
+	userID := currentUser(c).ID
+	livestreamID := currentLivestream(c).ID
 
 	tx, err := dbConn.Connx(ctx)
 	if err != nil {
@@ -151,30 +136,30 @@ func postLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
+	userID := currentUser(c).ID
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *PostLivecommentRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.Connx(ctx)
+	// コメント・集計・台帳・通知はまとめてコミットする
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if req.Tip != 0 {
+		if err := lockTipper(ctx, tx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 	}
-	defer tx.Close()
 
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
@@ -184,6 +169,9 @@ func postLivecommentHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
+	if err := requireLivestreamOpen(&livestreamModel); err != nil {
+		return err
+	}
 
 	// スパム判定
 	var ngwords []*NGWord
@@ -198,6 +186,19 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 
 	now := time.Now().Unix()
+
+	// チップの検証と不正対策。保留にしたチップは承認されるまでコメントに載せない
+	var holdTip bool
+	if req.Tip != 0 {
+		usage, err := loadTipUsage(ctx, tx, tipPolicy, userID, livestreamModel.ID, time.Unix(now, 0))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if holdTip, err = tipPolicy.Check(req.Tip, livestreamModel.UserID == userID, usage); err != nil {
+			return err
+		}
+	}
+
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
 		LivestreamID: int64(livestreamID),
@@ -205,6 +206,9 @@ func postLivecommentHandler(c echo.Context) error {
 		Tip:          req.Tip,
 		CreatedAt:    now,
 	}
+	if holdTip {
+		livecommentModel.Tip = 0
+	}
 
 	rs, err := tx.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", livecommentModel.UserID, livecommentModel.LivestreamID, livecommentModel.Comment, livecommentModel.Tip, livecommentModel.CreatedAt)
 	if err != nil {
@@ -217,10 +221,70 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 	livecommentModel.ID = livecommentID
 
+	if holdTip {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO held_tips (livecomment_id, livestream_id, user_id, amount, reason, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			livecommentID, livestreamModel.ID, userID, req.Tip, heldTipReasonVelocity, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to hold tip: "+err.Error())
+		}
+	}
+
+	if err := addLivecommentStats(ctx, tx, &livestreamModel, livecommentModel.Tip); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := addTipper(ctx, tx, livestreamModel.ID, userID, livecommentModel.Tip, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := appendTipLedger(ctx, tx, tipLedgerEntries(tipLedgerKindTip, &livestreamModel, []*LivecommentModel{&livecommentModel}, now)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// 配信者に投げ銭を通知
+	if livecommentModel.Tip > 0 {
+		if err := insertNotifications(ctx, tx, []NotificationModel{{
+			UserID:        livestreamModel.UserID,
+			Type:          notificationTypeTipReceived,
+			ActorID:       userID,
+			LivestreamID:  livestreamModel.ID,
+			LivecommentID: livecommentID,
+			Amount:        livecommentModel.Tip,
+			CreatedAt:     now,
+		}}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to notify tip: "+err.Error())
+		}
+		if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, webhookEventTipReceived, TipReceivedWebhookData{
+			LivestreamID:  livestreamModel.ID,
+			LivecommentID: livecommentID,
+			UserID:        userID,
+			Comment:       livecommentModel.Comment,
+			Tip:           livecommentModel.Tip,
+		}, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+		}
+	}
+
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
 	}
+	if err := saveIdempotentResponse(c, tx, http.StatusCreated, livecomment); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	// メモリ上の集計はコミットしてから反映する
+	statsRollupWriter.AddLivecomment(livestreamModel.ID, now, livecommentModel.Tip)
+	if err := statsRankings.Add(ctx, &livestreamModel, livecommentModel.Tip, now); err != nil {
+		// コメントは保存済みなので失敗にはしない。ランキングは起動時・初期化時に作り直される
+		c.Logger().Errorf("failed to update rankings: %v", err)
+	}
+	if livecommentModel.Tip > 0 {
+		webhookDispatcher.Wake()
+	}
+	if holdTip {
+		livecomment.HeldTip = req.Tip
+	}
 
 	return c.JSON(http.StatusCreated, livecomment)
 }
@@ -228,9 +292,7 @@ func postLivecommentHandler(c echo.Context) error {
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
+	userID := currentUser(c).ID
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -242,11 +304,6 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -288,6 +345,19 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 	reportModel.ID = reportID
 
+	if err := addReportStats(ctx, tx, &livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, webhookEventLivecommentReported, LivecommentReportedWebhookData{
+		LivestreamID:  reportModel.LivestreamID,
+		LivecommentID: reportModel.LivecommentID,
+		ReportID:      reportID,
+		ReporterID:    reportModel.UserID,
+	}, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
+
 	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
@@ -295,6 +365,8 @@ func reportLivecommentHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	webhookDispatcher.Wake()
+	statsRollupWriter.AddReport(livestreamModel.ID, now)
 
 	return c.JSON(http.StatusCreated, report)
 }
@@ -304,19 +376,8 @@ func moderateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := currentUser(c).ID
+	livestreamID := currentLivestream(c).ID
 
 	var req *ModerateRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -329,15 +390,6 @@ func moderateHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-	if len(ownedLivestreams) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
-	}
-
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -360,41 +412,169 @@ func moderateHandler(c echo.Context) error {
 
 	time.Sleep(500 * time.Millisecond)
 
+	ng_livecomments, err := hideNGLivecomments(ctx, tx, livestreamID, ngwords)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	ng_livecomment_ids := make([]int64, 0, len(ng_livecomments))
+	for _, livecomment := range ng_livecomments {
+		ng_livecomment_ids = append(ng_livecomment_ids, livecomment.ID)
+	}
+
+	if len(ng_livecomments) > 0 {
+		if err := hideLivecommentStats(ctx, tx, currentLivestream(c), ng_livecomments); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if err := removeTippers(ctx, tx, livestreamID, ng_livecomments); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if err := appendTipLedger(ctx, tx, tipLedgerEntries(tipLedgerKindRefund, currentLivestream(c), ng_livecomments, time.Now().Unix())); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		// 非表示になったコメントの投稿者に通知
+		if err := notifyHiddenLivecomments(ctx, tx, userID, ng_livecomments, time.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to notify hidden livecomments: "+err.Error())
+		}
+	}
+
+	if err := enqueueWebhookEvent(ctx, tx, currentLivestream(c).UserID, webhookEventLivestreamModerated, LivestreamModeratedWebhookData{
+		LivestreamID:         livestreamID,
+		NGWordID:             wordID,
+		NGWord:               req.NGWord,
+		HiddenLivecommentIDs: ng_livecomment_ids,
+	}, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	webhookDispatcher.Wake()
+	// チップはコメントした時刻の期間のランキングから引く
+	for _, livecomment := range ng_livecomments {
+		statsRollupWriter.RemoveLivecomment(livestreamID, livecomment.CreatedAt, livecomment.Tip)
+		if livecomment.Tip == 0 {
+			continue
+		}
+		if err := statsRankings.Add(ctx, currentLivestream(c), -livecomment.Tip, livecomment.CreatedAt); err != nil {
+			c.Logger().Errorf("failed to update rankings: %v", err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"word_id": wordID,
+	})
+}
+
+// hideNGLivecomments はNGワードを含む表示中のコメントを非表示にし、非表示にしたコメントを返す
+// 同時に走るモデレーションやチップの承認と同じコメントを取り合わないよう、行をロックして読む
+func hideNGLivecomments(ctx context.Context, tx *sqlx.Tx, livestreamID int64, ngwords []*NGWord) ([]*LivecommentModel, error) {
 	var livecomments []*LivecommentModel
-	if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ? and is_deleted = 0", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ? AND is_deleted = 0 FOR UPDATE", livestreamID); err != nil {
+		return nil, fmt.Errorf("failed to get livecomments: %w", err)
 	}
 
-	ng_livecomment_ids := make([]int64, 0, len(livecomments))
+	ngLivecommentIDs := make([]int64, 0, len(livecomments))
+	ngLivecomments := make([]*LivecommentModel, 0, len(livecomments))
 	for _, livecomment := range livecomments {
 		for _, ngword := range ngwords {
 			if strings.Contains(livecomment.Comment, ngword.Word) {
-				ng_livecomment_ids = append(ng_livecomment_ids, livecomment.ID)
+				ngLivecommentIDs = append(ngLivecommentIDs, livecomment.ID)
+				ngLivecomments = append(ngLivecomments, livecomment)
 				break
 			}
 		}
 	}
+	if len(ngLivecommentIDs) == 0 {
+		return ngLivecomments, nil
+	}
 
-	// ng_livecomment_idsのコメントを削除
-	if len(ng_livecomment_ids) > 0 {
-		query, args, err := sqlx.In("UPDATE livecomments SET is_deleted = 1 WHERE id IN (?)", ng_livecomment_ids)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build delete query: "+err.Error())
-		}
-		query = tx.Rebind(query)
-		_, err = tx.ExecContext(ctx, query, args...)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomments: "+err.Error())
+	query, args, err := sqlx.In("UPDATE livecomments SET is_deleted = 1 WHERE id IN (?) AND is_deleted = 0", ngLivecommentIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build delete query: %w", err)
+	}
+	rs, err := tx.ExecContext(ctx, tx.Rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete livecomments: %w", err)
+	}
+	// ロックしているので読んだ行はすべて更新されるはずだが、集計を戻す前に確かめる
+	hidden, err := rs.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if hidden != int64(len(ngLivecommentIDs)) {
+		return nil, fmt.Errorf("failed to delete livecomments: %d of %d livecomments were changed concurrently", int64(len(ngLivecommentIDs))-hidden, len(ngLivecommentIDs))
+	}
+
+	return ngLivecomments, nil
+}
+
+// 非表示にしたライブコメントの復元API
+// POST /api/livestream/:livestream_id/livecomment/:livecomment_id/restore
+// NGワードは消えないので、次のモデレーションでまた非表示になることがある
+func restoreLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamModel := currentLivestream(c)
+
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ? FOR UPDATE", livecommentID, livestreamModel.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
 		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+	if !livecommentModel.IsDeleted {
+		return echo.NewHTTPError(http.StatusConflict, "livecomment is not hidden")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET is_deleted = 0 WHERE id = ?", livecommentModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore livecomment: "+err.Error())
+	}
+	livecommentModel.IsDeleted = false
+
+	// 非表示にしたときの集計・返金を打ち消す
+	if err := addLivecommentStats(ctx, tx, livestreamModel, livecommentModel.Tip); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := addTipper(ctx, tx, livestreamModel.ID, livecommentModel.UserID, livecommentModel.Tip, livecommentModel.CreatedAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := appendTipLedger(ctx, tx, tipLedgerEntries(tipLedgerKindReversal, livestreamModel, []*LivecommentModel{&livecommentModel}, time.Now().Unix())); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	statsRollupWriter.AddLivecomment(livestreamModel.ID, livecommentModel.CreatedAt, livecommentModel.Tip)
+	if err := statsRankings.Add(ctx, livestreamModel, livecommentModel.Tip, livecommentModel.CreatedAt); err != nil {
+		c.Logger().Errorf("failed to update rankings: %v", err)
+	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
-	})
+	conn, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer conn.Close()
+	livecomment, err := fillLivecommentResponse(ctx, conn, livecommentModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livecomment)
 }
 
 func fillLivecommentResponses(ctx context.Context, tx *sqlx.Conn, livecommentModels []LivecommentModel) ([]Livecomment, error) {
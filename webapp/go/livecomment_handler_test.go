@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLivecommentDB は hideNGLivecomments が発行するクエリだけを解釈する database/sql のドライバ
+// SELECT ... FOR UPDATE はコミットかロールバックまで livecomments 全体をロックする
+type fakeLivecommentDB struct {
+	mu           sync.Mutex
+	rowLock      sync.Mutex
+	livecomments []LivecommentModel
+}
+
+func newFakeLivecommentDB(t *testing.T, livecomments []LivecommentModel) (*fakeLivecommentDB, *sqlx.DB) {
+	fake := &fakeLivecommentDB{livecomments: livecomments}
+	db := sqlx.NewDb(sql.OpenDB(fake), "mysql")
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+func (f *fakeLivecommentDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeLivecommentConn{db: f}, nil
+}
+func (f *fakeLivecommentDB) Driver() driver.Driver { return f }
+func (f *fakeLivecommentDB) Open(string) (driver.Conn, error) {
+	return &fakeLivecommentConn{db: f}, nil
+}
+
+type fakeLivecommentConn struct {
+	db *fakeLivecommentDB
+	// tx はトランザクション中なら開始時点の livecomments
+	tx     []LivecommentModel
+	locked bool
+}
+
+func (c *fakeLivecommentConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare is not supported: %s", query)
+}
+func (c *fakeLivecommentConn) Close() error { return nil }
+func (c *fakeLivecommentConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.tx = append([]LivecommentModel{}, c.db.livecomments...)
+	return c, nil
+}
+
+func (c *fakeLivecommentConn) Commit() error {
+	c.tx = nil
+	c.unlock()
+	return nil
+}
+
+func (c *fakeLivecommentConn) Rollback() error {
+	c.db.mu.Lock()
+	c.db.livecomments = c.tx
+	c.db.mu.Unlock()
+	c.tx = nil
+	c.unlock()
+	return nil
+}
+
+func (c *fakeLivecommentConn) unlock() {
+	if c.locked {
+		c.locked = false
+		c.db.rowLock.Unlock()
+	}
+}
+
+func (c *fakeLivecommentConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query != "SELECT * FROM livecomments WHERE livestream_id = ? AND is_deleted = 0 FOR UPDATE" {
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+	if !c.locked {
+		c.db.rowLock.Lock()
+		c.locked = true
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	rows := &fakeRows{columns: []string{"id", "user_id", "livestream_id", "comment", "tip", "created_at", "is_deleted"}}
+	for _, l := range c.db.livecomments {
+		if l.LivestreamID == args[0].Value && !l.IsDeleted {
+			rows.values = append(rows.values, []driver.Value{l.ID, l.UserID, l.LivestreamID, l.Comment, l.Tip, l.CreatedAt, l.IsDeleted})
+		}
+	}
+	return rows, nil
+}
+
+func (c *fakeLivecommentConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "UPDATE livecomments SET is_deleted = 1 WHERE id IN (") || !strings.HasSuffix(query, ") AND is_deleted = 0") {
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	var affected int64
+	for i := range c.db.livecomments {
+		l := &c.db.livecomments[i]
+		for _, arg := range args {
+			if l.ID == arg.Value && !l.IsDeleted {
+				l.IsDeleted = true
+				affected++
+			}
+		}
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func TestHideNGLivecommentsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	fake, db := newFakeLivecommentDB(t, []LivecommentModel{
+		{ID: 1, UserID: 10, LivestreamID: 1, Comment: "いい配信", CreatedAt: 100},
+		{ID: 2, UserID: 11, LivestreamID: 1, Comment: "NGな投稿", Tip: 500, CreatedAt: 101},
+		{ID: 3, UserID: 12, LivestreamID: 1, Comment: "またNG", CreatedAt: 102},
+		{ID: 4, UserID: 12, LivestreamID: 2, Comment: "別の配信のNG", CreatedAt: 103},
+	})
+	ngwords := []*NGWord{{LivestreamID: 1, Word: "NG"}}
+
+	// 同じNGワードで2つのモデレーションが同時に走っても、各コメントを非表示にするのは片方だけ
+	var wg sync.WaitGroup
+	hidden := make([][]*LivecommentModel, 2)
+	errs := make([]error, 2)
+	for i := range hidden {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, err := db.BeginTxx(ctx, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer tx.Rollback()
+			if hidden[i], errs[i] = hideNGLivecomments(ctx, tx, 1, ngwords); errs[i] != nil {
+				return
+			}
+			// コミットまでの間にもう片方が同じコメントを読まないこと
+			time.Sleep(50 * time.Millisecond)
+			errs[i] = tx.Commit()
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	var ids []int64
+	for _, livecomments := range hidden {
+		for _, l := range livecomments {
+			ids = append(ids, l.ID)
+		}
+	}
+	assert.ElementsMatch(t, []int64{2, 3}, ids)
+
+	var deleted []int64
+	for _, l := range fake.livecomments {
+		if l.IsDeleted {
+			deleted = append(deleted, l.ID)
+		}
+	}
+	assert.Equal(t, []int64{2, 3}, deleted)
+}
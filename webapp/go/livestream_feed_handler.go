@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	icalendarContentType = "text/calendar; charset=utf-8"
+	atomContentType      = "application/atom+xml; charset=utf-8"
+
+	icalendarTimeFormat = "20060102T150405Z"
+	// RFC 5545 3.1: 1行は75オクテットまで
+	icalendarMaxLineOctets = 75
+)
+
+// livestreamPageURL は配信ページのURL
+func livestreamPageURL(username string, livestreamID int64) string {
+	return fmt.Sprintf("https://%s.%s/watch/%d", username, powerDNSZoneName, livestreamID)
+}
+
+// escapeICalendarText はTEXT型の値をエスケープする (RFC 5545 3.3.11)
+func escapeICalendarText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// writeICalendarLine は長い行をCRLF+空白で折り返して書く (RFC 5545 3.1)
+// UTF-8の文字の途中では折り返さない
+func writeICalendarLine(buf *bytes.Buffer, line string) {
+	limit := icalendarMaxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isUTF8Boundary(line, cut) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// 継続行は先頭の空白の分だけ短くする
+		limit = icalendarMaxLineOctets - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func isUTF8Boundary(s string, i int) bool {
+	return i >= len(s) || s[i]&0xC0 != 0x80
+}
+
+func renderLivestreamICalendar(username string, livestreams []Livestream) []byte {
+	buf := new(bytes.Buffer)
+	writeICalendarLine(buf, "BEGIN:VCALENDAR")
+	writeICalendarLine(buf, "VERSION:2.0")
+	writeICalendarLine(buf, "PRODID:-//ISUCON//ISUPipe//JA")
+	writeICalendarLine(buf, "CALSCALE:GREGORIAN")
+	writeICalendarLine(buf, "X-WR-CALNAME:"+escapeICalendarText(username))
+	for _, livestream := range livestreams {
+		writeICalendarLine(buf, "BEGIN:VEVENT")
+		writeICalendarLine(buf, fmt.Sprintf("UID:livestream-%d@%s", livestream.ID, powerDNSZoneName))
+		// 配信には更新日時がないので、レスポンスが毎回変わらないよう開始日時を使う
+		writeICalendarLine(buf, "DTSTAMP:"+time.Unix(livestream.StartAt, 0).UTC().Format(icalendarTimeFormat))
+		writeICalendarLine(buf, "DTSTART:"+time.Unix(livestream.StartAt, 0).UTC().Format(icalendarTimeFormat))
+		writeICalendarLine(buf, "DTEND:"+time.Unix(livestream.EndAt, 0).UTC().Format(icalendarTimeFormat))
+		writeICalendarLine(buf, "SUMMARY:"+escapeICalendarText(livestream.Title))
+		if livestream.Description != "" {
+			writeICalendarLine(buf, "DESCRIPTION:"+escapeICalendarText(livestream.Description))
+		}
+		writeICalendarLine(buf, "URL:"+livestreamPageURL(username, livestream.ID))
+		if livestream.State == LivestreamStateCancelled {
+			writeICalendarLine(buf, "STATUS:CANCELLED")
+		}
+		if len(livestream.Tags) > 0 {
+			categories := make([]string, len(livestream.Tags))
+			for i, tag := range livestream.Tags {
+				categories[i] = escapeICalendarText(tag.Name)
+			}
+			writeICalendarLine(buf, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+		writeICalendarLine(buf, "END:VEVENT")
+	}
+	writeICalendarLine(buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Link       atomLink       `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func renderLivestreamAtom(username string, livestreams []Livestream) ([]byte, error) {
+	// 新しい配信を先頭にする
+	sorted := make([]Livestream, len(livestreams))
+	copy(sorted, livestreams)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].StartAt != sorted[j].StartAt {
+			return sorted[i].StartAt > sorted[j].StartAt
+		}
+		return sorted[i].ID > sorted[j].ID
+	})
+
+	var updated int64
+	entries := make([]atomEntry, len(sorted))
+	for i, livestream := range sorted {
+		updated = max(updated, livestream.StartAt)
+		categories := make([]atomCategory, len(livestream.Tags))
+		for j, tag := range livestream.Tags {
+			categories[j] = atomCategory{Term: tag.Name}
+		}
+		entries[i] = atomEntry{
+			ID:    fmt.Sprintf("tag:%s,2023:livestream/%d", powerDNSZoneName, livestream.ID),
+			Title: livestream.Title,
+			// 配信には更新日時がないので開始日時を使う
+			Updated:    time.Unix(livestream.StartAt, 0).UTC().Format(time.RFC3339),
+			Link:       atomLink{Href: livestreamPageURL(username, livestream.ID), Rel: "alternate"},
+			Summary:    livestream.Description,
+			Categories: categories,
+		}
+	}
+
+	feed := atomFeed{
+		ID:      fmt.Sprintf("tag:%s,2023:user/%s/livestream", powerDNSZoneName, username),
+		Title:   username + " の配信",
+		Updated: time.Unix(updated, 0).UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: username},
+		Link:    atomLink{Href: fmt.Sprintf("https://%s.%s/", username, powerDNSZoneName), Rel: "alternate"},
+		Entries: entries,
+	}
+
+	buf := bytes.NewBufferString(xml.Header)
+	if err := xml.NewEncoder(buf).Encode(feed); err != nil {
+		return nil, fmt.Errorf("failed to encode atom feed: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// feedVersion はフィードの中身が変わったかを、配信一覧を読んで描画せずに判定するための値
+// 予約した後に変わるのは状態と終了日時だけなので、件数・最大ID・それらのチェックサムで足りる
+type feedVersion struct {
+	UserID   int64  `db:"user_id"`
+	Count    int64  `db:"count"`
+	MaxID    int64  `db:"max_id"`
+	Checksum uint64 `db:"checksum"`
+}
+
+func getFeedVersion(ctx context.Context, tx *sqlx.Conn, username string) (feedVersion, error) {
+	var v feedVersion
+	if err := tx.GetContext(ctx, &v, `SELECT u.id AS user_id, COUNT(l.id) AS count, IFNULL(MAX(l.id), 0) AS max_id,
+		BIT_XOR(IFNULL(CRC32(CONCAT_WS(':', l.id, l.state, l.end_at)), 0)) AS checksum
+	FROM users u LEFT JOIN livestreams l ON l.user_id = u.id WHERE u.name = ? GROUP BY u.id`, username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return feedVersion{}, echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		return feedVersion{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get feed version: "+err.Error())
+	}
+	return v, nil
+}
+
+// feedETag はフィードの形式と feedVersion から強いETagを作る
+func feedETag(format string, v feedVersion) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d:%d:%d", format, v.UserID, v.Count, v.MaxID, v.Checksum))))
+}
+
+// etagMatches は If-None-Match ヘッダのいずれかがETagと一致するか調べる (弱い比較)
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFeedETag はETagを付け、条件付きGETでフィードが変わっていなければ true を返す
+// 配信一覧を読む前に呼び、変わっていなければ304だけを返す
+func checkFeedETag(c echo.Context, etag string) bool {
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "public, max-age=60")
+	ifNoneMatch := c.Request().Header.Get("If-None-Match")
+	return ifNoneMatch != "" && etagMatches(ifNoneMatch, etag)
+}
+
+// 配信予定のiCalendarAPI
+// GET /api/user/:username/livestream.ics
+func getUserLivestreamsICalendarHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	v, err := getFeedVersion(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+	if checkFeedETag(c, feedETag("ics", v)) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	livestreams, err := getUserLivestreams(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	return c.Blob(http.StatusOK, icalendarContentType, renderLivestreamICalendar(username, livestreams))
+}
+
+// 配信予定のAtomフィードAPI
+// GET /api/user/:username/livestream.atom
+func getUserLivestreamsAtomHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	v, err := getFeedVersion(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+	if checkFeedETag(c, feedETag("atom", v)) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	livestreams, err := getUserLivestreams(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	body, err := renderLivestreamAtom(username, livestreams)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.Blob(http.StatusOK, atomContentType, body)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeICalendarText(t *testing.T) {
+	assert.Equal(t, `a\, b\; c\\d\ne`, escapeICalendarText("a, b; c\\d\r\ne"))
+}
+
+func TestWriteICalendarLineFolds(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeICalendarLine(buf, "SUMMARY:"+strings.Repeat("配信", 40))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	assert.Greater(t, len(lines), 1)
+	for i, line := range lines {
+		assert.LessOrEqual(t, len(line), icalendarMaxLineOctets)
+		if i > 0 {
+			assert.True(t, strings.HasPrefix(line, " "))
+		}
+	}
+	// 折り返しを戻すと元に戻る
+	assert.Equal(t, "SUMMARY:"+strings.Repeat("配信", 40), strings.ReplaceAll(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n ", ""))
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := feedETag("ics", feedVersion{UserID: 1, Count: 2, MaxID: 3, Checksum: 4})
+	assert.True(t, etagMatches(etag, etag))
+	assert.True(t, etagMatches(`"other", W/`+etag, etag))
+	assert.True(t, etagMatches("*", etag))
+	assert.False(t, etagMatches(`"other"`, etag))
+}
+
+func TestFeedETag(t *testing.T) {
+	v := feedVersion{UserID: 1, Count: 2, MaxID: 3, Checksum: 4}
+	assert.Equal(t, feedETag("ics", v), feedETag("ics", v))
+	// 形式が違うか、配信の追加や状態の変更があればETagも変わる
+	assert.NotEqual(t, feedETag("ics", v), feedETag("atom", v))
+	changed := v
+	changed.Checksum = 5
+	assert.NotEqual(t, feedETag("ics", v), feedETag("ics", changed))
+}
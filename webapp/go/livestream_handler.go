@@ -11,7 +11,6 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -23,6 +22,8 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// TipGoal はチップの目標額。0なら目標なし
+	TipGoal int64 `json:"tip_goal"`
 }
 
 type LivestreamViewerModel struct {
@@ -40,6 +41,8 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	State        string `db:"state" json:"state"`
+	TipGoal      int64  `db:"tip_goal" json:"tip_goal"`
 }
 
 type Livestream struct {
@@ -52,6 +55,8 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	// State は scheduled, live, ended, cancelled のいずれか
+	State string `json:"state"`
 }
 
 type LivestreamTagModel struct {
@@ -71,15 +76,7 @@ func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := currentUser(c).ID
 
 	var req *ReserveLivestreamRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -96,22 +93,21 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
 		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
 	}
+	if req.TipGoal < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tip_goal must not be negative")
+	}
 
 	startAts := make([]int64, 0, 10)
 	for startAt := req.StartAt; startAt+3600 <= req.EndAt; startAt += 3600 {
 		startAts = append(startAts, startAt)
 	}
 
-	// tx, err := dbConn.BeginTxx(ctx, nil)
-	// if err != nil {
-	// 	return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	// }
-	// defer tx.Rollback()
-	tx, err := dbConn.Connx(ctx)
+	// 枠の確保と Idempotency-Key の保存はまとめてコミットする
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
-	defer tx.Close()
+	defer tx.Rollback()
 
 	query, args, err := sqlx.In("UPDATE reservation_slots SET slot = slot - 1 WHERE start_at IN (?) AND slot >= 1", startAts)
 	if err != nil {
@@ -138,10 +134,12 @@ func reserveLivestreamHandler(c echo.Context) error {
 			ThumbnailUrl: req.ThumbnailUrl,
 			StartAt:      req.StartAt,
 			EndAt:        req.EndAt,
+			State:        LivestreamStateScheduled,
+			TipGoal:      req.TipGoal,
 		}
 	)
 
-	rs, err = tx.ExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(?, ?, ?, ?, ?, ?, ?)", int64(userID), req.Title, req.Description, req.PlaylistUrl, req.ThumbnailUrl, req.StartAt, req.EndAt)
+	rs, err = tx.ExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, tip_goal) VALUES(?, ?, ?, ?, ?, ?, ?, ?)", int64(userID), req.Title, req.Description, req.PlaylistUrl, req.ThumbnailUrl, req.StartAt, req.EndAt, req.TipGoal)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
@@ -167,10 +165,32 @@ func reserveLivestreamHandler(c echo.Context) error {
 		}
 	}
 
+	// フォロワーに配信予約を通知
+	if err := notifyFollowers(ctx, tx, notificationTypeLivestreamReserved, *livestreamModel, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to notify followers: "+err.Error())
+	}
+	if err := enqueueWebhookEvent(ctx, tx, userID, webhookEventLivestreamReserved, LivestreamReservedWebhookData{
+		LivestreamID: livestreamID,
+		Title:        livestreamModel.Title,
+		StartAt:      livestreamModel.StartAt,
+		EndAt:        livestreamModel.EndAt,
+	}, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
+
 	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
+	if err := saveIdempotentResponse(c, tx, http.StatusCreated, livestream); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	webhookDispatcher.Wake()
+	statsRankings.AddLivestream(livestreamID, currentUser(c).Name, req.Tags)
 
 	return c.JSON(http.StatusCreated, livestream)
 }
@@ -185,6 +205,13 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Close()
 
+	// 状態による絞り込み
+	state := c.QueryParam("state")
+	if state != "" && !isLivestreamState(state) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown state: "+state)
+	}
+	now := livestreamClock().Unix()
+
 	var livestreamModels []*LivestreamModel
 	if c.QueryParam("tag") != "" {
 		// タグによる取得
@@ -207,12 +234,22 @@ func searchLivestreamsHandler(c echo.Context) error {
 			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 			}
+			if state != "" && ls.StateAt(now) != state {
+				continue
+			}
 
 			livestreamModels = append(livestreamModels, &ls)
 		}
 	} else {
 		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
+		query := "SELECT * FROM livestreams"
+		var args []any
+		if state != "" {
+			cond, condArgs := livestreamStateCondition("", state, now)
+			query += " WHERE " + cond
+			args = condArgs
+		}
+		query += " ORDER BY id DESC"
 		if c.QueryParam("limit") != "" {
 			limit, err := strconv.Atoi(c.QueryParam("limit"))
 			if err != nil {
@@ -221,7 +258,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 			query += fmt.Sprintf(" LIMIT %d", limit)
 		}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
 	}
@@ -236,20 +273,13 @@ func searchLivestreamsHandler(c echo.Context) error {
 
 func getMyLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	tx, err := dbConn.Connx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
 	}
 	defer tx.Close()
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := currentUser(c).ID
 
 	var livestreamModels []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
@@ -269,10 +299,6 @@ func getMyLivestreamsHandler(c echo.Context) error {
 
 func getUserLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	username := c.Param("username")
 
 	tx, err := dbConn.Connx(ctx)
@@ -281,39 +307,41 @@ func getUserLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Close()
 
+	livestreams, err := getUserLivestreams(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// getUserLivestreams はユーザの配信一覧を返す。JSON・iCalendar・Atomで共通
+func getUserLivestreams(ctx context.Context, tx *sqlx.Conn, username string) ([]Livestream, error) {
 	var user UserModel
 	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+			return nil, echo.NewHTTPError(http.StatusNotFound, "user not found")
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 		}
 	}
 
 	var livestreamModels []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return livestreams, nil
 }
 
 // viewerテーブルの廃止
 func enterLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := currentUser(c).ID
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -326,52 +354,52 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	if _, err := getOpenLivestream(ctx, tx, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	now := time.Now()
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+		CreatedAt:    now.Unix(),
 	}
 
+	// 視聴履歴は退出しても消さない
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	if err := recordUniqueViewer(ctx, tx, viewer.LivestreamID, viewer.UserID, now.Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := recordWatch(ctx, tx, viewer.UserID, viewer.LivestreamID, now.Unix(), true); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	// 入室はコミット済みなので、最大値を書けなくてもログに残すだけにする
+	if _, err := touchViewerPresence(ctx, dbConn, viewer.LivestreamID, viewer.UserID, now); err != nil {
+		c.Logger().Errorf("failed to touch viewer presence: %v", err)
+	}
 
 	return c.NoContent(http.StatusOK)
 }
 
 func exitLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := currentUser(c).ID
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// 視聴中から外すだけで、視聴履歴は残す
+	viewerPresence.Leave(int64(livestreamID), userID)
+	if err := finishWatch(ctx, dbConn, userID, int64(livestreamID), time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -380,10 +408,6 @@ func exitLivestreamHandler(c echo.Context) error {
 func getLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -415,14 +439,7 @@ func getLivestreamHandler(c echo.Context) error {
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
-	}
+	livestreamID := currentLivestream(c).ID
 
 	tx, err := dbConn.Connx(ctx)
 	if err != nil {
@@ -430,20 +447,6 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	}
 	defer tx.Close()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
-	}
-
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
-
-	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
-	}
-
 	var reportModels []*LivecommentReportModel
 	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
@@ -549,6 +552,7 @@ func fillLivestreamResponses(ctx context.Context, tx *sqlx.Conn, livestreamModel
 	}
 
 	// 結果のライブストリームスライスを作成
+	now := livestreamClock().Unix()
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i, livestreamModel := range livestreamModels {
 		// 所有者情報の取得
@@ -574,6 +578,7 @@ func fillLivestreamResponses(ctx context.Context, tx *sqlx.Conn, livestreamModel
 			ThumbnailUrl: livestreamModel.ThumbnailUrl,
 			StartAt:      livestreamModel.StartAt,
 			EndAt:        livestreamModel.EndAt,
+			State:        livestreamModel.StateAt(now),
 		}
 	}
 
@@ -618,6 +623,7 @@ func fillLivestreamResponse(ctx context.Context, tx SqlxConn, livestreamModel Li
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+		State:        livestreamModel.StateAt(livestreamClock().Unix()),
 	}
 	return livestream, nil
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	LivestreamStateScheduled = "scheduled"
+	LivestreamStateLive      = "live"
+	LivestreamStateEnded     = "ended"
+	LivestreamStateCancelled = "cancelled"
+)
+
+// livestreamClock は配信の状態判定に使う現在時刻
+var livestreamClock = time.Now
+
+// StateAt は now 時点の配信の状態を返す
+//
+// state カラムは配信者の操作を記録する。scheduled のままなら時刻から決まり、
+// live (開始を早めた) でも end_at を過ぎれば ended になる
+func (l *LivestreamModel) StateAt(now int64) string {
+	switch l.State {
+	case LivestreamStateCancelled, LivestreamStateEnded:
+		return l.State
+	case LivestreamStateLive:
+		if now >= l.EndAt {
+			return LivestreamStateEnded
+		}
+		return LivestreamStateLive
+	default:
+		if now < l.StartAt {
+			return LivestreamStateScheduled
+		}
+		if now < l.EndAt {
+			return LivestreamStateLive
+		}
+		return LivestreamStateEnded
+	}
+}
+
+func isLivestreamState(state string) bool {
+	switch state {
+	case LivestreamStateScheduled, LivestreamStateLive, LivestreamStateEnded, LivestreamStateCancelled:
+		return true
+	}
+	return false
+}
+
+// livestreamStateCondition は StateAt と同じ判定をするWHERE句を返す
+// prefix は livestreams テーブルのエイリアス ("" または "l.")
+func livestreamStateCondition(prefix string, state string, now int64) (string, []any) {
+	switch state {
+	case LivestreamStateScheduled:
+		return fmt.Sprintf("(%[1]sstate = ? AND %[1]sstart_at > ?)", prefix), []any{LivestreamStateScheduled, now}
+	case LivestreamStateLive:
+		return fmt.Sprintf("((%[1]sstate = ? AND %[1]send_at > ?) OR (%[1]sstate = ? AND %[1]sstart_at <= ? AND %[1]send_at > ?))", prefix),
+			[]any{LivestreamStateLive, now, LivestreamStateScheduled, now, now}
+	case LivestreamStateEnded:
+		return fmt.Sprintf("(%[1]sstate = ? OR (%[1]sstate IN (?, ?) AND %[1]send_at <= ?))", prefix),
+			[]any{LivestreamStateEnded, LivestreamStateScheduled, LivestreamStateLive, now}
+	default:
+		return fmt.Sprintf("%sstate = ?", prefix), []any{state}
+	}
+}
+
+// requireLivestreamState は配信が allowed のいずれかの状態でなければ400を返す
+func requireLivestreamState(livestreamModel *LivestreamModel, now int64, allowed ...string) error {
+	state := livestreamModel.StateAt(now)
+	for _, s := range allowed {
+		if state == s {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "livestream is "+state)
+}
+
+// requireLivestreamOpen は配信者が終了・中止した配信への書き込みを400で弾く
+// 書き込みは state カラムだけで判定し、時刻では弾かない
+// (ベンチマーカーは予約期間 2023-11-25〜2024-11-25 の配信に書き込むので、実時刻ではどれも終わっている)
+func requireLivestreamOpen(livestreamModel *LivestreamModel) error {
+	switch livestreamModel.State {
+	case LivestreamStateEnded, LivestreamStateCancelled:
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream is "+livestreamModel.State)
+	}
+	return nil
+}
+
+// getOpenLivestream は終了・中止されていない配信を取得する
+func getOpenLivestream(ctx context.Context, tx SqlxConn, livestreamID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := requireLivestreamOpen(&livestreamModel); err != nil {
+		return LivestreamModel{}, err
+	}
+	return livestreamModel, nil
+}
+
+// releaseReservationSlots は from から to までの予約枠を空ける
+func releaseReservationSlots(ctx context.Context, tx sqlx.ExecerContext, from, to int64) error {
+	if from >= to {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", from, to); err != nil {
+		return fmt.Errorf("failed to release reservation slots: %w", err)
+	}
+	return nil
+}
+
+// transitionLivestream は配信の状態を to に変える
+// 同時に操作された場合は片方だけが成功する
+func transitionLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, to string, endAt int64) error {
+	rs, err := tx.ExecContext(ctx, "UPDATE livestreams SET state = ?, end_at = ? WHERE id = ? AND state = ?", to, endAt, livestreamModel.ID, livestreamModel.State)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "livestream state has been changed")
+	}
+	livestreamModel.State = to
+	livestreamModel.EndAt = endAt
+	return nil
+}
+
+// 配信開始API
+// POST /api/livestream/:livestream_id/live
+func goLiveLivestreamHandler(c echo.Context) error {
+	return changeLivestreamState(c, func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64) error {
+		if err := requireLivestreamState(livestreamModel, now, LivestreamStateScheduled, LivestreamStateLive); err != nil {
+			return err
+		}
+		if livestreamModel.State == LivestreamStateLive {
+			return nil
+		}
+		return transitionLivestream(ctx, tx, livestreamModel, LivestreamStateLive, livestreamModel.EndAt)
+	})
+}
+
+// 配信終了API
+// 予約枠の残りの時間は空ける
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	return changeLivestreamState(c, func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64) error {
+		if err := requireLivestreamState(livestreamModel, now, LivestreamStateLive); err != nil {
+			return err
+		}
+		reservedEndAt := livestreamModel.EndAt
+		if err := transitionLivestream(ctx, tx, livestreamModel, LivestreamStateEnded, max(now, livestreamModel.StartAt)); err != nil {
+			return err
+		}
+		// 予約は1時間単位なので、まだ始まっていない枠だけを空ける
+		elapsedSlots := (max(now, livestreamModel.StartAt) - livestreamModel.StartAt + 3599) / 3600
+		return releaseReservationSlots(ctx, tx, livestreamModel.StartAt+elapsedSlots*3600, reservedEndAt)
+	})
+}
+
+// 配信中止API
+// POST /api/livestream/:livestream_id/cancel
+func cancelLivestreamHandler(c echo.Context) error {
+	return changeLivestreamState(c, func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64) error {
+		if err := requireLivestreamState(livestreamModel, now, LivestreamStateScheduled); err != nil {
+			return err
+		}
+		if err := transitionLivestream(ctx, tx, livestreamModel, LivestreamStateCancelled, livestreamModel.EndAt); err != nil {
+			return err
+		}
+		return releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt)
+	})
+}
+
+func changeLivestreamState(c echo.Context, change func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64) error) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", currentLivestream(c).ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	if err := change(ctx, tx, &livestreamModel, livestreamClock().Unix()); err != nil {
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
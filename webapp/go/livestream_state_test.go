@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLivestreamStateAt(t *testing.T) {
+	l := LivestreamModel{StartAt: 100, EndAt: 200, State: LivestreamStateScheduled}
+
+	// 時刻から決まる
+	assert.Equal(t, LivestreamStateScheduled, l.StateAt(99))
+	assert.Equal(t, LivestreamStateLive, l.StateAt(100))
+	assert.Equal(t, LivestreamStateLive, l.StateAt(199))
+	assert.Equal(t, LivestreamStateEnded, l.StateAt(200))
+
+	// 開始を早めても終了時刻を過ぎれば終わる
+	l.State = LivestreamStateLive
+	assert.Equal(t, LivestreamStateLive, l.StateAt(50))
+	assert.Equal(t, LivestreamStateEnded, l.StateAt(200))
+
+	// 配信者が終了・中止したらそのまま
+	l.State = LivestreamStateEnded
+	assert.Equal(t, LivestreamStateEnded, l.StateAt(150))
+	l.State = LivestreamStateCancelled
+	assert.Equal(t, LivestreamStateCancelled, l.StateAt(50))
+}
+
+func TestRequireLivestreamState(t *testing.T) {
+	l := LivestreamModel{StartAt: 100, EndAt: 200, State: LivestreamStateScheduled}
+	assert.NoError(t, requireLivestreamState(&l, 150, LivestreamStateLive))
+	assert.Error(t, requireLivestreamState(&l, 250, LivestreamStateLive))
+	assert.NoError(t, requireLivestreamState(&l, 50, LivestreamStateScheduled, LivestreamStateLive))
+}
+
+func TestRequireLivestreamOpenIgnoresClock(t *testing.T) {
+	// 予約期間内 (2024-01-01 10:00-12:00 UTC) の配信。実時刻ではとっくに終わっている
+	startAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).Unix()
+	l := LivestreamModel{StartAt: startAt, EndAt: startAt + 2*3600, State: LivestreamStateScheduled}
+	assert.Equal(t, LivestreamStateEnded, l.StateAt(livestreamClock().Unix()))
+
+	// それでもコメント・リアクション・入室はできる
+	assert.NoError(t, requireLivestreamOpen(&l))
+	l.State = LivestreamStateLive
+	assert.NoError(t, requireLivestreamOpen(&l))
+
+	// 配信者が終了・中止したら書き込めない
+	l.State = LivestreamStateEnded
+	assert.Error(t, requireLivestreamOpen(&l))
+	l.State = LivestreamStateCancelled
+	assert.Error(t, requireLivestreamOpen(&l))
+}
@@ -41,6 +41,15 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	adminUsernames = loadAdminUsernames(os.Getenv(adminUsersEnvKey))
+	tiers, err := loadTipTiers(os.Getenv(tipTiersEnvKey))
+	if err != nil {
+		log.Fatalf("failed to load %s: %v", tipTiersEnvKey, err)
+	}
+	tipPolicy.Tiers = tiers
+	if os.Getenv(tipVelocityHoldEnvKey) == "0" {
+		tipPolicy.VelocityCount = 0
+	}
 }
 
 type InitializeResponse struct {
@@ -128,25 +137,72 @@ func (c *ThemeCache) Get(userID int64) bool {
 	return c.userIDThemeMap[userID]
 }
 
+func (c *ThemeCache) Delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.userIDThemeMap, userID)
+}
+
 var themeCache = &ThemeCache{
 	mu:             new(sync.RWMutex),
 	userIDThemeMap: make(map[int64]bool, 1000),
 }
 
 func initializeHandler(c echo.Context) error {
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
+	// ゾーンは pdnsutil ではなく設定したDNSレコードのバックエンドで初期化する
+	cmd := exec.Command("../sql/init.sh")
+	cmd.Env = append(os.Environ(), skipZoneInitEnvKey+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
+	records, err := loadZoneFileRecords(dnsZoneFilePath, powerDNSSubdomainAddress)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load zone file: "+err.Error())
+	}
+	if err := dnsRecordManager.ResetRecords(c.Request().Context(), records); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset dns records: "+err.Error())
+	}
+	// カスタム絵文字のIDは振り直しになるので画像も消す
+	if err := os.RemoveAll(customEmojiDir); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to remove custom emoji files: "+err.Error())
+	}
 
 	var themes []*ThemeModel
-	err := dbConn.SelectContext(c.Request().Context(), &themes, "SELECT * FROM themes")
+	err = dbConn.SelectContext(c.Request().Context(), &themes, "SELECT * FROM themes")
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 	for _, theme := range themes {
 		themeCache.Set(theme.UserID, theme.DarkMode)
 	}
+	userCache.Reset()
+	viewerPresence.Reset()
+	if err := followCountCache.Load(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load follow counts: "+err.Error())
+	}
+	if err := rebuildStats(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild stats: "+err.Error())
+	}
+	if err := statsRankings.Load(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load stats rankings: "+err.Error())
+	}
+	statsRollupWriter.Reset()
+	if err := rebuildMinutelyStats(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild minutely stats: "+err.Error())
+	}
+	if err := rebuildTipLedger(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild tip ledger: "+err.Error())
+	}
+
+	if embeddedDNSZone != nil {
+		if err := embeddedDNSZone.Reset(c.Request().Context(), dnsZoneFilePath); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset dns zone: "+err.Error())
+		}
+	}
+	if dnsGuard != nil {
+		dnsGuard.Flush()
+	}
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -164,69 +220,145 @@ func main() {
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.u.isucon.dev"
 	e.Use(session.Middleware(cookieStore))
+	e.Use(authenticationMiddleware)
 	// e.Use(middleware.Recover())
 
 	// pprof
 	pprof.Register(e)
+	e.GET("/debug/dnsguard", getDNSGuardMetricsHandler)
 
 	err := os.Mkdir(iconDir, 0755)
 	if err != nil {
 		e.Logger.Errorf("failed to create icons directory: %v", err)
 	}
 
+	// ルートは必要なロールごとにまとめる (認可ルールは authorization.go)
+	requireUser := requireRole(RoleUser)
+	requireLivestreamOwner := requireRole(RoleLivestreamOwner)
+	requireModerator := requireRole(RoleModerator)
+	requireAdmin := requireRole(RoleAdmin)
+
+	// --- 公開API ---
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
-
 	// top
 	e.GET("/api/tag", getTagHandler)
-	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	// list livestream
+	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	// user
+	e.POST("/api/register", registerHandler)
+	e.POST("/api/login", loginHandler)
+	e.POST("/api/login/2fa", twoFactorLoginHandler)
+	e.GET("/api/user/:username/icon", getIconHandler)
+	e.GET("/api/user/:username/emoji/:emoji_id", getCustomEmojiImageHandler)
+	// カレンダーアプリやフィードリーダーはログインできないので公開する
+	e.GET("/api/user/:username/livestream.ics", getUserLivestreamsICalendarHandler)
+	e.GET("/api/user/:username/livestream.atom", getUserLivestreamsAtomHandler)
+	// 課金情報
+	// 内訳はログイン中なら自分のぶん、運営なら全員ぶんが見える
+	e.GET("/api/payment", GetPaymentResult)
+
+	// --- ログインユーザ向けAPI ---
+	// top
+	e.GET("/api/user/:username/theme", getStreamerThemeHandler, requireUser)
 
 	// livestream
 	// reserve livestream
-	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.POST("/api/livestream/reservation", reserveLivestreamHandler, requireUser, requireIdempotency)
 	// list livestream
-	e.GET("/api/livestream/search", searchLivestreamsHandler)
-	e.GET("/api/livestream", getMyLivestreamsHandler)
-	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	e.GET("/api/livestream", getMyLivestreamsHandler, requireUser)
+	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler, requireUser)
 	// get livestream
-	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.GET("/api/livestream/:livestream_id", getLivestreamHandler, requireUser)
 	// get polling livecomment timeline
-	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler, requireUser)
 	// ライブコメント投稿
-	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
-	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
-	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
-
-	// (配信者向け)ライブコメントの報告一覧取得API
-	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
-	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
+	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler, requireUser, requireIdempotency)
+	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler, requireUser)
+	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler, requireUser)
+	e.GET("/api/livestream/:livestream_id/reaction/summary", getReactionSummaryHandler, requireUser)
 	// ライブコメント報告
-	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
-	// 配信者によるモデレーション (NGワード登録)
-	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler, requireUser)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
-	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler, requireUser)
 	// ユーザ視聴終了 (viewer)
-	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler, requireUser)
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler, requireUser)
+	e.GET("/api/livestream/:livestream_id/viewers", getLivestreamViewersHandler, requireUser)
 
 	// user
-	e.POST("/api/register", registerHandler)
-	e.POST("/api/login", loginHandler)
-	e.GET("/api/user/me", getMeHandler)
+	e.GET("/api/user/me", getMeHandler, requireUser)
+	e.DELETE("/api/user/me", deleteMeHandler, requireUser)
+	e.POST("/api/user/me/export", postExportHandler, requireUser)
+	e.GET("/api/user/me/export/:export_id", getExportHandler, requireUser)
+	e.GET("/api/user/me/export/:export_id/download", downloadExportHandler, requireUser)
+	e.POST("/api/user/me/tokens", postPersonalAccessTokenHandler, requireUser)
+	e.GET("/api/user/me/tokens", getPersonalAccessTokensHandler, requireUser)
+	e.DELETE("/api/user/me/tokens/:token_id", deletePersonalAccessTokenHandler, requireUser)
+	e.POST("/api/user/me/2fa/enroll", enrollTwoFactorHandler, requireUser)
+	e.POST("/api/user/me/2fa/verify", verifyTwoFactorHandler, requireUser)
+	e.GET("/api/user/me/history", getWatchHistoryHandler, requireUser)
+	e.DELETE("/api/user/me/history", deleteWatchHistoryHandler, requireUser)
+	e.PUT("/api/user/me/history/settings", putWatchHistorySettingsHandler, requireUser)
+	e.POST("/api/user/me/webhooks", postWebhookSubscriptionHandler, requireUser)
+	e.GET("/api/user/me/webhooks", getWebhookSubscriptionsHandler, requireUser)
+	e.DELETE("/api/user/me/webhooks/:webhook_id", deleteWebhookSubscriptionHandler, requireUser)
+	e.GET("/api/user/me/webhooks/:webhook_id/deliveries", getWebhookDeliveriesHandler, requireUser)
+	e.POST("/api/user/me/webhooks/:webhook_id/test", testWebhookSubscriptionHandler, requireUser)
+	e.POST("/api/user/me/emoji", postCustomEmojiHandler, requireUser)
+	e.DELETE("/api/user/me/emoji/:emoji_id", deleteCustomEmojiHandler, requireUser)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
-	e.GET("/api/user/:username", getUserHandler)
-	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
-	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/user/:username", getUserHandler, requireUser)
+	e.GET("/api/user/:username/statistics", getUserStatisticsHandler, requireUser)
+	e.GET("/api/user/:username/emoji", getCustomEmojisHandler, requireUser)
+	// follow
+	e.POST("/api/user/:username/follow", followHandler, requireUser)
+	e.DELETE("/api/user/:username/follow", unfollowHandler, requireUser)
+	e.GET("/api/user/:username/followers", getFollowersHandler, requireUser)
+	e.GET("/api/user/:username/following", getFollowingHandler, requireUser)
+	e.GET("/api/feed", getFeedHandler, requireUser)
+	// notification
+	e.GET("/api/notifications", getNotificationsHandler, requireUser)
+	e.POST("/api/notifications/read", readNotificationsHandler, requireUser)
+	e.GET("/api/notifications/unread_count", getUnreadNotificationCountHandler, requireUser)
+	e.POST("/api/icon", postIconHandler, requireUser)
 
 	// stats
 	// ライブ配信統計情報
-	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
-
-	// 課金情報
-	e.GET("/api/payment", GetPaymentResult)
+	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler, requireUser)
+	e.GET("/api/livestream/:livestream_id/highlights", getLivestreamHighlightsHandler, requireUser)
+	e.GET("/api/livestream/:livestream_id/top_tippers", getTopTippersHandler, requireUser)
+	e.GET("/api/livestream/:livestream_id/tip_goal", getTipGoalHandler, requireUser)
+	// ランキング
+	e.GET("/api/ranking/users", getUserRankingHandler)
+	e.GET("/api/ranking/livestreams", getLivestreamRankingHandler)
+
+	// --- 配信者向けAPI ---
+	// ライブコメントの報告一覧取得API
+	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler, requireLivestreamOwner)
+	e.GET("/api/livestream/:livestream_id/statistics/timeseries", getLivestreamTimeseriesHandler, requireLivestreamOwner)
+	e.PUT("/api/livestream/:livestream_id/tip_goal", putTipGoalHandler, requireLivestreamOwner)
+	// 配信の開始・早期終了・中止
+	e.POST("/api/livestream/:livestream_id/live", goLiveLivestreamHandler, requireLivestreamOwner)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler, requireLivestreamOwner)
+	e.POST("/api/livestream/:livestream_id/cancel", cancelLivestreamHandler, requireLivestreamOwner)
+
+	// --- モデレータ向けAPI ---
+	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords, requireModerator)
+	// 配信者によるモデレーション (NGワード登録)
+	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler, requireModerator)
+	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/restore", restoreLivecommentHandler, requireModerator)
+
+	// --- 運営向けAPI ---
+	// 配信者へのチップの支払い
+	e.POST("/api/admin/payouts", postPayoutsHandler, requireAdmin)
+	e.GET("/api/admin/tip_ledger/reconcile", getTipLedgerReconciliationHandler, requireAdmin)
+	// 不正の疑いで保留したチップの審査
+	e.GET("/api/admin/held_tips", getHeldTipsHandler, requireAdmin)
+	e.POST("/api/admin/held_tips/:held_tip_id/approve", approveHeldTipHandler, requireAdmin)
+	e.POST("/api/admin/held_tips/:held_tip_id/reject", rejectHeldTipHandler, requireAdmin)
 
 	e.HTTPErrorHandler = errorResponseHandler
 
@@ -246,6 +378,49 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	manager, err := newDNSRecordManager()
+	if err != nil {
+		e.Logger.Errorf("failed to set up dns record manager: %v", err)
+		os.Exit(1)
+	}
+	dnsRecordManager = manager
+
+	// 組み込みDNSサーバ (任意)
+	if err := setupDNSServers(e.Logger); err != nil {
+		e.Logger.Errorf("failed to set up dns servers: %v", err)
+		os.Exit(1)
+	}
+
+	if err := followCountCache.Load(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load follow counts: %v", err)
+	}
+	if err := statsRankings.Load(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load stats rankings: %v", err)
+	}
+
+	// 中断していたエクスポートの再開
+	if err := resumeExportJobs(context.Background(), e.Logger); err != nil {
+		e.Logger.Errorf("failed to resume export jobs: %v", err)
+	}
+
+	// 退会したユーザの後始末
+	go userDeletionSweeper.Run(context.Background(), e.Logger)
+
+	// 開始間近の配信の通知
+	go startingSoonNotifier.Run(context.Background(), e.Logger)
+
+	// Webhookの配送
+	go webhookDispatcher.Run(context.Background(), e.Logger)
+
+	// 視聴をやめたユーザの掃除
+	go viewerPresence.Run(context.Background(), e.Logger)
+
+	// 1分ごとの集計の書き込み
+	go statsRollupWriter.Run(context.Background(), e.Logger)
+
+	// 保持期間を過ぎた Idempotency-Key の掃除
+	go idempotencyKeySweeper.Run(context.Background(), e.Logger)
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
 	if err := e.Start(listenAddr); err != nil {
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	notificationTypeLivestreamReserved = "livestream_reserved"
+	notificationTypeLivestreamStarting = "livestream_starting"
+	notificationTypeTipReceived        = "tip_received"
+	notificationTypeLivecommentHidden  = "livecomment_hidden"
+
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 100
+
+	// 配信開始のこの時間前に通知する
+	livestreamStartingSoonWindow = 15 * time.Minute
+	startingSoonNotifyInterval   = 30 * time.Second
+)
+
+type NotificationModel struct {
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	Type          string `db:"type"`
+	ActorID       int64  `db:"actor_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	Amount        int64  `db:"amount"`
+	IsRead        bool   `db:"is_read"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type Notification struct {
+	ID            int64  `json:"id"`
+	Type          string `json:"type"`
+	ActorID       int64  `json:"actor_id,omitempty"`
+	LivestreamID  int64  `json:"livestream_id,omitempty"`
+	LivecommentID int64  `json:"livecomment_id,omitempty"`
+	Amount        int64  `json:"amount,omitempty"`
+	IsRead        bool   `json:"is_read"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+type ReadNotificationsRequest struct {
+	NotificationIDs []int64 `json:"notification_ids"`
+	// All がtrueなら未読をすべて既読にする
+	All bool `json:"all"`
+}
+
+type UnreadNotificationCount struct {
+	Count int64 `json:"count"`
+}
+
+func fillNotificationResponse(notificationModel NotificationModel) Notification {
+	return Notification{
+		ID:            notificationModel.ID,
+		Type:          notificationModel.Type,
+		ActorID:       notificationModel.ActorID,
+		LivestreamID:  notificationModel.LivestreamID,
+		LivecommentID: notificationModel.LivecommentID,
+		Amount:        notificationModel.Amount,
+		IsRead:        notificationModel.IsRead,
+		CreatedAt:     notificationModel.CreatedAt,
+	}
+}
+
+// insertNotifications は通知をまとめてINSERTする
+func insertNotifications(ctx context.Context, tx sqlx.ExecerContext, notificationModels []NotificationModel) error {
+	if len(notificationModels) == 0 {
+		return nil
+	}
+	query := "INSERT INTO notifications (user_id, type, actor_id, livestream_id, livecomment_id, amount, created_at) VALUES "
+	args := make([]any, 0, len(notificationModels)*7)
+	for i, n := range notificationModels {
+		if i != 0 {
+			query += ", "
+		}
+		query += "(?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, n.UserID, n.Type, n.ActorID, n.LivestreamID, n.LivecommentID, n.Amount, n.CreatedAt)
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to insert notifications: %w", err)
+	}
+	return nil
+}
+
+// notifyFollowers は配信者のフォロワー全員に配信の通知を送る
+func notifyFollowers(ctx context.Context, tx sqlx.ExecerContext, notificationType string, livestreamModel LivestreamModel, now int64) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO notifications (user_id, type, actor_id, livestream_id, created_at) SELECT follower_id, ?, ?, ?, ? FROM follows WHERE followee_id = ?", notificationType, livestreamModel.UserID, livestreamModel.ID, now, livestreamModel.UserID); err != nil {
+		return fmt.Errorf("failed to notify followers: %w", err)
+	}
+	return nil
+}
+
+// notifyHiddenLivecomments はモデレーションで非表示になったコメントの投稿者に通知する
+func notifyHiddenLivecomments(ctx context.Context, tx sqlx.ExecerContext, moderatorID int64, livecommentModels []*LivecommentModel, now int64) error {
+	notificationModels := make([]NotificationModel, 0, len(livecommentModels))
+	for _, livecommentModel := range livecommentModels {
+		notificationModels = append(notificationModels, NotificationModel{
+			UserID:        livecommentModel.UserID,
+			Type:          notificationTypeLivecommentHidden,
+			ActorID:       moderatorID,
+			LivestreamID:  livecommentModel.LivestreamID,
+			LivecommentID: livecommentModel.ID,
+			CreatedAt:     now,
+		})
+	}
+	return insertNotifications(ctx, tx, notificationModels)
+}
+
+// 通知一覧API
+// GET /api/notifications
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	query := "SELECT * FROM notifications WHERE user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("unread") == "true" {
+		query += " AND is_read = FALSE"
+	}
+	if c.QueryParam("before_id") != "" {
+		beforeID, err := strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	limit := defaultNotificationLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxNotificationLimit)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	var notificationModels []NotificationModel
+	if err := dbConn.SelectContext(ctx, &notificationModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i := range notificationModels {
+		notifications[i] = fillNotificationResponse(notificationModels[i])
+	}
+	return c.JSON(http.StatusOK, notifications)
+}
+
+// 通知の既読API
+// POST /api/notifications/read
+func readNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := currentUser(c).ID
+
+	var req *ReadNotificationsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if req.All {
+		if _, err := dbConn.ExecContext(ctx, "UPDATE notifications SET is_read = TRUE WHERE user_id = ? AND is_read = FALSE", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if len(req.NotificationIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "notification_ids or all is required")
+	}
+	query, args, err := sqlx.In("UPDATE notifications SET is_read = TRUE WHERE user_id = ? AND id IN (?)", userID, req.NotificationIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	if _, err := dbConn.ExecContext(ctx, dbConn.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 未読通知数API
+// GET /api/notifications/unread_count
+func getUnreadNotificationCountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	var count int64
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = FALSE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count notifications: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, UnreadNotificationCount{Count: count})
+}
+
+// StartingSoonNotifier は開始間近の配信をフォロワーに通知する
+type StartingSoonNotifier struct {
+	window time.Duration
+}
+
+var startingSoonNotifier = &StartingSoonNotifier{
+	window: livestreamStartingSoonWindow,
+}
+
+func (n *StartingSoonNotifier) Run(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(startingSoonNotifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := n.notify(ctx, time.Now()); err != nil {
+			logger.Warnf("failed to notify starting livestreams: %v", err)
+		}
+	}
+}
+
+func (n *StartingSoonNotifier) notify(ctx context.Context, now time.Time) error {
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE state = ? AND start_at > ? AND start_at <= ?", LivestreamStateScheduled, now.Unix(), now.Add(n.window).Unix()); err != nil {
+		return fmt.Errorf("failed to get livestreams: %w", err)
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		if err := n.notifyLivestream(ctx, livestreamModel, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyLivestream は配信ごとに一度だけ通知する
+func (n *StartingSoonNotifier) notifyLivestream(ctx context.Context, livestreamModel LivestreamModel, now time.Time) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livestream_start_notifications (livestream_id, created_at) VALUES (?, ?)", livestreamModel.ID, now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to insert livestream start notification: %w", err)
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected == 0 {
+		return nil
+	}
+
+	if err := notifyFollowers(ctx, tx, notificationTypeLivestreamStarting, livestreamModel, now.Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
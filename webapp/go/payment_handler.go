@@ -1,30 +1,318 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	paymentPeriodDay   = "day"
+	paymentPeriodWeek  = "week"
+	paymentPeriodMonth = "month"
+	paymentPeriodAll   = "all"
+
+	// 照合で返す不一致の件数の上限
+	maxReconciliationMismatches = 100
+)
+
 type PaymentResult struct {
+	// TotalTip は受け取ったチップの総額 (返金前)
 	TotalTip int64 `json:"total_tip"`
+	// Refunded は返金額から取り消しぶんを引いたもの
+	Refunded int64 `json:"refunded"`
+	NetTip   int64 `json:"net_tip"`
+	PaidOut  int64 `json:"paid_out"`
+	// Breakdown は配信者・期間ごとの内訳
+	// 運営は全員ぶん、ログイン中の配信者は自分のぶんだけ見える
+	Breakdown []PaymentBreakdown `json:"breakdown"`
+}
+
+type PaymentBreakdown struct {
+	// Streamer は退会済みなら空
+	Streamer    string `json:"streamer"`
+	PeriodStart int64  `json:"period_start"`
+	TotalTip    int64  `json:"total_tip"`
+	Refunded    int64  `json:"refunded"`
+	NetTip      int64  `json:"net_tip"`
+	PaidOut     int64  `json:"paid_out"`
+	// Balance は期間内の増減 (NetTip - PaidOut)
+	Balance int64 `json:"balance"`
+}
+
+type PostPayoutRequest struct {
+	// Username を省略すると残高のある全配信者に支払う
+	Username string `json:"username"`
+}
+
+type Payout struct {
+	Streamer string `json:"streamer"`
+	Amount   int64  `json:"amount"`
 }
 
+type TipReconciliationMismatch struct {
+	// Kind は livecomment (コメントと台帳が合わない) か livestream_stats (集計と台帳が合わない)
+	Kind          string `db:"kind" json:"kind"`
+	LivestreamID  int64  `db:"livestream_id" json:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id" json:"livecomment_id,omitempty"`
+	Expected      int64  `db:"expected" json:"expected"`
+	Ledger        int64  `db:"ledger" json:"ledger"`
+}
+
+type TipReconciliation struct {
+	OK bool `json:"ok"`
+	// Checked は照合したチップつきコメントの件数
+	Checked int64 `json:"checked"`
+	// OrphanedEntries はコメントが消えたのに返金されていない台帳の行数 (不一致には数えない)
+	OrphanedEntries int64                       `json:"orphaned_entries"`
+	Mismatches      []TipReconciliationMismatch `json:"mismatches"`
+}
+
+// paymentPeriodStart は day (日の開始時刻) を含む期間の開始時刻を返す
+func paymentPeriodStart(period string, day int64) int64 {
+	t := time.Unix(day, 0).UTC()
+	switch period {
+	case paymentPeriodWeek:
+		return rankingWindowStart(rankingWindowWeekly, t)
+	case paymentPeriodMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+	case paymentPeriodAll:
+		return 0
+	}
+	return day
+}
+
+func addPaymentAmount(b *PaymentBreakdown, kind string, amount int64) {
+	switch kind {
+	case tipLedgerKindTip:
+		b.TotalTip += amount
+	case tipLedgerKindRefund, tipLedgerKindReversal:
+		b.Refunded -= amount
+	case tipLedgerKindPayout:
+		b.PaidOut -= amount
+	}
+	b.NetTip = b.TotalTip - b.Refunded
+	b.Balance = b.NetTip - b.PaidOut
+}
+
+// 課金情報API
+// GET /api/payment
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
+	period := paymentPeriodDay
+	if c.QueryParam("period") != "" {
+		period = c.QueryParam("period")
+		switch period {
+		case paymentPeriodDay, paymentPeriodWeek, paymentPeriodMonth, paymentPeriodAll:
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown period: "+period)
+		}
+	}
+	var since, until int64 = 0, 1<<63 - 1
+	for name, dst := range map[string]*int64{"since": &since, "until": &until} {
+		if v := c.QueryParam(name); v != "" {
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be integer")
+			}
+			*dst = t
+		}
+	}
+
 	tx, err := dbConn.Connx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
 	}
 	defer tx.Close()
 
-	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+	// 合計は誰でも見られる
+	var totals []struct {
+		Kind   string `db:"kind"`
+		Amount int64  `db:"amount"`
+	}
+	if err := tx.SelectContext(ctx, &totals, "SELECT kind, IFNULL(SUM(amount), 0) AS amount FROM tip_ledger WHERE created_at >= ? AND created_at < ? GROUP BY kind", since, until); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
 	}
+	var total PaymentBreakdown
+	for _, row := range totals {
+		addPaymentAmount(&total, row.Kind, row.Amount)
+	}
+	res := PaymentResult{
+		TotalTip:  total.TotalTip,
+		Refunded:  total.Refunded,
+		NetTip:    total.NetTip,
+		PaidOut:   total.PaidOut,
+		Breakdown: []PaymentBreakdown{},
+	}
 
-	return c.JSON(http.StatusOK, &PaymentResult{
-		TotalTip: totalTip,
+	// 内訳は運営なら全員 (streamer で絞り込める)、配信者なら自分だけ
+	principal, _ := c.Get(principalContextKey).(*Principal)
+	if principal == nil {
+		return c.JSON(http.StatusOK, res)
+	}
+	query := `SELECT IFNULL(u.name, '') AS streamer, t.day, t.kind, t.amount FROM (
+		SELECT streamer_id, created_at - created_at % 86400 AS day, kind, SUM(amount) AS amount
+		FROM tip_ledger WHERE created_at >= ? AND created_at < ?`
+	args := []interface{}{since, until}
+	if !principal.Admin {
+		query += " AND streamer_id = ?"
+		args = append(args, principal.UserID)
+	} else if c.QueryParam("streamer") != "" {
+		query += " AND streamer_id = (SELECT id FROM users WHERE name = ?)"
+		args = append(args, c.QueryParam("streamer"))
+	}
+	query += ` GROUP BY streamer_id, day, kind
+	) t LEFT JOIN users u ON u.id = t.streamer_id`
+
+	var rows []struct {
+		Streamer string `db:"streamer"`
+		Day      int64  `db:"day"`
+		Kind     string `db:"kind"`
+		Amount   int64  `db:"amount"`
+	}
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payment breakdown: "+err.Error())
+	}
+
+	type breakdownKey struct {
+		streamer    string
+		periodStart int64
+	}
+	breakdowns := make(map[breakdownKey]*PaymentBreakdown)
+	for _, row := range rows {
+		key := breakdownKey{streamer: row.Streamer, periodStart: paymentPeriodStart(period, row.Day)}
+		b, ok := breakdowns[key]
+		if !ok {
+			b = &PaymentBreakdown{Streamer: key.streamer, PeriodStart: key.periodStart}
+			breakdowns[key] = b
+		}
+		addPaymentAmount(b, row.Kind, row.Amount)
+	}
+	for _, b := range breakdowns {
+		res.Breakdown = append(res.Breakdown, *b)
+	}
+	sort.Slice(res.Breakdown, func(i, j int) bool {
+		if res.Breakdown[i].PeriodStart != res.Breakdown[j].PeriodStart {
+			return res.Breakdown[i].PeriodStart < res.Breakdown[j].PeriodStart
+		}
+		return res.Breakdown[i].Streamer < res.Breakdown[j].Streamer
 	})
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 配信者への支払いAPI
+// POST /api/admin/payouts
+func postPayoutsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	req := PostPayoutRequest{}
+	if c.Request().ContentLength != 0 {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 同時に支払って二重払いにならないよう、対象の台帳の行をロックして残高を求める
+	query := `SELECT u.id, u.name, SUM(t.amount) AS balance FROM tip_ledger t INNER JOIN users u ON u.id = t.streamer_id`
+	args := []interface{}{}
+	if req.Username != "" {
+		query += " WHERE u.name = ?"
+		args = append(args, req.Username)
+	}
+	query += " GROUP BY u.id, u.name HAVING balance > 0 FOR UPDATE"
+	var balances []struct {
+		UserID  int64  `db:"id"`
+		Name    string `db:"name"`
+		Balance int64  `db:"balance"`
+	}
+	if err := tx.SelectContext(ctx, &balances, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get balances: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	payouts := make([]Payout, 0, len(balances))
+	entries := make([]TipLedgerEntryModel, 0, len(balances))
+	for _, balance := range balances {
+		entries = append(entries, TipLedgerEntryModel{
+			Kind:       tipLedgerKindPayout,
+			StreamerID: balance.UserID,
+			Amount:     -balance.Balance,
+			CreatedAt:  now,
+		})
+		payouts = append(payouts, Payout{Streamer: balance.Name, Amount: balance.Balance})
+	}
+	if err := appendTipLedger(ctx, tx, entries); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, payouts)
+}
+
+// チップ台帳の照合API
+// GET /api/admin/tip_ledger/reconcile
+func getTipLedgerReconciliationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	res := TipReconciliation{Mismatches: []TipReconciliationMismatch{}}
+	if err := tx.GetContext(ctx, &res.Checked, "SELECT COUNT(*) FROM livecomments WHERE tip > 0"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error())
+	}
+	// 退会で消えたコメントはチップと返金で打ち消し合っているので数えない
+	if err := tx.GetContext(ctx, &res.OrphanedEntries, `SELECT COUNT(*) FROM tip_ledger t INNER JOIN (
+		SELECT livecomment_id FROM tip_ledger WHERE kind <> ? GROUP BY livecomment_id HAVING SUM(amount) <> 0
+	) o ON o.livecomment_id = t.livecomment_id
+	WHERE t.kind <> ? AND NOT EXISTS (SELECT 1 FROM livecomments lc WHERE lc.id = t.livecomment_id)`, tipLedgerKindPayout, tipLedgerKindPayout); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count orphaned entries: "+err.Error())
+	}
+
+	// 表示中のコメントはチップ額、非表示のコメントは0が台帳に残っているはず
+	var livecommentMismatches []TipReconciliationMismatch
+	if err := tx.SelectContext(ctx, &livecommentMismatches, `SELECT 'livecomment' AS kind, lc.livestream_id, lc.id AS livecomment_id,
+		IF(lc.is_deleted = 0, lc.tip, 0) AS expected, IFNULL(t.amount, 0) AS ledger
+	FROM livecomments lc LEFT JOIN (
+		SELECT livecomment_id, SUM(amount) AS amount FROM tip_ledger WHERE kind <> ? GROUP BY livecomment_id
+	) t ON t.livecomment_id = lc.id
+	WHERE lc.tip > 0 AND IFNULL(t.amount, 0) <> IF(lc.is_deleted = 0, lc.tip, 0)
+	ORDER BY lc.id LIMIT ?`, tipLedgerKindPayout, maxReconciliationMismatches); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile livecomments: "+err.Error())
+	}
+	res.Mismatches = append(res.Mismatches, livecommentMismatches...)
+
+	// 統計APIの集計とも合っているか
+	var statsMismatches []TipReconciliationMismatch
+	if err := tx.SelectContext(ctx, &statsMismatches, `SELECT 'livestream_stats' AS kind, s.livestream_id, s.total_tip AS expected, IFNULL(t.amount, 0) AS ledger
+	FROM livestream_stats s LEFT JOIN (
+		SELECT livestream_id, SUM(amount) AS amount FROM tip_ledger WHERE kind <> ? GROUP BY livestream_id
+	) t ON t.livestream_id = s.livestream_id
+	WHERE s.total_tip <> IFNULL(t.amount, 0)
+	ORDER BY s.livestream_id LIMIT ?`, tipLedgerKindPayout, maxReconciliationMismatches); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile livestream stats: "+err.Error())
+	}
+	res.Mismatches = append(res.Mismatches, statsMismatches...)
+
+	res.OK = len(res.Mismatches) == 0
+	return c.JSON(http.StatusOK, res)
 }
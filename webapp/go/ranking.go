@@ -0,0 +1,280 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	rankingMaxLevel = 32
+	rankingP        = 0.25
+)
+
+// RankingEntry はランキングの1件
+type RankingEntry[K comparable] struct {
+	Key   K
+	Score int64
+	// Rank は1始まりの順位 (スコアが大きいほど上位)
+	Rank int64
+}
+
+type rankingLevel[K comparable] struct {
+	next *rankingNode[K]
+	// span は next までに飛ばすノード数
+	span int64
+}
+
+type rankingNode[K comparable] struct {
+	key    K
+	score  int64
+	prev   *rankingNode[K]
+	levels []rankingLevel[K]
+}
+
+// Ranking はスコア順のスキップリスト
+// 順位の取得・更新・範囲取得がO(log n)でできる
+//
+// スコアの昇順、同点なら less の昇順に並べ、末尾を1位とする。
+// これは sort.Sort した結果を後ろから数える UserRanking/LivestreamRanking と同じ順位になる
+type Ranking[K comparable] struct {
+	mu     *sync.RWMutex
+	less   func(a, b K) bool
+	head   *rankingNode[K]
+	tail   *rankingNode[K]
+	level  int
+	length int64
+	scores map[K]int64
+	rnd    *rand.Rand
+}
+
+func NewRanking[K comparable](less func(a, b K) bool) *Ranking[K] {
+	r := &Ranking[K]{
+		mu:   new(sync.RWMutex),
+		less: less,
+		rnd:  rand.New(rand.NewSource(1)),
+	}
+	r.reset()
+	return r
+}
+
+func (r *Ranking[K]) reset() {
+	r.head = &rankingNode[K]{levels: make([]rankingLevel[K], rankingMaxLevel)}
+	r.tail = nil
+	r.level = 1
+	r.length = 0
+	r.scores = make(map[K]int64)
+}
+
+func (r *Ranking[K]) randomLevel() int {
+	level := 1
+	for level < rankingMaxLevel && r.rnd.Float64() < rankingP {
+		level++
+	}
+	return level
+}
+
+// before は (score, key) が node より前に並ぶか
+func (r *Ranking[K]) before(node *rankingNode[K], score int64, key K) bool {
+	if node.score != score {
+		return node.score < score
+	}
+	return r.less(node.key, key)
+}
+
+func (r *Ranking[K]) insert(key K, score int64) {
+	var update [rankingMaxLevel]*rankingNode[K]
+	var rank [rankingMaxLevel]int64
+
+	x := r.head
+	for i := r.level - 1; i >= 0; i-- {
+		if i != r.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].next != nil && r.before(x.levels[i].next, score, key) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].next
+		}
+		update[i] = x
+	}
+
+	level := r.randomLevel()
+	if level > r.level {
+		for i := r.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = r.head
+			update[i].levels[i].span = r.length
+		}
+		r.level = level
+	}
+
+	x = &rankingNode[K]{key: key, score: score, levels: make([]rankingLevel[K], level)}
+	for i := 0; i < level; i++ {
+		x.levels[i].next = update[i].levels[i].next
+		update[i].levels[i].next = x
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < r.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != r.head {
+		x.prev = update[0]
+	}
+	if x.levels[0].next != nil {
+		x.levels[0].next.prev = x
+	} else {
+		r.tail = x
+	}
+	r.length++
+	r.scores[key] = score
+}
+
+func (r *Ranking[K]) remove(key K, score int64) {
+	var update [rankingMaxLevel]*rankingNode[K]
+
+	x := r.head
+	for i := r.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && r.before(x.levels[i].next, score, key) {
+			x = x.levels[i].next
+		}
+		update[i] = x
+	}
+	x = x.levels[0].next
+	if x == nil || x.key != key {
+		return
+	}
+
+	for i := 0; i < r.level; i++ {
+		if update[i].levels[i].next == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].next = x.levels[i].next
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if x.levels[0].next != nil {
+		x.levels[0].next.prev = x.prev
+	} else {
+		r.tail = x.prev
+	}
+	for r.level > 1 && r.head.levels[r.level-1].next == nil {
+		r.level--
+	}
+	r.length--
+	delete(r.scores, key)
+}
+
+// nodeAt は昇順で rank 番目 (1始まり) のノードを返す
+func (r *Ranking[K]) nodeAt(rank int64) *rankingNode[K] {
+	var traversed int64
+	x := r.head
+	for i := r.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && traversed+x.levels[i].span <= rank {
+			traversed += x.levels[i].span
+			x = x.levels[i].next
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// Set はスコアを設定する。なければ追加する
+func (r *Ranking[K]) Set(key K, score int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.scores[key]; ok {
+		if old == score {
+			return
+		}
+		r.remove(key, old)
+	}
+	r.insert(key, score)
+}
+
+// Add はスコアに delta を足す。なければ delta で追加する
+func (r *Ranking[K]) Add(key K, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.scores[key]
+	if ok {
+		if delta == 0 {
+			return
+		}
+		r.remove(key, old)
+	}
+	r.insert(key, old+delta)
+}
+
+func (r *Ranking[K]) Delete(key K) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.scores[key]; ok {
+		r.remove(key, old)
+	}
+}
+
+// Replace は全件を入れ替える
+func (r *Ranking[K]) Replace(scores map[K]int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	for key, score := range scores {
+		r.insert(key, score)
+	}
+}
+
+func (r *Ranking[K]) Len() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.length
+}
+
+func (r *Ranking[K]) Score(key K) (int64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	score, ok := r.scores[key]
+	return score, ok
+}
+
+// Rank は1始まりの順位を返す
+func (r *Ranking[K]) Rank(key K) (int64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	score, ok := r.scores[key]
+	if !ok {
+		return 0, false
+	}
+	var ascRank int64
+	x := r.head
+	for i := r.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && (r.before(x.levels[i].next, score, key) || x.levels[i].next.key == key) {
+			ascRank += x.levels[i].span
+			x = x.levels[i].next
+		}
+		if x != r.head && x.key == key {
+			return r.length - ascRank + 1, true
+		}
+	}
+	return 0, false
+}
+
+// Top は上位から offset 件飛ばして limit 件を返す
+func (r *Ranking[K]) Top(offset, limit int64) []RankingEntry[K] {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if offset < 0 || offset >= r.length || limit <= 0 {
+		return []RankingEntry[K]{}
+	}
+	entries := make([]RankingEntry[K], 0, min(limit, r.length-offset))
+	rank := offset + 1
+	for x := r.nodeAt(r.length - offset); x != nil && int64(len(entries)) < limit; x = x.prev {
+		entries = append(entries, RankingEntry[K]{Key: x.key, Score: x.score, Rank: rank})
+		rank++
+	}
+	return entries
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRankingLimit = 20
+	maxRankingLimit     = 100
+)
+
+type UserRankingItem struct {
+	Rank  int64 `json:"rank"`
+	Score int64 `json:"score"`
+	User  User  `json:"user"`
+}
+
+type LivestreamRankingItem struct {
+	Rank       int64      `json:"rank"`
+	Score      int64      `json:"score"`
+	Livestream Livestream `json:"livestream"`
+}
+
+type UserRankingResponse struct {
+	Window string `json:"window"`
+	// Total はランキングに載っている件数
+	Total   int64             `json:"total"`
+	Ranking []UserRankingItem `json:"ranking"`
+}
+
+type LivestreamRankingResponse struct {
+	Window  string                  `json:"window"`
+	Total   int64                   `json:"total"`
+	Ranking []LivestreamRankingItem `json:"ranking"`
+}
+
+type rankingQuery struct {
+	window string
+	limit  int64
+	offset int64
+	board  *rankingBoard
+}
+
+// parseRankingQuery は window, tag, limit, offset を読んで対象のランキングを返す
+// 該当するランキングがなければ board は nil
+func parseRankingQuery(c echo.Context, tx SqlxConn) (rankingQuery, error) {
+	ctx := c.Request().Context()
+	q := rankingQuery{
+		window: rankingWindowAll,
+		limit:  defaultRankingLimit,
+	}
+
+	if window := c.QueryParam("window"); window != "" {
+		if !isRankingWindow(window) {
+			return q, echo.NewHTTPError(http.StatusBadRequest, "unknown window: "+window)
+		}
+		q.window = window
+	}
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		q.limit = int64(min(limit, maxRankingLimit))
+	}
+	if c.QueryParam("offset") != "" {
+		offset, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || offset < 0 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+		q.offset = int64(offset)
+	}
+
+	var tagID int64
+	if tagName := c.QueryParam("tag"); tagName != "" {
+		if err := tx.GetContext(ctx, &tagID, "SELECT id FROM tags WHERE name = ?", tagName); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				// 検索APIと同じく、知らないタグなら空で返す
+				return q, nil
+			}
+			return q, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+	}
+
+	q.board = statsRankings.Board(q.window, tagID, time.Now())
+	return q, nil
+}
+
+// ユーザランキングAPI
+// GET /api/ranking/users
+func getUserRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	q, err := parseRankingQuery(c, tx)
+	if err != nil {
+		return err
+	}
+
+	res := UserRankingResponse{Window: q.window, Ranking: []UserRankingItem{}}
+	if q.board == nil {
+		return c.JSON(http.StatusOK, res)
+	}
+	res.Total = q.board.users.Len()
+	entries := q.board.users.Top(q.offset, q.limit)
+	if len(entries) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Key
+	}
+	query, args, err := sqlx.In("SELECT * FROM users WHERE name IN (?)", names)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	users, err := fillUserResponses(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+	userMap := make(map[string]User, len(users))
+	for _, user := range users {
+		userMap[user.Name] = user
+	}
+
+	for _, entry := range entries {
+		// 退会直後でまだランキングに残っているユーザは飛ばす
+		user, ok := userMap[entry.Key]
+		if !ok {
+			continue
+		}
+		res.Ranking = append(res.Ranking, UserRankingItem{
+			Rank:  entry.Rank,
+			Score: entry.Score,
+			User:  user,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 配信ランキングAPI
+// GET /api/ranking/livestreams
+func getLivestreamRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	q, err := parseRankingQuery(c, tx)
+	if err != nil {
+		return err
+	}
+
+	res := LivestreamRankingResponse{Window: q.window, Ranking: []LivestreamRankingItem{}}
+	if q.board == nil {
+		return c.JSON(http.StatusOK, res)
+	}
+	res.Total = q.board.livestreams.Len()
+	entries := q.board.livestreams.Top(q.offset, q.limit)
+	if len(entries) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	livestreamIDs := make([]int64, len(entries))
+	for i, entry := range entries {
+		livestreamIDs[i] = entry.Key
+	}
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+	livestreamMap := make(map[int64]Livestream, len(livestreams))
+	for _, livestream := range livestreams {
+		livestreamMap[livestream.ID] = livestream
+	}
+
+	for _, entry := range entries {
+		livestream, ok := livestreamMap[entry.Key]
+		if !ok {
+			continue
+		}
+		res.Ranking = append(res.Ranking, LivestreamRankingItem{
+			Rank:       entry.Rank,
+			Score:      entry.Score,
+			Livestream: livestream,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
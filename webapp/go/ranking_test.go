@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRankingMatchesSortedRanking(t *testing.T) {
+	r := NewRanking(func(a, b string) bool { return a < b })
+	rnd := rand.New(rand.NewSource(42))
+	names := make([]string, 200)
+	scores := make(map[string]int64, len(names))
+	for i := range names {
+		names[i] = string(rune('a'+i%26)) + string(rune('a'+i/26))
+	}
+
+	// ランダムに更新・削除して、毎回 UserRanking を sort した結果と比べる
+	for step := 0; step < 2000; step++ {
+		name := names[rnd.Intn(len(names))]
+		switch rnd.Intn(4) {
+		case 0:
+			r.Delete(name)
+			delete(scores, name)
+		case 1:
+			score := int64(rnd.Intn(20))
+			r.Set(name, score)
+			scores[name] = score
+		default:
+			delta := int64(rnd.Intn(5))
+			r.Add(name, delta)
+			scores[name] += delta
+		}
+
+		if step%100 != 0 {
+			continue
+		}
+		var ranking UserRanking
+		for name, score := range scores {
+			ranking = append(ranking, UserRankingEntry{Username: name, Score: score})
+		}
+		sort.Sort(ranking)
+		require.Equal(t, int64(len(ranking)), r.Len())
+
+		top := r.Top(0, int64(len(ranking)))
+		require.Len(t, top, len(ranking))
+		for i := range ranking {
+			want := ranking[len(ranking)-1-i]
+			assert.Equal(t, want.Username, top[i].Key)
+			assert.Equal(t, want.Score, top[i].Score)
+			assert.Equal(t, int64(i+1), top[i].Rank)
+
+			rank, ok := r.Rank(want.Username)
+			assert.True(t, ok)
+			assert.Equal(t, int64(i+1), rank)
+		}
+	}
+}
+
+func TestRankingTop(t *testing.T) {
+	r := NewRanking(func(a, b int64) bool { return a < b })
+	r.Replace(map[int64]int64{1: 10, 2: 30, 3: 20, 4: 20})
+
+	// 同点ならIDの大きい方が上位
+	assert.Equal(t, []RankingEntry[int64]{
+		{Key: 3, Score: 20, Rank: 3},
+		{Key: 1, Score: 10, Rank: 4},
+	}, r.Top(2, 10))
+	assert.Empty(t, r.Top(4, 10))
+
+	rank, ok := r.Rank(4)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), rank)
+	_, ok = r.Rank(5)
+	assert.False(t, ok)
+}
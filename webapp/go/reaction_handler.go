@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -33,13 +34,41 @@ type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
 }
 
-func getReactionsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+type EmojiCount struct {
+	EmojiName string `json:"emoji_name"`
+	Count     int64  `json:"count"`
+}
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
+type ReactionSummaryBucket struct {
+	StartAt int64        `json:"start_at"`
+	Total   int64        `json:"total"`
+	Emojis  []EmojiCount `json:"emojis"`
+}
+
+type ReactionSummary struct {
+	Total int64 `json:"total"`
+	// Emojis は多い順
+	Emojis []EmojiCount `json:"emojis"`
+	// Bucket, Buckets は bucket を指定したときだけ入る。リアクションのないバケットは省く
+	Bucket  int64                   `json:"bucket,omitempty"`
+	Buckets []ReactionSummaryBucket `json:"buckets,omitempty"`
+}
+
+var emojiCatalogSet = func() map[string]struct{} {
+	set := make(map[string]struct{}, len(emojiCatalog))
+	for _, name := range emojiCatalog {
+		set[name] = struct{}{}
 	}
+	return set
+}()
+
+func isCatalogEmoji(name string) bool {
+	_, ok := emojiCatalogSet[name]
+	return ok
+}
+
+func getReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -81,26 +110,38 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := currentUser(c).ID
 
 	var req *PostReactionRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if !isCatalogEmoji(req.EmojiName) && !isCustomEmojiShortcode(req.EmojiName) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown emoji_name")
+	}
 
-	tx, err := dbConn.Connx(ctx)
+	// リアクションと集計はまとめてコミットする
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
-	defer tx.Close()
+	defer tx.Rollback()
+
+	livestreamModel, err := getOpenLivestream(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return err
+	}
+
+	// カスタム絵文字はその配信者の配信でだけ使える
+	if isCustomEmojiShortcode(req.EmojiName) {
+		exists, err := customEmojiExists(ctx, tx, livestreamModel.UserID, req.EmojiName)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if !exists {
+			return echo.NewHTTPError(http.StatusBadRequest, "custom emoji is not registered by the streamer")
+		}
+	}
 
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
@@ -120,14 +161,96 @@ func postReactionHandler(c echo.Context) error {
 	}
 	reactionModel.ID = reactionID
 
+	if err := addReactionStats(ctx, tx, &livestreamModel, reactionModel.EmojiName); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	statsRollupWriter.AddReaction(livestreamModel.ID, reactionModel.CreatedAt, reactionModel.EmojiName)
+	// リアクションは保存済みなので失敗にはしない。ランキングは起動時・初期化時に作り直される
+	if err := statsRankings.Add(ctx, &livestreamModel, 1, reactionModel.CreatedAt); err != nil {
+		c.Logger().Errorf("failed to update rankings: %v", err)
+	}
+
 	return c.JSON(http.StatusCreated, reaction)
 }
 
+// 配信のリアクション集計API
+// GET /api/livestream/:livestream_id/reaction/summary
+func getReactionSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var bucket time.Duration
+	if c.QueryParam("bucket") != "" {
+		if bucket, err = parseStatsBucket(c.QueryParam("bucket")); err != nil {
+			return err
+		}
+	}
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	res := ReactionSummary{Emojis: []EmojiCount{}}
+	if err := tx.SelectContext(ctx, &res.Emojis, "SELECT emoji_name, COUNT(*) AS count FROM reactions WHERE livestream_id = ? GROUP BY emoji_name ORDER BY count DESC, emoji_name", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	for _, emoji := range res.Emojis {
+		res.Total += emoji.Count
+	}
+
+	if bucket == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	// タイムシリーズと同じく配信の開始時刻に揃えて区切る
+	width := int64(bucket / time.Second)
+	var rows []struct {
+		Index     int64  `db:"idx"`
+		EmojiName string `db:"emoji_name"`
+		Count     int64  `db:"count"`
+	}
+	if err := tx.SelectContext(ctx, &rows, `SELECT FLOOR((created_at - ?) / ?) AS idx, emoji_name, COUNT(*) AS count FROM reactions
+	WHERE livestream_id = ? GROUP BY idx, emoji_name ORDER BY idx, count DESC, emoji_name`, livestreamModel.StartAt, width, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	res.Bucket = width
+	res.Buckets = []ReactionSummaryBucket{}
+	for _, row := range rows {
+		startAt := livestreamModel.StartAt + row.Index*width
+		if len(res.Buckets) == 0 || res.Buckets[len(res.Buckets)-1].StartAt != startAt {
+			res.Buckets = append(res.Buckets, ReactionSummaryBucket{StartAt: startAt, Emojis: []EmojiCount{}})
+		}
+		b := &res.Buckets[len(res.Buckets)-1]
+		b.Total += row.Count
+		b.Emojis = append(b.Emojis, EmojiCount{EmojiName: row.EmojiName, Count: row.Count})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
 func fillReactionResponses(ctx context.Context, tx *sqlx.Conn, reactionModels []ReactionModel) ([]Reaction, error) {
 	if len(reactionModels) == 0 {
 		return []Reaction{}, nil
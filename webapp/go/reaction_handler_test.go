@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCatalogEmoji(t *testing.T) {
+	assert.True(t, isCatalogEmoji("chair"))
+	assert.True(t, isCatalogEmoji("man-getting-massage"))
+	assert.False(t, isCatalogEmoji(""))
+	assert.False(t, isCatalogEmoji("not_an_emoji"))
+	assert.False(t, isCatalogEmoji(":chair:"))
+}
+
+func TestParseStatsBucket(t *testing.T) {
+	d, err := parseStatsBucket("5m")
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, d)
+
+	for _, v := range []string{"30s", "90s", "25h", "abc"} {
+		_, err := parseStatsBucket(v)
+		var httpErr *echo.HTTPError
+		require.ErrorAs(t, err, &httpErr, v)
+		assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+	}
+}
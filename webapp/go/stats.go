@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type UserStatsModel struct {
+	UserID            int64 `db:"user_id"`
+	TotalReactions    int64 `db:"total_reactions"`
+	TotalLivecomments int64 `db:"total_livecomments"`
+	TotalTip          int64 `db:"total_tip"`
+}
+
+type LivestreamStatsModel struct {
+	LivestreamID      int64 `db:"livestream_id"`
+	UserID            int64 `db:"user_id"`
+	TotalReactions    int64 `db:"total_reactions"`
+	TotalLivecomments int64 `db:"total_livecomments"`
+	TotalTip          int64 `db:"total_tip"`
+	MaxTip            int64 `db:"max_tip"`
+	TotalReports      int64 `db:"total_reports"`
+}
+
+const (
+	rankingWindowDaily  = "daily"
+	rankingWindowWeekly = "weekly"
+	rankingWindowAll    = "all"
+)
+
+// 期間で区切るランキング
+var rankingPeriodicWindows = []string{rankingWindowDaily, rankingWindowWeekly}
+
+func isRankingWindow(window string) bool {
+	switch window {
+	case rankingWindowDaily, rankingWindowWeekly, rankingWindowAll:
+		return true
+	}
+	return false
+}
+
+// rankingWindowStart は now を含む集計期間の開始時刻を返す
+// 日はUTCの0時、週は月曜0時で区切る。all は常に0
+func rankingWindowStart(window string, now time.Time) int64 {
+	day := now.UTC().Truncate(24 * time.Hour)
+	switch window {
+	case rankingWindowDaily:
+		return day.Unix()
+	case rankingWindowWeekly:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset).Unix()
+	}
+	return 0
+}
+
+type rankingScope struct {
+	window string
+	// tagID が0ならタグで絞り込まない
+	tagID int64
+}
+
+// rankingBoard はある期間・タグでのユーザと配信のランキング
+type rankingBoard struct {
+	users       *Ranking[string]
+	livestreams *Ranking[int64]
+}
+
+func newRankingBoard() *rankingBoard {
+	return &rankingBoard{
+		users:       NewRanking(func(a, b string) bool { return a < b }),
+		livestreams: NewRanking(func(a, b int64) bool { return a < b }),
+	}
+}
+
+// StatsRankings はユーザと配信のスコア (リアクション数 + チップ合計) の順位を保持する
+// DBの user_stats / livestream_stats を更新したら、同じ差分をここにも反映する
+//
+// 全期間のランキングには全ユーザ・全配信が載り、統計APIの順位もここから返す。
+// 日・週のランキングにはその期間にスコアがついたものだけが載り、期間が変わったら空にする
+type StatsRankings struct {
+	mu     *sync.Mutex
+	boards map[rankingScope]*rankingBoard
+	// windowStarts は日・週のランキングの集計期間の開始時刻
+	windowStarts map[string]int64
+	// livestreamTags は配信ID -> タグID
+	livestreamTags map[int64][]int64
+}
+
+var statsRankings = &StatsRankings{
+	mu: new(sync.Mutex),
+	boards: map[rankingScope]*rankingBoard{
+		{window: rankingWindowAll}: newRankingBoard(),
+	},
+	windowStarts:   map[string]int64{},
+	livestreamTags: map[int64][]int64{},
+}
+
+// Load はDBから順位を作り直す
+// 全期間は集計テーブルから、日・週は元のテーブルから求める
+func (r *StatsRankings) Load(ctx context.Context) error {
+	var users []struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := dbConn.SelectContext(ctx, &users, "SELECT id, name FROM users"); err != nil {
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+	userNames := make(map[int64]string, len(users))
+	for _, user := range users {
+		userNames[user.ID] = user.Name
+	}
+
+	var livestreams []struct {
+		ID     int64 `db:"id"`
+		UserID int64 `db:"user_id"`
+		Score  int64 `db:"score"`
+	}
+	if err := dbConn.SelectContext(ctx, &livestreams, "SELECT l.id, l.user_id, IFNULL(s.total_reactions + s.total_tip, 0) AS score FROM livestreams l LEFT JOIN livestream_stats s ON s.livestream_id = l.id"); err != nil {
+		return fmt.Errorf("failed to get livestream stats: %w", err)
+	}
+	owners := make(map[int64]string, len(livestreams))
+	for _, livestream := range livestreams {
+		owners[livestream.ID] = userNames[livestream.UserID]
+	}
+
+	var livestreamTagModels []*LivestreamTagModel
+	if err := dbConn.SelectContext(ctx, &livestreamTagModels, "SELECT * FROM livestream_tags"); err != nil {
+		return fmt.Errorf("failed to get livestream tags: %w", err)
+	}
+	livestreamTags := make(map[int64][]int64, len(livestreams))
+	for _, livestreamTagModel := range livestreamTagModels {
+		livestreamTags[livestreamTagModel.LivestreamID] = append(livestreamTags[livestreamTagModel.LivestreamID], livestreamTagModel.TagID)
+	}
+
+	boards := make(map[rankingScope]*rankingBoard)
+	all := boardFor(boards, rankingScope{window: rankingWindowAll})
+	for _, user := range users {
+		all.users.Add(user.Name, 0)
+	}
+	for _, livestream := range livestreams {
+		addToBoards(boards, rankingWindowAll, livestreamTags[livestream.ID], owners[livestream.ID], livestream.ID, livestream.Score)
+	}
+
+	now := time.Now()
+	windowStarts := make(map[string]int64, len(rankingPeriodicWindows))
+	for _, window := range rankingPeriodicWindows {
+		windowStarts[window] = rankingWindowStart(window, now)
+		scores, err := loadWindowScores(ctx, windowStarts[window])
+		if err != nil {
+			return err
+		}
+		for livestreamID, score := range scores {
+			owner, ok := owners[livestreamID]
+			if !ok {
+				continue
+			}
+			addToBoards(boards, window, livestreamTags[livestreamID], owner, livestreamID, score)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.boards = boards
+	r.windowStarts = windowStarts
+	r.livestreamTags = livestreamTags
+	return nil
+}
+
+// loadWindowScores は since 以降のリアクションとチップから配信ごとのスコアを求める
+func loadWindowScores(ctx context.Context, since int64) (map[int64]int64, error) {
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Score        int64 `db:"score"`
+	}
+	if err := dbConn.SelectContext(ctx, &rows, `SELECT livestream_id, SUM(score) AS score FROM (
+		SELECT livestream_id, COUNT(*) AS score FROM reactions WHERE created_at >= ? GROUP BY livestream_id
+		UNION ALL
+		SELECT livestream_id, SUM(tip) AS score FROM livecomments WHERE is_deleted = 0 AND tip > 0 AND created_at >= ? GROUP BY livestream_id
+	) t GROUP BY livestream_id`, since, since); err != nil {
+		return nil, fmt.Errorf("failed to get window scores: %w", err)
+	}
+	scores := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		scores[row.LivestreamID] = row.Score
+	}
+	return scores, nil
+}
+
+func boardFor(boards map[rankingScope]*rankingBoard, scope rankingScope) *rankingBoard {
+	board, ok := boards[scope]
+	if !ok {
+		board = newRankingBoard()
+		boards[scope] = board
+	}
+	return board
+}
+
+// addToBoards は配信と配信者のスコアを、タグなしと配信についたタグごとのランキングに足す
+func addToBoards(boards map[rankingScope]*rankingBoard, window string, tagIDs []int64, owner string, livestreamID, delta int64) {
+	scopes := make([]rankingScope, 0, len(tagIDs)+1)
+	scopes = append(scopes, rankingScope{window: window})
+	for _, tagID := range tagIDs {
+		scopes = append(scopes, rankingScope{window: window, tagID: tagID})
+	}
+	for _, scope := range scopes {
+		board := boardFor(boards, scope)
+		board.users.Add(owner, delta)
+		board.livestreams.Add(livestreamID, delta)
+	}
+}
+
+// rollover は日・週が変わっていたらそのランキングを空にする。ロックを取ってから呼ぶ
+func (r *StatsRankings) rollover(now time.Time) {
+	for _, window := range rankingPeriodicWindows {
+		start := rankingWindowStart(window, now)
+		if r.windowStarts[window] == start {
+			continue
+		}
+		for scope := range r.boards {
+			if scope.window == window {
+				delete(r.boards, scope)
+			}
+		}
+		r.windowStarts[window] = start
+	}
+}
+
+// Add は配信と配信者のスコアに delta を足す
+// at はリアクションやチップがついた時刻で、それを含む期間のランキングにだけ足す
+func (r *StatsRankings) Add(ctx context.Context, livestreamModel *LivestreamModel, delta int64, at int64) error {
+	owner, err := userCache.Get(ctx, livestreamModel.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get livestream owner: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rollover(time.Now())
+
+	tagIDs := r.livestreamTags[livestreamModel.ID]
+	addToBoards(r.boards, rankingWindowAll, tagIDs, owner.Name, livestreamModel.ID, delta)
+	if delta == 0 {
+		return nil
+	}
+	for _, window := range rankingPeriodicWindows {
+		if at >= r.windowStarts[window] {
+			addToBoards(r.boards, window, tagIDs, owner.Name, livestreamModel.ID, delta)
+		}
+	}
+	return nil
+}
+
+// AddUser は登録したユーザをスコア0で加える
+func (r *StatsRankings) AddUser(username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	boardFor(r.boards, rankingScope{window: rankingWindowAll}).users.Add(username, 0)
+}
+
+// AddLivestream は予約した配信をスコア0で加える
+func (r *StatsRankings) AddLivestream(livestreamID int64, owner string, tagIDs []int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.livestreamTags[livestreamID] = tagIDs
+	addToBoards(r.boards, rankingWindowAll, tagIDs, owner, livestreamID, 0)
+}
+
+// RemoveUser は退会したユーザとその配信をすべてのランキングから消す
+func (r *StatsRankings) RemoveUser(username string, livestreamIDs []int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, board := range r.boards {
+		board.users.Delete(username)
+		for _, livestreamID := range livestreamIDs {
+			board.livestreams.Delete(livestreamID)
+		}
+	}
+	for _, livestreamID := range livestreamIDs {
+		delete(r.livestreamTags, livestreamID)
+	}
+}
+
+// Board は期間とタグを指定してランキングを返す。まだ誰もスコアがなければ nil
+func (r *StatsRankings) Board(window string, tagID int64, now time.Time) *rankingBoard {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rollover(now)
+	return r.boards[rankingScope{window: window, tagID: tagID}]
+}
+
+func (r *StatsRankings) UserRank(username string) int64 {
+	board := r.Board(rankingWindowAll, 0, time.Now())
+	rank, ok := board.users.Rank(username)
+	if !ok {
+		// 登録直後で反映されていなければ最下位
+		return board.users.Len() + 1
+	}
+	return rank
+}
+
+func (r *StatsRankings) LivestreamRank(livestreamID int64) int64 {
+	board := r.Board(rankingWindowAll, 0, time.Now())
+	rank, ok := board.livestreams.Rank(livestreamID)
+	if !ok {
+		return board.livestreams.Len() + 1
+	}
+	return rank
+}
+
+// rebuildStats は全件の集計を元のテーブルから作り直す
+func rebuildStats(ctx context.Context, tx sqlx.ExecerContext) error {
+	return recomputeStatsRows(ctx, tx, true, nil, nil)
+}
+
+// recomputeStats は指定した配信とユーザの集計を元のテーブルから作り直す
+// 消えた配信・ユーザの集計は消える
+func recomputeStats(ctx context.Context, tx sqlx.ExecerContext, livestreamIDs, userIDs []int64) error {
+	return recomputeStatsRows(ctx, tx, false, livestreamIDs, userIDs)
+}
+
+func recomputeStatsRows(ctx context.Context, tx sqlx.ExecerContext, all bool, livestreamIDs, userIDs []int64) error {
+
+	type statsQuery struct {
+		query string
+		// ids は IN句に展開するID。all なら条件ごと消す
+		ids []int64
+	}
+	queries := []statsQuery{
+		{"DELETE FROM livestream_stats WHERE livestream_id IN (?)", livestreamIDs},
+		{"INSERT INTO livestream_stats (livestream_id, user_id) SELECT id, user_id FROM livestreams WHERE id IN (?)", livestreamIDs},
+		{`UPDATE livestream_stats s INNER JOIN (
+			SELECT livestream_id, COUNT(*) AS cnt FROM reactions WHERE livestream_id IN (?) GROUP BY livestream_id
+		) r ON r.livestream_id = s.livestream_id SET s.total_reactions = r.cnt`, livestreamIDs},
+		{`UPDATE livestream_stats s INNER JOIN (
+			SELECT livestream_id, COUNT(*) AS cnt, SUM(tip) AS total_tip, MAX(tip) AS max_tip FROM livecomments WHERE is_deleted = 0 AND livestream_id IN (?) GROUP BY livestream_id
+		) c ON c.livestream_id = s.livestream_id SET s.total_livecomments = c.cnt, s.total_tip = c.total_tip, s.max_tip = c.max_tip`, livestreamIDs},
+		{`UPDATE livestream_stats s INNER JOIN (
+			SELECT livestream_id, COUNT(*) AS cnt FROM livecomment_reports WHERE livestream_id IN (?) GROUP BY livestream_id
+		) r ON r.livestream_id = s.livestream_id SET s.total_reports = r.cnt`, livestreamIDs},
+		{"DELETE FROM livestream_tippers WHERE livestream_id IN (?)", livestreamIDs},
+		{`INSERT INTO livestream_tippers (livestream_id, user_id, total_tip, last_tipped_at)
+			SELECT livestream_id, user_id, SUM(tip), MAX(created_at) FROM livecomments WHERE is_deleted = 0 AND tip > 0 AND livestream_id IN (?) GROUP BY livestream_id, user_id`, livestreamIDs},
+		{"DELETE FROM user_stats WHERE user_id IN (?)", userIDs},
+		{"INSERT INTO user_stats (user_id) SELECT id FROM users WHERE id IN (?)", userIDs},
+		{`UPDATE user_stats u INNER JOIN (
+			SELECT user_id, SUM(total_reactions) AS total_reactions, SUM(total_livecomments) AS total_livecomments, SUM(total_tip) AS total_tip
+			FROM livestream_stats WHERE user_id IN (?) GROUP BY user_id
+		) s ON s.user_id = u.user_id SET u.total_reactions = s.total_reactions, u.total_livecomments = s.total_livecomments, u.total_tip = s.total_tip`, userIDs},
+		{"DELETE FROM user_emoji_stats WHERE user_id IN (?)", userIDs},
+		{`INSERT INTO user_emoji_stats (user_id, emoji_name, count)
+			SELECT l.user_id, r.emoji_name, COUNT(*) FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id
+			WHERE l.user_id IN (?) GROUP BY l.user_id, r.emoji_name`, userIDs},
+	}
+
+	for _, q := range queries {
+		query, args := q.query, []interface{}{}
+		if all {
+			query = strings.NewReplacer(
+				"WHERE livestream_id IN (?)", "",
+				"WHERE id IN (?)", "",
+				"WHERE user_id IN (?)", "",
+				"WHERE l.user_id IN (?)", "",
+				"AND livestream_id IN (?)", "",
+			).Replace(query)
+		} else {
+			if len(q.ids) == 0 {
+				continue
+			}
+			var err error
+			query, args, err = sqlx.In(query, q.ids)
+			if err != nil {
+				return fmt.Errorf("failed to construct IN query: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to recompute stats: %w", err)
+		}
+	}
+	return nil
+}
+
+// addLivecommentStats はライブコメントの投稿を集計に反映する
+func addLivecommentStats(ctx context.Context, tx sqlx.ExecerContext, livestreamModel *LivestreamModel, tip int64) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO livestream_stats (livestream_id, user_id, total_livecomments, total_tip, max_tip) VALUES (?, ?, 1, ?, ?)
+	ON DUPLICATE KEY UPDATE total_livecomments = total_livecomments + 1, total_tip = total_tip + VALUES(total_tip), max_tip = GREATEST(max_tip, VALUES(max_tip))`,
+		livestreamModel.ID, livestreamModel.UserID, tip, tip); err != nil {
+		return fmt.Errorf("failed to update livestream stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO user_stats (user_id, total_livecomments, total_tip) VALUES (?, 1, ?)
+	ON DUPLICATE KEY UPDATE total_livecomments = total_livecomments + 1, total_tip = total_tip + VALUES(total_tip)`,
+		livestreamModel.UserID, tip); err != nil {
+		return fmt.Errorf("failed to update user stats: %w", err)
+	}
+	return nil
+}
+
+// addTipStats は投稿済みのライブコメントに後から載ったチップ (保留の承認) を集計に反映する
+func addTipStats(ctx context.Context, tx sqlx.ExecerContext, livestreamModel *LivestreamModel, tip int64) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO livestream_stats (livestream_id, user_id, total_tip, max_tip) VALUES (?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE total_tip = total_tip + VALUES(total_tip), max_tip = GREATEST(max_tip, VALUES(max_tip))`,
+		livestreamModel.ID, livestreamModel.UserID, tip, tip); err != nil {
+		return fmt.Errorf("failed to update livestream stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_stats (user_id, total_tip) VALUES (?, ?) ON DUPLICATE KEY UPDATE total_tip = total_tip + VALUES(total_tip)",
+		livestreamModel.UserID, tip); err != nil {
+		return fmt.Errorf("failed to update user stats: %w", err)
+	}
+	return nil
+}
+
+// addReactionStats はリアクションを集計に反映する
+func addReactionStats(ctx context.Context, tx sqlx.ExecerContext, livestreamModel *LivestreamModel, emojiName string) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_stats (livestream_id, user_id, total_reactions) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE total_reactions = total_reactions + 1", livestreamModel.ID, livestreamModel.UserID); err != nil {
+		return fmt.Errorf("failed to update livestream stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_stats (user_id, total_reactions) VALUES (?, 1) ON DUPLICATE KEY UPDATE total_reactions = total_reactions + 1", livestreamModel.UserID); err != nil {
+		return fmt.Errorf("failed to update user stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_emoji_stats (user_id, emoji_name, count) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE count = count + 1", livestreamModel.UserID, emojiName); err != nil {
+		return fmt.Errorf("failed to update user emoji stats: %w", err)
+	}
+	return nil
+}
+
+// addReportStats はスパム報告を集計に反映する
+func addReportStats(ctx context.Context, tx sqlx.ExecerContext, livestreamModel *LivestreamModel) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_stats (livestream_id, user_id, total_reports) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE total_reports = total_reports + 1", livestreamModel.ID, livestreamModel.UserID); err != nil {
+		return fmt.Errorf("failed to update livestream stats: %w", err)
+	}
+	return nil
+}
+
+// hideLivecommentStats は非表示にしたライブコメントを集計から外す
+// 最大チップ額は残ったコメントから求め直す
+func hideLivecommentStats(ctx context.Context, tx sqlx.ExecerContext, livestreamModel *LivestreamModel, livecommentModels []*LivecommentModel) error {
+	if len(livecommentModels) == 0 {
+		return nil
+	}
+	var count, tip int64
+	for _, livecommentModel := range livecommentModels {
+		count++
+		tip += livecommentModel.Tip
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE livestream_stats SET
+		total_livecomments = total_livecomments - ?,
+		total_tip = total_tip - ?,
+		max_tip = (SELECT IFNULL(MAX(tip), 0) FROM livecomments WHERE livestream_id = ? AND is_deleted = 0)
+	WHERE livestream_id = ?`, count, tip, livestreamModel.ID, livestreamModel.ID); err != nil {
+		return fmt.Errorf("failed to update livestream stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_stats SET total_livecomments = total_livecomments - ?, total_tip = total_tip - ? WHERE user_id = ?", count, tip, livestreamModel.UserID); err != nil {
+		return fmt.Errorf("failed to update user stats: %w", err)
+	}
+	return nil
+}
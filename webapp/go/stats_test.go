@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRankingWindowStart(t *testing.T) {
+	// 2024-01-04 は木曜日
+	now := time.Date(2024, 1, 4, 15, 30, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC).Unix(), rankingWindowStart(rankingWindowDaily, now))
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix(), rankingWindowStart(rankingWindowWeekly, now))
+	assert.Equal(t, int64(0), rankingWindowStart(rankingWindowAll, now))
+
+	// 日曜日は前の月曜日からの週に入る
+	sunday := time.Date(2024, 1, 7, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix(), rankingWindowStart(rankingWindowWeekly, sunday))
+}
+
+func TestStatsRankingsRollover(t *testing.T) {
+	r := &StatsRankings{
+		boards:         map[rankingScope]*rankingBoard{},
+		windowStarts:   map[string]int64{},
+		livestreamTags: map[int64][]int64{},
+	}
+	day1 := time.Date(2024, 1, 4, 12, 0, 0, 0, time.UTC)
+	r.rollover(day1)
+
+	addToBoards(r.boards, rankingWindowAll, []int64{7}, "alice", 1, 10)
+	addToBoards(r.boards, rankingWindowDaily, []int64{7}, "alice", 1, 10)
+	addToBoards(r.boards, rankingWindowDaily, nil, "bob", 2, 20)
+
+	daily := r.boards[rankingScope{window: rankingWindowDaily}]
+	assert.Equal(t, []RankingEntry[string]{
+		{Key: "bob", Score: 20, Rank: 1},
+		{Key: "alice", Score: 10, Rank: 2},
+	}, daily.users.Top(0, 10))
+	// タグで絞ると bob の配信は載らない
+	tagged := r.boards[rankingScope{window: rankingWindowDaily, tagID: 7}]
+	assert.Equal(t, int64(1), tagged.livestreams.Len())
+
+	// 日が変わると日のランキングだけ空になる
+	r.rollover(day1.Add(24 * time.Hour))
+	assert.Nil(t, r.boards[rankingScope{window: rankingWindowDaily}])
+	assert.Nil(t, r.boards[rankingScope{window: rankingWindowDaily, tagID: 7}])
+	assert.NotNil(t, r.boards[rankingScope{window: rankingWindowAll, tagID: 7}])
+}
+
+func TestStatsRankingsRemoveUser(t *testing.T) {
+	r := &StatsRankings{
+		mu:             new(sync.Mutex),
+		boards:         map[rankingScope]*rankingBoard{},
+		windowStarts:   map[string]int64{},
+		livestreamTags: map[int64][]int64{1: {7}, 2: nil},
+	}
+	addToBoards(r.boards, rankingWindowAll, []int64{7}, "alice", 1, 10)
+	addToBoards(r.boards, rankingWindowDaily, []int64{7}, "alice", 1, 10)
+	addToBoards(r.boards, rankingWindowAll, nil, "bob", 2, 20)
+
+	// 退会した alice と配信はどの期間・タグのランキングからも消える
+	r.RemoveUser("alice", []int64{1})
+	for scope, board := range r.boards {
+		_, ok := board.users.Score("alice")
+		assert.False(t, ok, scope)
+		_, ok = board.livestreams.Score(1)
+		assert.False(t, ok, scope)
+	}
+	assert.Equal(t, []RankingEntry[string]{{Key: "bob", Score: 20, Rank: 1}}, r.boards[rankingScope{window: rankingWindowAll}].users.Top(0, 10))
+	assert.NotContains(t, r.livestreamTags, int64(1))
+}
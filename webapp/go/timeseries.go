@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	statsRollupFlushInterval = time.Second
+	// 1回のINSERTにまとめる行数
+	statsRollupBatchSize = 500
+)
+
+type LivestreamMinutelyStatsModel struct {
+	LivestreamID int64 `db:"livestream_id"`
+	Minute       int64 `db:"minute"`
+	Livecomments int64 `db:"livecomments"`
+	Tips         int64 `db:"tips"`
+	Reactions    int64 `db:"reactions"`
+	Reports      int64 `db:"reports"`
+	PeakViewers  int64 `db:"peak_viewers"`
+}
+
+type LivestreamMinutelyEmojiStatsModel struct {
+	LivestreamID int64  `db:"livestream_id"`
+	Minute       int64  `db:"minute"`
+	EmojiName    string `db:"emoji_name"`
+	Count        int64  `db:"count"`
+}
+
+type statsRollupKey struct {
+	livestreamID int64
+	minute       int64
+}
+
+// statsRollup は1分ぶんの増分。peakViewers だけは最大値
+type statsRollup struct {
+	livecomments int64
+	tips         int64
+	reactions    int64
+	reports      int64
+	peakViewers  int64
+	emojis       map[string]int64
+}
+
+// StatsRollupWriter は配信の1分ごとの集計をメモリに貯めて、まとめてDBに書く
+type StatsRollupWriter struct {
+	mu      *sync.Mutex
+	pending map[statsRollupKey]*statsRollup
+}
+
+var statsRollupWriter = &StatsRollupWriter{
+	mu:      new(sync.Mutex),
+	pending: make(map[statsRollupKey]*statsRollup, 1000),
+}
+
+func rollupMinute(at int64) int64 {
+	return at - at%60
+}
+
+// update は at を含む分の増分を更新する
+func (w *StatsRollupWriter) update(livestreamID, at int64, f func(r *statsRollup)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key := statsRollupKey{livestreamID: livestreamID, minute: rollupMinute(at)}
+	r, ok := w.pending[key]
+	if !ok {
+		r = &statsRollup{}
+		w.pending[key] = r
+	}
+	f(r)
+}
+
+func (w *StatsRollupWriter) AddLivecomment(livestreamID, at, tip int64) {
+	w.update(livestreamID, at, func(r *statsRollup) {
+		r.livecomments++
+		r.tips += tip
+	})
+}
+
+// AddTip は承認された保留チップを、コメントを投稿した分の集計に足す
+func (w *StatsRollupWriter) AddTip(livestreamID, at, tip int64) {
+	w.update(livestreamID, at, func(r *statsRollup) {
+		r.tips += tip
+	})
+}
+
+// RemoveLivecomment は非表示にしたライブコメントを投稿した分の集計から外す
+func (w *StatsRollupWriter) RemoveLivecomment(livestreamID, at, tip int64) {
+	w.update(livestreamID, at, func(r *statsRollup) {
+		r.livecomments--
+		r.tips -= tip
+	})
+}
+
+func (w *StatsRollupWriter) AddReaction(livestreamID, at int64, emojiName string) {
+	w.update(livestreamID, at, func(r *statsRollup) {
+		r.reactions++
+		if r.emojis == nil {
+			r.emojis = make(map[string]int64)
+		}
+		r.emojis[emojiName]++
+	})
+}
+
+func (w *StatsRollupWriter) AddReport(livestreamID, at int64) {
+	w.update(livestreamID, at, func(r *statsRollup) {
+		r.reports++
+	})
+}
+
+// ObserveViewers は同時視聴者数を記録する。分の中では最大値を残す
+func (w *StatsRollupWriter) ObserveViewers(livestreamID, at, count int64) {
+	w.update(livestreamID, at, func(r *statsRollup) {
+		r.peakViewers = max(r.peakViewers, count)
+	})
+}
+
+func (w *StatsRollupWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = make(map[statsRollupKey]*statsRollup, 1000)
+}
+
+// Run は貯まった集計を定期的にDBに書く
+func (w *StatsRollupWriter) Run(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(statsRollupFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := w.Flush(ctx); err != nil {
+			logger.Warnf("failed to flush stats rollups: %v", err)
+		}
+	}
+}
+
+// Flush は貯まった集計をDBに書く。失敗したら書けなかったぶんを戻して次回やり直す
+func (w *StatsRollupWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[statsRollupKey]*statsRollup, len(pending))
+	w.mu.Unlock()
+
+	keys := make([]statsRollupKey, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), statsRollupBatchSize)
+		if err := flushStatsRollupBatch(ctx, keys[:n], pending); err != nil {
+			w.restore(keys, pending)
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// restore は書けなかった集計を、その後に貯まったぶんと合わせて戻す
+func (w *StatsRollupWriter) restore(keys []statsRollupKey, pending map[statsRollupKey]*statsRollup) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		old := pending[key]
+		r, ok := w.pending[key]
+		if !ok {
+			w.pending[key] = old
+			continue
+		}
+		r.livecomments += old.livecomments
+		r.tips += old.tips
+		r.reactions += old.reactions
+		r.reports += old.reports
+		r.peakViewers = max(r.peakViewers, old.peakViewers)
+		for emojiName, count := range old.emojis {
+			if r.emojis == nil {
+				r.emojis = make(map[string]int64)
+			}
+			r.emojis[emojiName] += count
+		}
+	}
+}
+
+// flushStatsRollupBatch は1バッチをトランザクションで書く
+// 途中で失敗したバッチは丸ごと戻すので、一部だけ書けていると次回に二重に足してしまう
+func flushStatsRollupBatch(ctx context.Context, keys []statsRollupKey, pending map[statsRollupKey]*statsRollup) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := writeStatsRollups(ctx, tx, keys, pending); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func writeStatsRollups(ctx context.Context, tx sqlx.ExecerContext, keys []statsRollupKey, pending map[statsRollupKey]*statsRollup) error {
+	placeholders := make([]string, 0, len(keys))
+	args := make([]interface{}, 0, len(keys)*7)
+	var emojiPlaceholders []string
+	var emojiArgs []interface{}
+	for _, key := range keys {
+		r := pending[key]
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, key.livestreamID, key.minute, r.livecomments, r.tips, r.reactions, r.reports, r.peakViewers)
+		for emojiName, count := range r.emojis {
+			emojiPlaceholders = append(emojiPlaceholders, "(?, ?, ?, ?)")
+			emojiArgs = append(emojiArgs, key.livestreamID, key.minute, emojiName, count)
+		}
+	}
+
+	query := `INSERT INTO livestream_minutely_stats (livestream_id, minute, livecomments, tips, reactions, reports, peak_viewers) VALUES ` + strings.Join(placeholders, ", ") + `
+	ON DUPLICATE KEY UPDATE
+		livecomments = livecomments + VALUES(livecomments),
+		tips = tips + VALUES(tips),
+		reactions = reactions + VALUES(reactions),
+		reports = reports + VALUES(reports),
+		peak_viewers = GREATEST(peak_viewers, VALUES(peak_viewers))`
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to write minutely stats: %w", err)
+	}
+
+	if len(emojiPlaceholders) == 0 {
+		return nil
+	}
+	query = "INSERT INTO livestream_minutely_emoji_stats (livestream_id, minute, emoji_name, count) VALUES " + strings.Join(emojiPlaceholders, ", ") + " ON DUPLICATE KEY UPDATE count = count + VALUES(count)"
+	if _, err := tx.ExecContext(ctx, query, emojiArgs...); err != nil {
+		return fmt.Errorf("failed to write minutely emoji stats: %w", err)
+	}
+	return nil
+}
+
+// rebuildMinutelyStats は初期データのライブコメント・リアクション・報告から1分ごとの集計を作る
+// 同時視聴者数は残っていないので0になる
+func rebuildMinutelyStats(ctx context.Context, tx sqlx.ExecerContext) error {
+	queries := []string{
+		"DELETE FROM livestream_minutely_stats",
+		"DELETE FROM livestream_minutely_emoji_stats",
+		`INSERT INTO livestream_minutely_stats (livestream_id, minute, livecomments, tips)
+		SELECT livestream_id, created_at - created_at % 60 AS minute, COUNT(*), SUM(tip) FROM livecomments WHERE is_deleted = 0 GROUP BY livestream_id, minute`,
+		`INSERT INTO livestream_minutely_stats (livestream_id, minute, reactions)
+		SELECT livestream_id, created_at - created_at % 60 AS minute, COUNT(*) AS cnt FROM reactions GROUP BY livestream_id, minute
+		ON DUPLICATE KEY UPDATE reactions = VALUES(reactions)`,
+		`INSERT INTO livestream_minutely_stats (livestream_id, minute, reports)
+		SELECT livestream_id, created_at - created_at % 60 AS minute, COUNT(*) AS cnt FROM livecomment_reports GROUP BY livestream_id, minute
+		ON DUPLICATE KEY UPDATE reports = VALUES(reports)`,
+		`INSERT INTO livestream_minutely_emoji_stats (livestream_id, minute, emoji_name, count)
+		SELECT livestream_id, created_at - created_at % 60 AS minute, emoji_name, COUNT(*) FROM reactions GROUP BY livestream_id, minute, emoji_name`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to rebuild minutely stats: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultTimeseriesBucket = time.Minute
+	maxTimeseriesBucket     = 24 * time.Hour
+	// これより多くのバケットになるなら bucket を大きくしてもらう
+	maxTimeseriesBuckets = 10000
+)
+
+type TimeseriesBucket struct {
+	// StartAt はバケットの開始時刻
+	StartAt          int64            `json:"start_at"`
+	Livecomments     int64            `json:"livecomments"`
+	Tips             int64            `json:"tips"`
+	Reactions        int64            `json:"reactions"`
+	ReactionsByEmoji map[string]int64 `json:"reactions_by_emoji"`
+	Reports          int64            `json:"reports"`
+	// PeakViewers はバケット内の同時視聴者数の最大値
+	PeakViewers int64 `json:"peak_viewers"`
+}
+
+type LivestreamTimeseries struct {
+	// Bucket はバケットの幅 (秒)
+	Bucket  int64              `json:"bucket"`
+	Buckets []TimeseriesBucket `json:"buckets"`
+}
+
+// parseStatsBucket は集計の bucket クエリパラメータ (1m 〜 24h の分単位) を読む
+func parseStatsBucket(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Minute || d > maxTimeseriesBucket || d%time.Minute != 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "bucket must be whole minutes between 1m and 24h")
+	}
+	return d, nil
+}
+
+// 配信の時系列統計API
+// GET /api/livestream/:livestream_id/statistics/timeseries
+func getLivestreamTimeseriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	livestreamModel := currentLivestream(c)
+
+	bucket := defaultTimeseriesBucket
+	if c.QueryParam("bucket") != "" {
+		d, err := parseStatsBucket(c.QueryParam("bucket"))
+		if err != nil {
+			return err
+		}
+		bucket = d
+	}
+	width := int64(bucket / time.Second)
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var statsModels []LivestreamMinutelyStatsModel
+	if err := tx.SelectContext(ctx, &statsModels, "SELECT * FROM livestream_minutely_stats WHERE livestream_id = ? ORDER BY minute", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get minutely stats: "+err.Error())
+	}
+	var emojiStatsModels []LivestreamMinutelyEmojiStatsModel
+	if err := tx.SelectContext(ctx, &emojiStatsModels, "SELECT * FROM livestream_minutely_emoji_stats WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get minutely emoji stats: "+err.Error())
+	}
+
+	// 配信の開始から終了 (まだなら現在) までを開始時刻に揃えて区切る
+	// 配信時間の外にも集計があれば範囲を広げる
+	from := rollupMinute(livestreamModel.StartAt)
+	to := min(livestreamModel.EndAt, time.Now().Unix())
+	for _, statsModel := range statsModels {
+		for statsModel.Minute < from {
+			from -= width
+		}
+		to = max(to, statsModel.Minute+60)
+	}
+	for _, emojiStatsModel := range emojiStatsModels {
+		for emojiStatsModel.Minute < from {
+			from -= width
+		}
+		to = max(to, emojiStatsModel.Minute+60)
+	}
+
+	res := LivestreamTimeseries{Bucket: width, Buckets: []TimeseriesBucket{}}
+	if to <= from {
+		return c.JSON(http.StatusOK, res)
+	}
+	n := (to - from + width - 1) / width
+	if n > maxTimeseriesBuckets {
+		return echo.NewHTTPError(http.StatusBadRequest, "too many buckets, use a larger bucket")
+	}
+
+	res.Buckets = make([]TimeseriesBucket, n)
+	for i := range res.Buckets {
+		res.Buckets[i] = TimeseriesBucket{
+			StartAt:          from + int64(i)*width,
+			ReactionsByEmoji: map[string]int64{},
+		}
+	}
+	for _, statsModel := range statsModels {
+		b := &res.Buckets[(statsModel.Minute-from)/width]
+		b.Livecomments += statsModel.Livecomments
+		b.Tips += statsModel.Tips
+		b.Reactions += statsModel.Reactions
+		b.Reports += statsModel.Reports
+		b.PeakViewers = max(b.PeakViewers, statsModel.PeakViewers)
+	}
+	for _, emojiStatsModel := range emojiStatsModels {
+		res.Buckets[(emojiStatsModel.Minute-from)/width].ReactionsByEmoji[emojiStatsModel.EmojiName] += emojiStatsModel.Count
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsRollupWriterRestore(t *testing.T) {
+	w := &StatsRollupWriter{mu: new(sync.Mutex), pending: map[statsRollupKey]*statsRollup{}}
+	w.AddLivecomment(1, 125, 500)
+	w.AddReaction(1, 130, "innocent")
+	w.ObserveViewers(1, 150, 3)
+
+	// 書き込みに失敗したとして取り出したぶんを戻す
+	failed := w.pending
+	w.pending = map[statsRollupKey]*statsRollup{}
+	w.AddReaction(1, 170, "innocent")
+	w.ObserveViewers(1, 170, 2)
+	w.AddReport(1, 190)
+
+	keys := make([]statsRollupKey, 0, len(failed))
+	for key := range failed {
+		keys = append(keys, key)
+	}
+	w.restore(keys, failed)
+
+	assert.Equal(t, &statsRollup{
+		livecomments: 1,
+		tips:         500,
+		reactions:    2,
+		peakViewers:  3,
+		emojis:       map[string]int64{"innocent": 2},
+	}, w.pending[statsRollupKey{livestreamID: 1, minute: 120}])
+	assert.Equal(t, &statsRollup{reports: 1}, w.pending[statsRollupKey{livestreamID: 1, minute: 180}])
+}
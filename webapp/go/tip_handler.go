@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultTopTippersLimit = 10
+	maxTopTippersLimit     = 100
+)
+
+type LivestreamTipperModel struct {
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+	TotalTip     int64 `db:"total_tip"`
+	LastTippedAt int64 `db:"last_tipped_at"`
+}
+
+type TopTipper struct {
+	Rank     int64 `json:"rank"`
+	User     User  `json:"user"`
+	TotalTip int64 `json:"total_tip"`
+}
+
+type TipGoalProgress struct {
+	// Goal が0なら目標は設定されていない
+	Goal     int64 `json:"goal"`
+	TotalTip int64 `json:"total_tip"`
+	// Progress は達成率 (%)。100を超えることもある
+	Progress float64 `json:"progress"`
+	Achieved bool    `json:"achieved"`
+}
+
+type PutTipGoalRequest struct {
+	TipGoal int64 `json:"tip_goal"`
+}
+
+// addTipper は配信ごとのユーザ別チップ合計に足す
+func addTipper(ctx context.Context, tx sqlx.ExecerContext, livestreamID, userID, tip, now int64) error {
+	if tip <= 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO livestream_tippers (livestream_id, user_id, total_tip, last_tipped_at) VALUES (?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE total_tip = total_tip + VALUES(total_tip), last_tipped_at = GREATEST(last_tipped_at, VALUES(last_tipped_at))`,
+		livestreamID, userID, tip, now); err != nil {
+		return fmt.Errorf("failed to update tipper: %w", err)
+	}
+	return nil
+}
+
+// removeTippers は非表示にしたライブコメントのチップをユーザ別チップ合計から引く
+func removeTippers(ctx context.Context, tx sqlx.ExecerContext, livestreamID int64, livecommentModels []*LivecommentModel) error {
+	tips := make(map[int64]int64)
+	for _, livecommentModel := range livecommentModels {
+		tips[livecommentModel.UserID] += livecommentModel.Tip
+	}
+	for userID, tip := range tips {
+		if tip <= 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE livestream_tippers SET total_tip = total_tip - ? WHERE livestream_id = ? AND user_id = ?", tip, livestreamID, userID); err != nil {
+			return fmt.Errorf("failed to update tipper: %w", err)
+		}
+	}
+	return nil
+}
+
+// 配信のチップ上位ユーザAPI
+// GET /api/livestream/:livestream_id/top_tippers
+func getTopTippersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	limit := defaultTopTippersLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxTopTippersLimit)
+	}
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	// 同額なら先にその額に達したユーザを上にする
+	var tipperModels []LivestreamTipperModel
+	if err := tx.SelectContext(ctx, &tipperModels, "SELECT * FROM livestream_tippers WHERE livestream_id = ? AND total_tip > 0 ORDER BY total_tip DESC, last_tipped_at, user_id LIMIT ?", livestreamID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get top tippers: "+err.Error())
+	}
+	tippers := make([]TopTipper, 0, len(tipperModels))
+	if len(tipperModels) == 0 {
+		return c.JSON(http.StatusOK, tippers)
+	}
+
+	userIDs := make([]int64, len(tipperModels))
+	for i := range tipperModels {
+		userIDs[i] = tipperModels[i].UserID
+	}
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	users, err := fillUserResponses(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+	userMap := make(map[int64]User, len(users))
+	for _, user := range users {
+		userMap[user.ID] = user
+	}
+
+	for i, tipperModel := range tipperModels {
+		tippers = append(tippers, TopTipper{
+			Rank:     int64(i + 1),
+			User:     userMap[tipperModel.UserID],
+			TotalTip: tipperModel.TotalTip,
+		})
+	}
+
+	return c.JSON(http.StatusOK, tippers)
+}
+
+// チップ目標の進捗API
+// GET /api/livestream/:livestream_id/tip_goal
+func getTipGoalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.Connx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get connection: "+err.Error())
+	}
+	defer tx.Close()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var totalTip int64
+	if err := tx.GetContext(ctx, &totalTip, "SELECT total_tip FROM livestream_stats WHERE livestream_id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream stats: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tipGoalProgress(livestreamModel.TipGoal, totalTip))
+}
+
+func tipGoalProgress(goal, totalTip int64) TipGoalProgress {
+	progress := TipGoalProgress{Goal: goal, TotalTip: totalTip}
+	if goal > 0 {
+		progress.Progress = float64(totalTip) * 100 / float64(goal)
+		progress.Achieved = totalTip >= goal
+	}
+	return progress
+}
+
+// チップ目標の設定API
+// PUT /api/livestream/:livestream_id/tip_goal
+func putTipGoalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	livestreamModel := currentLivestream(c)
+
+	var req *PutTipGoalRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.TipGoal < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tip_goal must not be negative")
+	}
+
+	// 終わった配信の目標は変えられない
+	if err := requireLivestreamOpen(livestreamModel); err != nil {
+		return err
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE livestreams SET tip_goal = ? WHERE id = ?", req.TipGoal, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tip goal: "+err.Error())
+	}
+
+	var totalTip int64
+	if err := dbConn.GetContext(ctx, &totalTip, "SELECT total_tip FROM livestream_stats WHERE livestream_id = ?", livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream stats: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tipGoalProgress(req.TipGoal, totalTip))
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTipGoalProgress(t *testing.T) {
+	assert.Equal(t, TipGoalProgress{Goal: 0, TotalTip: 500}, tipGoalProgress(0, 500))
+	assert.Equal(t, TipGoalProgress{Goal: 2000, TotalTip: 500, Progress: 25}, tipGoalProgress(2000, 500))
+	assert.Equal(t, TipGoalProgress{Goal: 1000, TotalTip: 1500, Progress: 150, Achieved: true}, tipGoalProgress(1000, 1500))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// tipLedgerKindTip はチップの受け取り
+	tipLedgerKindTip = "tip"
+	// tipLedgerKindRefund はモデレーションで非表示になったか、退会で消えたコメントのチップの返金
+	tipLedgerKindRefund = "refund"
+	// tipLedgerKindReversal は非表示を取り消したコメントの返金の取り消し
+	tipLedgerKindReversal = "reversal"
+	// tipLedgerKindPayout は配信者への支払い
+	tipLedgerKindPayout = "payout"
+)
+
+type TipLedgerEntryModel struct {
+	ID         int64  `db:"id"`
+	Kind       string `db:"kind"`
+	StreamerID int64  `db:"streamer_id"`
+	// UserID はチップを送ったユーザ。支払いでは0
+	UserID        int64 `db:"user_id"`
+	LivestreamID  int64 `db:"livestream_id"`
+	LivecommentID int64 `db:"livecomment_id"`
+	Amount        int64 `db:"amount"`
+	CreatedAt     int64 `db:"created_at"`
+}
+
+// appendTipLedger は台帳に追記する。台帳は更新も削除もしない
+func appendTipLedger(ctx context.Context, tx sqlx.ExecerContext, entries []TipLedgerEntryModel) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(entries))
+	args := make([]interface{}, 0, len(entries)*7)
+	for i, entry := range entries {
+		placeholders[i] = "(?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, entry.Kind, entry.StreamerID, entry.UserID, entry.LivestreamID, entry.LivecommentID, entry.Amount, entry.CreatedAt)
+	}
+	query := "INSERT INTO tip_ledger (kind, streamer_id, user_id, livestream_id, livecomment_id, amount, created_at) VALUES " + strings.Join(placeholders, ", ")
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to append tip ledger: %w", err)
+	}
+	return nil
+}
+
+// tipLedgerEntries はライブコメントのチップについて、kind の台帳の行を作る
+// チップのないコメントは飛ばす
+func tipLedgerEntries(kind string, livestreamModel *LivestreamModel, livecommentModels []*LivecommentModel, now int64) []TipLedgerEntryModel {
+	sign := int64(1)
+	if kind == tipLedgerKindRefund {
+		sign = -1
+	}
+	entries := make([]TipLedgerEntryModel, 0, len(livecommentModels))
+	for _, livecommentModel := range livecommentModels {
+		if livecommentModel.Tip <= 0 {
+			continue
+		}
+		entries = append(entries, TipLedgerEntryModel{
+			Kind:          kind,
+			StreamerID:    livestreamModel.UserID,
+			UserID:        livecommentModel.UserID,
+			LivestreamID:  livestreamModel.ID,
+			LivecommentID: livecommentModel.ID,
+			Amount:        sign * livecommentModel.Tip,
+			CreatedAt:     now,
+		})
+	}
+	return entries
+}
+
+// refundDeletedLivecomments は消すライブコメントのうち、表示中のコメントのチップを返金として台帳に残す
+// 台帳はライブコメントが消えても残るので、返金しないと配信者の残高に消えたチップが残る
+// cond は livecomments lc を絞り込む条件
+func refundDeletedLivecomments(ctx context.Context, tx sqlx.ExecerContext, now int64, cond string, args ...interface{}) error {
+	query := `INSERT INTO tip_ledger (kind, streamer_id, user_id, livestream_id, livecomment_id, amount, created_at)
+	SELECT ?, l.user_id, lc.user_id, lc.livestream_id, lc.id, -lc.tip, ?
+	FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id
+	WHERE lc.tip > 0 AND lc.is_deleted = 0 AND ` + cond + " ORDER BY lc.id"
+	if _, err := tx.ExecContext(ctx, query, append([]interface{}{tipLedgerKindRefund, now}, args...)...); err != nil {
+		return fmt.Errorf("failed to refund deleted livecomments: %w", err)
+	}
+	return nil
+}
+
+// rebuildTipLedger は初期データのライブコメントから台帳を作る
+// 非表示のコメントはチップと返金の2行にする
+func rebuildTipLedger(ctx context.Context, tx sqlx.ExecerContext) error {
+	queries := []string{
+		"DELETE FROM tip_ledger",
+		`INSERT INTO tip_ledger (kind, streamer_id, user_id, livestream_id, livecomment_id, amount, created_at)
+		SELECT 'tip', l.user_id, lc.user_id, lc.livestream_id, lc.id, lc.tip, lc.created_at
+		FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.tip > 0 ORDER BY lc.id`,
+		`INSERT INTO tip_ledger (kind, streamer_id, user_id, livestream_id, livecomment_id, amount, created_at)
+		SELECT 'refund', l.user_id, lc.user_id, lc.livestream_id, lc.id, -lc.tip, lc.created_at
+		FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.tip > 0 AND lc.is_deleted = 1 ORDER BY lc.id`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to rebuild tip ledger: %w", err)
+		}
+	}
+	return nil
+}
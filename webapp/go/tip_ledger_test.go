@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTipLedgerEntries(t *testing.T) {
+	livestream := &LivestreamModel{ID: 10, UserID: 3}
+	livecomments := []*LivecommentModel{
+		{ID: 1, UserID: 5, Tip: 500},
+		{ID: 2, UserID: 6, Tip: 0},
+		{ID: 3, UserID: 7, Tip: 100},
+	}
+
+	// チップのないコメントは台帳に載せない。返金は負の額になる
+	refunds := tipLedgerEntries(tipLedgerKindRefund, livestream, livecomments, 1000)
+	require.Len(t, refunds, 2)
+	assert.Equal(t, TipLedgerEntryModel{
+		Kind: tipLedgerKindRefund, StreamerID: 3, UserID: 5, LivestreamID: 10, LivecommentID: 1, Amount: -500, CreatedAt: 1000,
+	}, refunds[0])
+	assert.Equal(t, int64(-100), refunds[1].Amount)
+
+	reversals := tipLedgerEntries(tipLedgerKindReversal, livestream, livecomments[:1], 2000)
+	require.Len(t, reversals, 1)
+	assert.Equal(t, int64(500), reversals[0].Amount)
+}
+
+func TestAddPaymentAmount(t *testing.T) {
+	var b PaymentBreakdown
+	addPaymentAmount(&b, tipLedgerKindTip, 1000)
+	addPaymentAmount(&b, tipLedgerKindTip, 300)
+	addPaymentAmount(&b, tipLedgerKindRefund, -300)
+	addPaymentAmount(&b, tipLedgerKindReversal, 300)
+	addPaymentAmount(&b, tipLedgerKindRefund, -1000)
+	addPaymentAmount(&b, tipLedgerKindPayout, -200)
+
+	assert.Equal(t, PaymentBreakdown{TotalTip: 1300, Refunded: 1000, NetTip: 300, PaidOut: 200, Balance: 100}, b)
+}
+
+func TestPaymentPeriodStart(t *testing.T) {
+	// 2023-11-29 (水)
+	day := time.Date(2023, 11, 29, 0, 0, 0, 0, time.UTC).Unix()
+
+	assert.Equal(t, day, paymentPeriodStart(paymentPeriodDay, day))
+	assert.Equal(t, time.Date(2023, 11, 27, 0, 0, 0, 0, time.UTC).Unix(), paymentPeriodStart(paymentPeriodWeek, day))
+	assert.Equal(t, time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC).Unix(), paymentPeriodStart(paymentPeriodMonth, day))
+	assert.Equal(t, int64(0), paymentPeriodStart(paymentPeriodAll, day))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 送れるチップの額 (カンマ区切り)。未設定なら MaxTip 以下の正の額をすべて受け付ける
+	tipTiersEnvKey = "ISUCON13_TIP_TIERS"
+	// 0 なら大きなチップが続いても保留しない
+	tipVelocityHoldEnvKey = "ISUCON13_TIP_VELOCITY_HOLD"
+)
+
+const (
+	heldTipReasonVelocity = "velocity"
+
+	heldTipStatusPending  = "pending"
+	heldTipStatusApproved = "approved"
+	heldTipStatusRejected = "rejected"
+)
+
+type TipPolicy struct {
+	// Tiers は送れるチップの額。空なら MaxTip 以下の正の額を受け付ける
+	Tiers  []int64
+	MaxTip int64
+	// DailyCap はユーザが1日 (UTC) に送れるチップの合計
+	DailyCap int64
+	// StreamCap はユーザが1つの配信に送れるチップの合計
+	StreamCap int64
+	// BigTip 以上のチップを VelocityWindow 秒のうちに VelocityCount 回送ったユーザの次のチップは保留する
+	// VelocityCount が0なら保留しない
+	BigTip         int64
+	VelocityWindow int64
+	VelocityCount  int64
+}
+
+// 既定ではベンチマーカーが送る額 (pretest の0〜9から最大100000まで) をすべて通す
+var tipPolicy = TipPolicy{
+	MaxTip:         100000,
+	DailyCap:       1_000_000,
+	StreamCap:      500_000,
+	BigTip:         20000,
+	VelocityWindow: 60,
+	VelocityCount:  3,
+}
+
+// TipUsage はチップを送るユーザのこれまでの状況。保留中のチップも含める
+type TipUsage struct {
+	DailyTotal    int64 `db:"daily_total"`
+	StreamTotal   int64 `db:"stream_total"`
+	RecentBigTips int64 `db:"recent_big_tips"`
+}
+
+func loadTipTiers(v string) ([]int64, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var tiers []int64
+	for _, s := range strings.Split(v, ",") {
+		tier, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || tier <= 0 {
+			return nil, fmt.Errorf("invalid tip tier %q", s)
+		}
+		tiers = append(tiers, tier)
+	}
+	slices.Sort(tiers)
+	return tiers, nil
+}
+
+// Check はチップを送ってよいかを判定する。送れないならエラー、保留にするなら hold を返す
+func (p TipPolicy) Check(tip int64, self bool, usage TipUsage) (hold bool, err error) {
+	if tip < 0 {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "tip must not be negative")
+	}
+	if tip == 0 {
+		return false, nil
+	}
+	if self {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "cannot tip on your own livestream")
+	}
+	if len(p.Tiers) > 0 && !slices.Contains(p.Tiers, tip) {
+		return false, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tip must be one of %v", p.Tiers))
+	}
+	if len(p.Tiers) == 0 && tip > p.MaxTip {
+		return false, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tip must be at most %d", p.MaxTip))
+	}
+	if usage.DailyTotal+tip > p.DailyCap {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "daily tip limit exceeded")
+	}
+	if usage.StreamTotal+tip > p.StreamCap {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "tip limit for this livestream exceeded")
+	}
+	return p.VelocityCount > 0 && tip >= p.BigTip && usage.RecentBigTips >= p.VelocityCount, nil
+}
+
+// lockTipper はチップを送るユーザの行をロックして、同じユーザのチップを1つずつ処理させる
+// 上限の判定が古いスナップショットを読まないよう、トランザクションの最初に呼ぶ
+func lockTipper(ctx context.Context, tx sqlx.QueryerContext, userID int64) error {
+	var id int64
+	if err := sqlx.GetContext(ctx, tx, &id, "SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return fmt.Errorf("failed to lock user: %w", err)
+	}
+	return nil
+}
+
+// loadTipUsage はユーザが今日と配信に送ったチップと、直近の大きなチップの回数を数える
+// 保留中のチップは livecomments にまだ載っていないので held_tips から足す (承認済みは livecomments に載っている)
+func loadTipUsage(ctx context.Context, tx sqlx.QueryerContext, p TipPolicy, userID, livestreamID int64, now time.Time) (TipUsage, error) {
+	dayStart := rankingWindowStart(rankingWindowDaily, now)
+	recentStart := now.Unix() - p.VelocityWindow
+
+	var usage TipUsage
+	if err := sqlx.GetContext(ctx, tx, &usage, `SELECT
+	(SELECT COALESCE(SUM(tip), 0) FROM livecomments WHERE user_id = ? AND created_at >= ?)
+	+ (SELECT COALESCE(SUM(amount), 0) FROM held_tips WHERE user_id = ? AND status = ? AND created_at >= ?) AS daily_total,
+	(SELECT COALESCE(SUM(tip), 0) FROM livecomments WHERE user_id = ? AND livestream_id = ?)
+	+ (SELECT COALESCE(SUM(amount), 0) FROM held_tips WHERE user_id = ? AND livestream_id = ? AND status = ?) AS stream_total,
+	(SELECT COUNT(*) FROM livecomments WHERE user_id = ? AND created_at >= ? AND tip >= ?)
+	+ (SELECT COUNT(*) FROM held_tips WHERE user_id = ? AND created_at >= ? AND amount >= ? AND status <> ?) AS recent_big_tips`,
+		userID, dayStart, userID, heldTipStatusPending, dayStart,
+		userID, livestreamID, userID, livestreamID, heldTipStatusPending,
+		userID, recentStart, p.BigTip, userID, recentStart, p.BigTip, heldTipStatusApproved,
+	); err != nil {
+		return TipUsage{}, fmt.Errorf("failed to get tip usage: %w", err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTipPolicyCheck(t *testing.T) {
+	p := TipPolicy{
+		Tiers:          []int64{100, 1000, 10000},
+		DailyCap:       20000,
+		StreamCap:      15000,
+		BigTip:         10000,
+		VelocityWindow: 60,
+		VelocityCount:  2,
+	}
+
+	rejected := []struct {
+		name  string
+		tip   int64
+		self  bool
+		usage TipUsage
+	}{
+		{name: "negative", tip: -100},
+		{name: "self tip", tip: 100, self: true},
+		{name: "not in tiers", tip: 500},
+		{name: "daily cap", tip: 1000, usage: TipUsage{DailyTotal: 19500}},
+		{name: "stream cap", tip: 1000, usage: TipUsage{DailyTotal: 14500, StreamTotal: 14500}},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Check(tt.tip, tt.self, tt.usage)
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, err, &httpErr)
+			assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+		})
+	}
+
+	// チップなしのコメントは自分の配信でもよい
+	hold, err := p.Check(0, true, TipUsage{})
+	require.NoError(t, err)
+	assert.False(t, hold)
+
+	// ちょうど上限までは送れる
+	hold, err = p.Check(1000, false, TipUsage{DailyTotal: 19000, StreamTotal: 14000})
+	require.NoError(t, err)
+	assert.False(t, hold)
+
+	// 大きなチップが続くと保留。小さなチップは保留しない
+	hold, err = p.Check(10000, false, TipUsage{RecentBigTips: 1})
+	require.NoError(t, err)
+	assert.False(t, hold)
+	hold, err = p.Check(10000, false, TipUsage{RecentBigTips: 2})
+	require.NoError(t, err)
+	assert.True(t, hold)
+	hold, err = p.Check(1000, false, TipUsage{RecentBigTips: 2})
+	require.NoError(t, err)
+	assert.False(t, hold)
+
+	// VelocityCount が0なら保留しない
+	p.VelocityCount = 0
+	hold, err = p.Check(10000, false, TipUsage{RecentBigTips: 5})
+	require.NoError(t, err)
+	assert.False(t, hold)
+}
+
+func TestTipPolicyCheckWithoutTiers(t *testing.T) {
+	p := tipPolicy
+
+	// ベンチマーカーの pretest は0〜9のチップを送る
+	hold, err := p.Check(5, false, TipUsage{})
+	require.NoError(t, err)
+	assert.False(t, hold)
+	_, err = p.Check(p.MaxTip, false, TipUsage{})
+	require.NoError(t, err)
+
+	_, err = p.Check(p.MaxTip+1, false, TipUsage{})
+	var httpErr *echo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+}
+
+func TestLoadTipTiers(t *testing.T) {
+	tiers, err := loadTipTiers("")
+	require.NoError(t, err)
+	assert.Empty(t, tiers)
+
+	tiers, err = loadTipTiers(" 500, 100 ,1000")
+	require.NoError(t, err)
+	assert.Equal(t, []int64{100, 500, 1000}, tiers)
+
+	_, err = loadTipTiers("100,abc")
+	assert.Error(t, err)
+	_, err = loadTipTiers("100,0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	personalAccessTokenPrefix = "isupipe_"
+
+	scopeLivecommentRead  = "livecomment:read"
+	scopeLivecommentWrite = "livecomment:write"
+	scopeModerate         = "moderate"
+
+	personalAccessTokenDefaultTTL = 90 * 24 * time.Hour
+	personalAccessTokenMaxTTL     = 365 * 24 * time.Hour
+	// last_used_at の更新はこの間隔に1回まで
+	personalAccessTokenTouchInterval = 60
+)
+
+var personalAccessTokenScopes = map[string]struct{}{
+	scopeLivecommentRead:  {},
+	scopeLivecommentWrite: {},
+	scopeModerate:         {},
+}
+
+type PersonalAccessTokenModel struct {
+	ID         int64  `db:"id"`
+	UserID     int64  `db:"user_id"`
+	Name       string `db:"name"`
+	TokenHash  string `db:"token_hash"`
+	Scopes     string `db:"scopes"`
+	ExpiresAt  int64  `db:"expires_at"`
+	RevokedAt  int64  `db:"revoked_at"`
+	LastUsedAt int64  `db:"last_used_at"`
+	CreatedAt  int64  `db:"created_at"`
+}
+
+type PersonalAccessToken struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  int64    `json:"expires_at"`
+	Revoked    bool     `json:"revoked"`
+	LastUsedAt int64    `json:"last_used_at"`
+	CreatedAt  int64    `json:"created_at"`
+	// Token は作成時のレスポンスにだけ含める
+	Token string `json:"token,omitempty"`
+}
+
+type PostPersonalAccessTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn は有効期間(秒)。0ならデフォルト
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func (m *PersonalAccessTokenModel) ScopeList() []string {
+	if m.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(m.Scopes, ",")
+}
+
+func (m *PersonalAccessTokenModel) HasScope(scope string) bool {
+	for _, s := range m.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func fillPersonalAccessTokenResponse(tokenModel PersonalAccessTokenModel) PersonalAccessToken {
+	return PersonalAccessToken{
+		ID:         tokenModel.ID,
+		Name:       tokenModel.Name,
+		Scopes:     tokenModel.ScopeList(),
+		ExpiresAt:  tokenModel.ExpiresAt,
+		Revoked:    tokenModel.RevokedAt != 0,
+		LastUsedAt: tokenModel.LastUsedAt,
+		CreatedAt:  tokenModel.CreatedAt,
+	}
+}
+
+func hashPersonalAccessToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func generatePersonalAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return personalAccessTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// トークン作成API
+// POST /api/user/me/tokens
+func postPersonalAccessTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := currentUser(c).ID
+
+	var req *PostPersonalAccessTokenRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if len(req.Scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one scope is required")
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := personalAccessTokenScopes[scope]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown scope: "+scope)
+		}
+	}
+	ttl := personalAccessTokenDefaultTTL
+	if req.ExpiresIn < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_in must be positive")
+	}
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > personalAccessTokenMaxTTL {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_in is too long")
+	}
+
+	token, err := generatePersonalAccessToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate token: "+err.Error())
+	}
+
+	now := time.Now()
+	tokenModel := PersonalAccessTokenModel{
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: hashPersonalAccessToken(token),
+		Scopes:    strings.Join(req.Scopes, ","),
+		ExpiresAt: now.Add(ttl).Unix(),
+		CreatedAt: now.Unix(),
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at, created_at) VALUES (:user_id, :name, :token_hash, :scopes, :expires_at, :created_at)", &tokenModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert token: "+err.Error())
+	}
+	tokenID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted token id: "+err.Error())
+	}
+	tokenModel.ID = tokenID
+
+	res := fillPersonalAccessTokenResponse(tokenModel)
+	res.Token = token
+	return c.JSON(http.StatusCreated, res)
+}
+
+// トークン一覧API
+// GET /api/user/me/tokens
+func getPersonalAccessTokensHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	var tokenModels []PersonalAccessTokenModel
+	if err := dbConn.SelectContext(ctx, &tokenModels, "SELECT * FROM personal_access_tokens WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tokens: "+err.Error())
+	}
+
+	tokens := make([]PersonalAccessToken, len(tokenModels))
+	for i := range tokenModels {
+		tokens[i] = fillPersonalAccessTokenResponse(tokenModels[i])
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// トークン失効API
+// DELETE /api/user/me/tokens/:token_id
+func deletePersonalAccessTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	tokenID, err := strconv.ParseInt(c.Param("token_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "token_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE personal_access_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at = 0", time.Now().Unix(), tokenID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke token: "+err.Error())
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "token not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// findPersonalAccessToken は有効なトークンを探す。無効なら401を返す
+func findPersonalAccessToken(ctx context.Context, token string, now time.Time) (*PersonalAccessTokenModel, error) {
+	var tokenModel PersonalAccessTokenModel
+	if err := dbConn.GetContext(ctx, &tokenModel, "SELECT * FROM personal_access_tokens WHERE token_hash = ?", hashPersonalAccessToken(token)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get token: "+err.Error())
+	}
+	if tokenModel.RevokedAt != 0 {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "token has been revoked")
+	}
+	if now.Unix() > tokenModel.ExpiresAt {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "token has expired")
+	}
+
+	if now.Unix()-tokenModel.LastUsedAt > personalAccessTokenTouchInterval {
+		if _, err := dbConn.ExecContext(ctx, "UPDATE personal_access_tokens SET last_used_at = ? WHERE id = ?", now.Unix(), tokenModel.ID); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to update token: "+err.Error())
+		}
+		tokenModel.LastUsedAt = now.Unix()
+	}
+	return &tokenModel, nil
+}
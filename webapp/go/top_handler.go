@@ -49,12 +49,7 @@ func getTagHandler(c echo.Context) error {
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
 func getStreamerThemeHandler(c echo.Context) error {
-	userID, err := verifyUserSessionWithUserID(c)
-	if err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		c.Logger().Printf("verifyUserSession: %+v\n", err)
-		return err
-	}
+	userID := currentUser(c).ID
 
 	darkmode := themeCache.Get(userID)
 
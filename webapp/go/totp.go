@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const totpIssuer = "ISUPipe"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP は RFC 6238 のワンタイムパスワード (HMAC-SHA1)
+type TOTP struct {
+	Digits int
+	Period int64
+	// Skew は前後に許容するタイムステップ数
+	Skew int64
+}
+
+var defaultTOTP = TOTP{
+	Digits: 6,
+	Period: 30,
+	Skew:   1,
+}
+
+// totpClock はテストで時刻を固定するために差し替える
+var totpClock = time.Now
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+func (t TOTP) Step(at time.Time) int64 {
+	return at.Unix() / t.Period
+}
+
+// CodeAt は RFC 4226 のHOTPをタイムステップに対して計算する
+func (t TOTP) CodeAt(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < t.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", t.Digits, value%mod)
+}
+
+func (t TOTP) Code(key []byte, at time.Time) string {
+	return t.CodeAt(key, t.Step(at))
+}
+
+// Verify はコードが一致したタイムステップを返す
+// lastUsedStep 以前のステップは再利用とみなして受け付けない
+func (t TOTP) Verify(key []byte, code string, now time.Time, lastUsedStep int64) (int64, bool) {
+	if len(code) != t.Digits {
+		return 0, false
+	}
+	current := t.Step(now)
+	for step := current - t.Skew; step <= current+t.Skew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.CodeAt(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI は認証アプリに読み込ませる otpauth:// のURI
+func (t TOTP) ProvisioningURI(secret, accountName string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(t.Digits))
+	v.Set("period", fmt.Sprint(t.Period))
+	label := url.PathEscape(totpIssuer + ":" + accountName)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 Appendix B のテストベクタ (SHA1)
+func TestTOTPRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	totp := TOTP{Digits: 8, Period: 30, Skew: 1}
+
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		assert.Equal(t, v.code, totp.Code(key, time.Unix(v.unix, 0)), "unix=%d", v.unix)
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	secret, err := newTOTPSecret()
+	assert.NoError(t, err)
+	key, err := decodeTOTPSecret(secret)
+	assert.NoError(t, err)
+
+	now := time.Date(2023, 11, 25, 10, 0, 15, 0, time.UTC)
+	code := defaultTOTP.Code(key, now)
+
+	step, ok := defaultTOTP.Verify(key, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, defaultTOTP.Step(now), step)
+
+	// 前後1ステップのずれは許容する
+	_, ok = defaultTOTP.Verify(key, code, now.Add(30*time.Second), 0)
+	assert.True(t, ok)
+	_, ok = defaultTOTP.Verify(key, code, now.Add(90*time.Second), 0)
+	assert.False(t, ok)
+
+	// 一度使ったコードは受け付けない
+	_, ok = defaultTOTP.Verify(key, code, now, step)
+	assert.False(t, ok)
+
+	_, ok = defaultTOTP.Verify(key, "12345", now, 0)
+	assert.False(t, ok)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := defaultTOTP.ProvisioningURI("JBSWY3DPEHPK3PXP", "alice")
+	assert.Equal(t, "otpauth://totp/ISUPipe:alice?algorithm=SHA1&digits=6&issuer=ISUPipe&period=30&secret=JBSWY3DPEHPK3PXP", uri)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPendingTwoFactorUserIDKey  = "PENDING_2FA_USERID"
+	defaultPendingTwoFactorExpiresKey = "PENDING_2FA_EXPIRES"
+
+	twoFactorLoginTTL     = 5 * time.Minute
+	recoveryCodeCount     = 10
+	totpMaxFailedAttempts = 5
+	totpLockDuration      = 5 * time.Minute
+)
+
+type UserTOTPModel struct {
+	UserID         int64  `db:"user_id"`
+	Secret         string `db:"secret"`
+	Enabled        bool   `db:"enabled"`
+	LastUsedStep   int64  `db:"last_used_step"`
+	FailedAttempts int64  `db:"failed_attempts"`
+	LockedUntil    int64  `db:"locked_until"`
+	CreatedAt      int64  `db:"created_at"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret          string   `json:"secret"`
+	ProvisioningURI string   `json:"provisioning_uri"`
+	RecoveryCodes   []string `json:"recovery_codes"`
+}
+
+type VerifyTwoFactorRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func isTOTPEnabled(ctx context.Context, userID int64) (bool, error) {
+	var enabled bool
+	if err := dbConn.GetContext(ctx, &enabled, "SELECT enabled FROM user_totp WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return enabled, nil
+}
+
+// startTwoFactorLogin はパスワード確認だけが済んだ状態をセッションに記録する
+func startTwoFactorLogin(c echo.Context, userID int64) error {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+
+	sess.Options = &sessions.Options{
+		Domain: "u.isucon.dev",
+		MaxAge: int(twoFactorLoginTTL.Seconds()),
+		Path:   "/",
+	}
+	// 以前のログイン状態は引き継がない
+	delete(sess.Values, defaultSessionIDKey)
+	delete(sess.Values, defaultUserIDKey)
+	delete(sess.Values, defaultUsernameKey)
+	delete(sess.Values, defaultSessionExpiresKey)
+	sess.Values[defaultPendingTwoFactorUserIDKey] = userID
+	sess.Values[defaultPendingTwoFactorExpiresKey] = time.Now().Add(twoFactorLoginTTL).Unix()
+
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+	return nil
+}
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// hashRecoveryCode は入力の揺れ (大文字小文字、区切り) を吸収してからハッシュする
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(normalized)))
+}
+
+// 二要素認証の登録API
+// POST /api/user/me/2fa/enroll
+func enrollTwoFactorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userModel := currentUser(c)
+	userID := userModel.ID
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var totpModel UserTOTPModel
+	err = tx.GetContext(ctx, &totpModel, "SELECT * FROM user_totp WHERE user_id = ? FOR UPDATE", userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get 2fa setting: "+err.Error())
+	}
+	if totpModel.Enabled {
+		return echo.NewHTTPError(http.StatusConflict, "2fa is already enabled")
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate secret: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_totp (user_id, secret, enabled, created_at) VALUES (?, ?, FALSE, ?) ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled = FALSE, last_used_step = 0, failed_attempts = 0, locked_until = 0, created_at = VALUES(created_at)", userID, secret, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert 2fa setting: "+err.Error())
+	}
+
+	recoveryCodes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create recovery codes: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, TwoFactorEnrollment{
+		Secret:          secret,
+		ProvisioningURI: defaultTOTP.ProvisioningURI(secret, userModel.Name),
+		RecoveryCodes:   recoveryCodes,
+	})
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID int64) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(code)); err != nil {
+			return nil, fmt.Errorf("failed to insert recovery code: %w", err)
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// 二要素認証の有効化API
+// POST /api/user/me/2fa/verify
+func verifyTwoFactorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := currentUser(c).ID
+
+	var req *VerifyTwoFactorRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var totpModel UserTOTPModel
+	if err := tx.GetContext(ctx, &totpModel, "SELECT * FROM user_totp WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "2fa is not enrolled")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get 2fa setting: "+err.Error())
+	}
+	if totpModel.Enabled {
+		return echo.NewHTTPError(http.StatusConflict, "2fa is already enabled")
+	}
+
+	key, err := decodeTOTPSecret(totpModel.Secret)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode secret: "+err.Error())
+	}
+	step, ok := defaultTOTP.Verify(key, req.Code, totpClock(), totpModel.LastUsedStep)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid code")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET enabled = TRUE, last_used_step = ? WHERE user_id = ?", step, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enable 2fa: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 二要素認証のログインAPI (2段階目)
+// POST /api/login/2fa
+func twoFactorLoginHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	req := TwoFactorLoginRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "code or recovery_code is required")
+	}
+
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+	userID, ok := sess.Values[defaultPendingTwoFactorUserIDKey].(int64)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "no pending 2fa login")
+	}
+	expiresAt, ok := sess.Values[defaultPendingTwoFactorExpiresKey].(int64)
+	now := totpClock()
+	if !ok || now.Unix() > expiresAt {
+		return echo.NewHTTPError(http.StatusUnauthorized, "pending 2fa login has expired")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var totpModel UserTOTPModel
+	if err := tx.GetContext(ctx, &totpModel, "SELECT * FROM user_totp WHERE user_id = ? AND enabled = TRUE FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "2fa is not enabled")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get 2fa setting: "+err.Error())
+	}
+	if now.Unix() < totpModel.LockedUntil {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed attempts")
+	}
+
+	verified := false
+	if req.Code != "" {
+		key, err := decodeTOTPSecret(totpModel.Secret)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode secret: "+err.Error())
+		}
+		if step, ok := defaultTOTP.Verify(key, req.Code, now, totpModel.LastUsedStep); ok {
+			if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET last_used_step = ? WHERE user_id = ?", step, userID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update 2fa setting: "+err.Error())
+			}
+			verified = true
+		}
+	} else {
+		rs, err := tx.ExecContext(ctx, "UPDATE user_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at = 0", now.Unix(), userID, hashRecoveryCode(req.RecoveryCode))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to use recovery code: "+err.Error())
+		}
+		rowsAffected, err := rs.RowsAffected()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		}
+		verified = rowsAffected > 0
+	}
+
+	if !verified {
+		// 失敗回数が上限に達したらしばらくロックする
+		failedAttempts := totpModel.FailedAttempts + 1
+		lockedUntil := totpModel.LockedUntil
+		if failedAttempts >= totpMaxFailedAttempts {
+			failedAttempts = 0
+			lockedUntil = now.Add(totpLockDuration).Unix()
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET failed_attempts = ?, locked_until = ? WHERE user_id = ?", failedAttempts, lockedUntil, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update 2fa setting: "+err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid code")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET failed_attempts = 0 WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update 2fa setting: "+err.Error())
+	}
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := issueUserSession(c, userModel); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
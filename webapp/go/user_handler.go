@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"sync"
 	"time"
 
@@ -46,6 +45,10 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// FollowerCount はこのユーザをフォローしているユーザ数
+	FollowerCount int64 `json:"follower_count"`
+	// FollowingCount はこのユーザがフォローしているユーザ数
+	FollowingCount int64 `json:"following_count"`
 }
 
 type Theme struct {
@@ -78,6 +81,11 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type LoginResponse struct {
+	// TwoFactorRequired がtrueなら POST /api/login/2fa でログインを完了させる
+	TwoFactorRequired bool `json:"two_factor_required"`
+}
+
 type PostIconRequest struct {
 	Image []byte `json:"image"`
 }
@@ -126,6 +134,13 @@ func (c *IconHashCache) Set(username string, iconHash string) {
 	}
 }
 
+func (c *IconHashCache) Delete(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, username)
+}
+
 var iconHashCache = &IconHashCache{
 	mu:  new(sync.RWMutex),
 	m:   make(map[string]*IconHash, 1000),
@@ -133,6 +148,49 @@ var iconHashCache = &IconHashCache{
 	// ttl: 1000 * time.Millisecond,
 }
 
+// UserCache はIDからユーザを引くキャッシュ。認証のたびにusersを引かないようにする
+type UserCache struct {
+	mu *sync.RWMutex
+	m  map[int64]*UserModel
+}
+
+// Get はキャッシュになければDBから読み込む。ユーザが存在しなければ sql.ErrNoRows を返す
+func (c *UserCache) Get(ctx context.Context, userID int64) (*UserModel, error) {
+	c.mu.RLock()
+	userModel, ok := c.m[userID]
+	c.mu.RUnlock()
+	if ok {
+		return userModel, nil
+	}
+
+	userModel = &UserModel{}
+	if err := dbConn.GetContext(ctx, userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[userID] = userModel
+	return userModel, nil
+}
+
+func (c *UserCache) Delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, userID)
+}
+
+func (c *UserCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[int64]*UserModel, 1000)
+}
+
+var userCache = &UserCache{
+	mu: new(sync.RWMutex),
+	m:  make(map[int64]*UserModel, 1000),
+}
+
 func getIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -193,15 +251,8 @@ func iconFilePath(userID int64) string {
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	user := currentUser(c)
+	userID := user.ID
 
 	var req *PostIconRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -213,7 +264,7 @@ func postIconHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to write icon file: "+err.Error())
 	}
-	iconHashCache.Set(sess.Values[defaultUsernameKey].(string), getIconHash(req.Image))
+	iconHashCache.Set(user.Name, getIconHash(req.Image))
 
 	// tx, err := dbConn.BeginTxx(ctx, nil)
 	// if err != nil {
@@ -261,16 +312,6 @@ func postIconHandler(c echo.Context) error {
 func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	// tx, err := dbConn.BeginTxx(ctx, nil)
 	// if err != nil {
 	// 	return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -282,16 +323,7 @@ func getMeHandler(c echo.Context) error {
 	}
 	defer tx.Close()
 
-	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
-	}
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-	}
-
-	user, err := fillUserResponse(ctx, tx, userModel)
+	user, err := fillUserResponse(ctx, tx, *currentUser(c))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
@@ -348,11 +380,11 @@ func registerHandler(c echo.Context) error {
 
 	userModel.ID = userID
 
-	if out, err := exec.Command("pdnsutil", "add-record", "u.isucon.dev", req.Name, "A", "0", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
-	}
+	createDNSRecordWithRetry(ctx, c.Logger(), req.Name, powerDNSSubdomainAddress)
+	registerDNSName(req.Name)
 
 	themeCache.Set(userID, req.Theme.DarkMode)
+	statsRankings.AddUser(req.Name)
 
 	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
@@ -401,27 +433,20 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
-
-	sessionID := uuid.NewString()
-
-	sess, err := session.Get(defaultSessionIDKey, c)
+	// 二要素認証が有効なら、2段階目が済むまでセッションは発行しない
+	totpEnabled, err := isTOTPEnabled(ctx, userModel.ID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get 2fa setting: "+err.Error())
 	}
-
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.dev",
-		MaxAge: int(60000),
-		Path:   "/",
+	if totpEnabled {
+		if err := startTwoFactorLogin(c, userModel.ID); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusAccepted, LoginResponse{TwoFactorRequired: true})
 	}
-	sess.Values[defaultSessionIDKey] = sessionID
-	sess.Values[defaultUserIDKey] = userModel.ID
-	sess.Values[defaultUsernameKey] = userModel.Name
-	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
 
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	if err := issueUserSession(c, userModel); err != nil {
+		return err
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -431,11 +456,6 @@ func loginHandler(c echo.Context) error {
 // GET /api/user/:username
 func getUserHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
 	username := c.Param("username")
 
 	tx, err := dbConn.Connx(ctx)
@@ -460,52 +480,34 @@ func getUserHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
-func verifyUserSession(c echo.Context) error {
-	sess, err := session.Get(defaultSessionIDKey, c)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
-	}
-
-	sessionExpires, ok := sess.Values[defaultSessionExpiresKey]
-	if !ok {
-		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
-	}
-
-	_, ok = sess.Values[defaultUserIDKey].(int64)
-	if !ok {
-		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
-	}
-
-	now := time.Now()
-	if now.Unix() > sessionExpires.(int64) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
-	}
+// issueUserSession はログイン済みのセッションを発行する
+func issueUserSession(c echo.Context, userModel UserModel) error {
+	sessionEndAt := time.Now().Add(1 * time.Hour)
 
-	return nil
-}
+	sessionID := uuid.NewString()
 
-func verifyUserSessionWithUserID(c echo.Context) (int64, error) {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
-		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
-	}
-
-	sessionExpires, ok := sess.Values[defaultSessionExpiresKey]
-	if !ok {
-		return 0, echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	userID, ok := sess.Values[defaultUserIDKey].(int64)
-	if !ok {
-		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
+	sess.Options = &sessions.Options{
+		Domain: "u.isucon.dev",
+		MaxAge: int(60000),
+		Path:   "/",
 	}
+	sess.Values[defaultSessionIDKey] = sessionID
+	sess.Values[defaultUserIDKey] = userModel.ID
+	sess.Values[defaultUsernameKey] = userModel.Name
+	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
+	delete(sess.Values, defaultPendingTwoFactorUserIDKey)
+	delete(sess.Values, defaultPendingTwoFactorExpiresKey)
 
-	now := time.Now()
-	if now.Unix() > sessionExpires.(int64) {
-		return 0, echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
 
-	return userID, nil
+	return nil
 }
 
 func fillUserResponses(ctx context.Context, tx *sqlx.Conn, userModels []UserModel) ([]User, error) {
@@ -576,6 +578,8 @@ func fillUserResponses(ctx context.Context, tx *sqlx.Conn, userModels []UserMode
 			iconHash = fallbackImageHash
 		}
 
+		followerCount, followingCount := followCountCache.Get(userModel.ID)
+
 		// Userの生成
 		users[i] = User{
 			ID:          userModel.ID,
@@ -586,7 +590,9 @@ func fillUserResponses(ctx context.Context, tx *sqlx.Conn, userModels []UserMode
 				ID:       userModel.ID,
 				DarkMode: themeCache.Get(userModel.ID),
 			},
-			IconHash: iconHash,
+			IconHash:       iconHash,
+			FollowerCount:  followerCount,
+			FollowingCount: followingCount,
 		}
 	}
 
@@ -607,6 +613,8 @@ func fillUserResponse(ctx context.Context, tx SqlxConn, userModel UserModel) (Us
 	iconHash := getIconHash(image)
 	iconHashCache.Set(userModel.Name, iconHash)
 
+	followerCount, followingCount := followCountCache.Get(userModel.ID)
+
 	user := User{
 		ID:          userModel.ID,
 		Name:        userModel.Name,
@@ -616,7 +624,9 @@ func fillUserResponse(ctx context.Context, tx SqlxConn, userModel UserModel) (Us
 			ID:       userModel.ID,
 			DarkMode: themeCache.Get(userModel.ID),
 		},
-		IconHash: iconHash,
+		IconHash:       iconHash,
+		FollowerCount:  followerCount,
+		FollowingCount: followingCount,
 	}
 
 	return user, nil
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// この時間ハートビートがなければ視聴をやめたとみなす
+	viewerPresenceTTL = 60 * time.Second
+	// クライアントに送ってほしいハートビートの間隔
+	viewerHeartbeatInterval = 20 * time.Second
+)
+
+type LivestreamViewerStatsModel struct {
+	LivestreamID  int64 `db:"livestream_id"`
+	PeakViewers   int64 `db:"peak_viewers"`
+	PeakAt        int64 `db:"peak_at"`
+	UniqueViewers int64 `db:"unique_viewers"`
+}
+
+type LivestreamViewers struct {
+	// CurrentViewers はいま視聴しているユーザ数
+	CurrentViewers int64 `json:"current_viewers"`
+	PeakViewers    int64 `json:"peak_viewers"`
+	PeakAt         int64 `json:"peak_at"`
+	UniqueViewers  int64 `json:"unique_viewers"`
+}
+
+type HeartbeatResponse struct {
+	CurrentViewers int64 `json:"current_viewers"`
+	// NextHeartbeatIn は次のハートビートまでの秒数
+	NextHeartbeatIn int64 `json:"next_heartbeat_in"`
+}
+
+// ViewerPresence は配信ごとの視聴中のユーザと最終ハートビート時刻を保持する
+type ViewerPresence struct {
+	mu  *sync.Mutex
+	ttl time.Duration
+	// livestreamID -> userID -> 最終ハートビート時刻
+	m map[int64]map[int64]time.Time
+	// livestreamID -> DBに書いた同時視聴者数の最大値
+	peaks map[int64]int64
+}
+
+var viewerPresence = &ViewerPresence{
+	mu:    new(sync.Mutex),
+	ttl:   viewerPresenceTTL,
+	m:     make(map[int64]map[int64]time.Time, 1000),
+	peaks: make(map[int64]int64, 1000),
+}
+
+// Touch は視聴を記録し、現在の視聴者数と最大値を更新すべきかを返す
+// 最大値はDBに書けてから RaisePeak で上げる
+func (p *ViewerPresence) Touch(livestreamID, userID int64, now time.Time) (count int64, newPeak bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	viewers, ok := p.m[livestreamID]
+	if !ok {
+		viewers = make(map[int64]time.Time)
+		p.m[livestreamID] = viewers
+	}
+	viewers[userID] = now
+	count = p.prune(livestreamID, now)
+
+	return count, count > p.peaks[livestreamID]
+}
+
+// RaisePeak はDBに書いた最大値を記録する
+func (p *ViewerPresence) RaisePeak(livestreamID, count int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peaks[livestreamID] = max(p.peaks[livestreamID], count)
+}
+
+func (p *ViewerPresence) Leave(livestreamID, userID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if viewers, ok := p.m[livestreamID]; ok {
+		delete(viewers, userID)
+	}
+}
+
+func (p *ViewerPresence) Count(livestreamID int64, now time.Time) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.prune(livestreamID, now)
+}
+
+// prune は期限切れの視聴者を消して残りの人数を返す。ロックを取ってから呼ぶ
+func (p *ViewerPresence) prune(livestreamID int64, now time.Time) int64 {
+	viewers, ok := p.m[livestreamID]
+	if !ok {
+		return 0
+	}
+	for userID, lastSeen := range viewers {
+		if now.Sub(lastSeen) >= p.ttl {
+			delete(viewers, userID)
+		}
+	}
+	if len(viewers) == 0 {
+		delete(p.m, livestreamID)
+	}
+	return int64(len(viewers))
+}
+
+func (p *ViewerPresence) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.m = make(map[int64]map[int64]time.Time, 1000)
+	p.peaks = make(map[int64]int64, 1000)
+}
+
+// Run は誰もアクセスしなくなった配信の視聴者を定期的に消す
+func (p *ViewerPresence) Run(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(p.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			for livestreamID := range p.m {
+				p.prune(livestreamID, now)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// recordViewerPeak は同時視聴者数の最大値を更新する
+func recordViewerPeak(ctx context.Context, tx sqlx.ExecerContext, livestreamID, count int64, now int64) error {
+	// peak_at を先に更新しないと、比較する peak_viewers が新しい値になってしまう
+	if _, err := tx.ExecContext(ctx, `INSERT INTO livestream_viewer_stats (livestream_id, peak_viewers, peak_at) VALUES (?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		peak_at = IF(VALUES(peak_viewers) > peak_viewers, VALUES(peak_at), peak_at),
+		peak_viewers = GREATEST(peak_viewers, VALUES(peak_viewers))`, livestreamID, count, now); err != nil {
+		return fmt.Errorf("failed to update peak viewers: %w", err)
+	}
+	return nil
+}
+
+// recordUniqueViewer は初めて視聴したユーザならユニーク視聴者数を増やす
+func recordUniqueViewer(ctx context.Context, tx sqlx.ExecerContext, livestreamID, userID int64, now int64) error {
+	rs, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livestream_unique_viewers (livestream_id, user_id, created_at) VALUES (?, ?, ?)", livestreamID, userID, now)
+	if err != nil {
+		return fmt.Errorf("failed to insert unique viewer: %w", err)
+	}
+	if rowsAffected, _ := rs.RowsAffected(); rowsAffected == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_viewer_stats (livestream_id, unique_viewers) VALUES (?, 1) ON DUPLICATE KEY UPDATE unique_viewers = unique_viewers + 1", livestreamID); err != nil {
+		return fmt.Errorf("failed to update unique viewers: %w", err)
+	}
+	return nil
+}
+
+// touchViewerPresence は視聴中として記録し、最大値を超えたらDBにも書く
+// 書けなかった最大値は次のハートビートで書き直す
+// トランザクションの中では呼ばず、ロールバックしても視聴中のまま残らないようにする
+func touchViewerPresence(ctx context.Context, db sqlx.ExecerContext, livestreamID, userID int64, now time.Time) (int64, error) {
+	count, newPeak := viewerPresence.Touch(livestreamID, userID, now)
+	statsRollupWriter.ObserveViewers(livestreamID, now.Unix(), count)
+	if newPeak {
+		if err := recordViewerPeak(ctx, db, livestreamID, count, now.Unix()); err != nil {
+			return 0, err
+		}
+		viewerPresence.RaisePeak(livestreamID, count)
+	}
+	return count, nil
+}
+
+// 視聴継続API
+// POST /api/livestream/:livestream_id/heartbeat
+func heartbeatLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := currentUser(c).ID
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if _, err := getOpenLivestream(ctx, dbConn, int64(livestreamID)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	count, err := touchViewerPresence(ctx, dbConn, int64(livestreamID), userID, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := recordWatch(ctx, dbConn, userID, int64(livestreamID), now.Unix(), false); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, HeartbeatResponse{
+		CurrentViewers:  count,
+		NextHeartbeatIn: int64(viewerHeartbeatInterval / time.Second),
+	})
+}
+
+// 視聴者数API
+// GET /api/livestream/:livestream_id/viewers
+func getLivestreamViewersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var statsModel LivestreamViewerStatsModel
+	if err := dbConn.GetContext(ctx, &statsModel, "SELECT * FROM livestream_viewer_stats WHERE livestream_id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewer stats: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, LivestreamViewers{
+		CurrentViewers: viewerPresence.Count(livestreamModel.ID, time.Now()),
+		PeakViewers:    statsModel.PeakViewers,
+		PeakAt:         statsModel.PeakAt,
+		UniqueViewers:  statsModel.UniqueViewers,
+	})
+}
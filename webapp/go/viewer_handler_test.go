@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewerPresence(t *testing.T) {
+	p := &ViewerPresence{
+		mu:    new(sync.Mutex),
+		ttl:   time.Minute,
+		m:     make(map[int64]map[int64]time.Time),
+		peaks: make(map[int64]int64),
+	}
+	now := time.Unix(1700000000, 0)
+
+	count, newPeak := p.Touch(1, 10, now)
+	assert.Equal(t, int64(1), count)
+	assert.True(t, newPeak)
+	p.RaisePeak(1, count)
+	count, newPeak = p.Touch(1, 20, now.Add(10*time.Second))
+	assert.Equal(t, int64(2), count)
+	assert.True(t, newPeak)
+
+	// DBに書けなかった最大値は次も更新すべきとして返す
+	count, newPeak = p.Touch(1, 20, now.Add(15*time.Second))
+	assert.Equal(t, int64(2), count)
+	assert.True(t, newPeak)
+	p.RaisePeak(1, count)
+
+	// 同じユーザのハートビートは人数を増やさない
+	count, newPeak = p.Touch(1, 20, now.Add(20*time.Second))
+	assert.Equal(t, int64(2), count)
+	assert.False(t, newPeak)
+
+	// 退出したユーザは数えない
+	p.Leave(1, 20)
+	assert.Equal(t, int64(1), p.Count(1, now.Add(20*time.Second)))
+
+	// ハートビートが途切れたら期限切れになる
+	assert.Equal(t, int64(0), p.Count(1, now.Add(time.Minute)))
+
+	// 最大値を下回る間は更新しない
+	_, newPeak = p.Touch(1, 30, now.Add(2*time.Minute))
+	assert.False(t, newPeak)
+}
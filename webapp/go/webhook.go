@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	webhookStatusPending   = "pending"
+	webhookStatusSucceeded = "succeeded"
+	webhookStatusFailed    = "failed"
+
+	webhookMaxAttempts    = 6
+	webhookInitialBackoff = 10 * time.Second
+	webhookMaxBackoff     = 30 * time.Minute
+
+	webhookDispatchInterval = time.Second
+	webhookDispatchBatch    = 50
+	webhookDispatchWorkers  = 4
+	webhookRequestTimeout   = 5 * time.Second
+
+	webhookEventHeader     = "X-Isupipe-Event"
+	webhookDeliveryHeader  = "X-Isupipe-Delivery"
+	webhookTimestampHeader = "X-Isupipe-Timestamp"
+	webhookSignatureHeader = "X-Isupipe-Signature"
+
+	// 1 ならプライベートアドレスやループバックにもWebhookを送る (テスト用)
+	webhookAllowPrivateEnvKey = "ISUCON13_WEBHOOK_ALLOW_PRIVATE"
+)
+
+type WebhookSubscriptionModel struct {
+	ID         int64  `db:"id"`
+	UserID     int64  `db:"user_id"`
+	URL        string `db:"url"`
+	Secret     string `db:"secret"`
+	EventTypes string `db:"event_types"`
+	CreatedAt  int64  `db:"created_at"`
+}
+
+type WebhookDeliveryModel struct {
+	ID             int64  `db:"id"`
+	SubscriptionID int64  `db:"subscription_id"`
+	UserID         int64  `db:"user_id"`
+	EventType      string `db:"event_type"`
+	Payload        string `db:"payload"`
+	Status         string `db:"status"`
+	Attempts       int64  `db:"attempts"`
+	NextAttemptAt  int64  `db:"next_attempt_at"`
+	LastStatusCode int64  `db:"last_status_code"`
+	LastError      string `db:"last_error"`
+	CreatedAt      int64  `db:"created_at"`
+	DeliveredAt    int64  `db:"delivered_at"`
+}
+
+// signWebhookPayload は "タイムスタンプ.本文" のHMAC-SHA256を返す
+// タイムスタンプを含めることで、受信側はリプレイを弾ける
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff は attempts 回失敗した後に次を試すまでの待ち時間
+func webhookBackoff(attempts int64) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := int64(1); i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+var webhookAllowPrivate = os.Getenv(webhookAllowPrivateEnvKey) == "1"
+
+// isWebhookDestinationAllowed はWebhookを送ってよいアドレスかを判定する
+// 内部のサービスに届かないよう、プライベート・ループバック・リンクローカルなどは弾く
+func isWebhookDestinationAllowed(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// newWebhookHTTPClient はWebhook用のHTTPクライアントを作る
+// 名前解決した後の接続先アドレスで判定するので、DNSで内部のアドレスを返されても届かない
+// リダイレクトはたどらず、3xxは失敗として扱う
+func newWebhookHTTPClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isWebhookDestinationAllowed(ip) {
+				return fmt.Errorf("webhook destination %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// プロキシを経由すると接続先の判定が効かない
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   webhookRequestTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// WebhookSender は1件のWebhookをHTTPで送る
+type WebhookSender struct {
+	Client *http.Client
+	Now    func() time.Time
+}
+
+// Send は2xx以外をエラーとして返す。ステータスコードは届いた場合だけ入る
+func (s *WebhookSender) Send(ctx context.Context, subscription WebhookSubscriptionModel, delivery WebhookDeliveryModel) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := s.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(subscription.Secret, timestamp, body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// nextWebhookDeliveryState は送信結果から配送の次の状態を決める
+func nextWebhookDeliveryState(delivery WebhookDeliveryModel, statusCode int, sendErr error, now time.Time) WebhookDeliveryModel {
+	delivery.Attempts++
+	delivery.LastStatusCode = int64(statusCode)
+	if sendErr == nil {
+		delivery.Status = webhookStatusSucceeded
+		delivery.LastError = ""
+		delivery.DeliveredAt = now.Unix()
+		return delivery
+	}
+
+	delivery.LastError = sendErr.Error()
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Status = webhookStatusFailed
+		return delivery
+	}
+	delivery.Status = webhookStatusPending
+	delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts)).Unix()
+	return delivery
+}
+
+// WebhookDispatcher は配送待ちのWebhookを送る
+type WebhookDispatcher struct {
+	sender *WebhookSender
+	wake   chan struct{}
+}
+
+var webhookDispatcher = &WebhookDispatcher{
+	sender: &WebhookSender{
+		Client: newWebhookHTTPClient(webhookAllowPrivate),
+		Now:    time.Now,
+	},
+	wake: make(chan struct{}, 1),
+}
+
+func (d *WebhookDispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *WebhookDispatcher) Run(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(webhookDispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+
+		if err := d.dispatch(ctx); err != nil {
+			logger.Warnf("failed to dispatch webhooks: %v", err)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context) error {
+	var deliveries []WebhookDeliveryModel
+	if err := dbConn.SelectContext(ctx, &deliveries, "SELECT * FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?", webhookStatusPending, time.Now().Unix(), webhookDispatchBatch); err != nil {
+		return fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, webhookDispatchWorkers)
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(delivery WebhookDeliveryModel) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := d.deliver(ctx, delivery); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(delivery)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery WebhookDeliveryModel) error {
+	var subscription WebhookSubscriptionModel
+	if err := dbConn.GetContext(ctx, &subscription, "SELECT * FROM webhook_subscriptions WHERE id = ?", delivery.SubscriptionID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get webhook subscription: %w", err)
+		}
+		// 購読が消えていたら送り先がないので、待たせ続けずに失敗にする
+		if _, err := dbConn.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, last_error = ? WHERE id = ?", webhookStatusFailed, "subscription not found", delivery.ID); err != nil {
+			return fmt.Errorf("failed to update webhook delivery: %w", err)
+		}
+		return nil
+	}
+
+	statusCode, sendErr := d.sender.Send(ctx, subscription, delivery)
+	next := nextWebhookDeliveryState(delivery, statusCode, sendErr, d.sender.Now())
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ?, delivered_at = ? WHERE id = ?", next.Status, next.Attempts, next.NextAttemptAt, next.LastStatusCode, next.LastError, next.DeliveredAt, next.ID); err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	webhookEventTipReceived         = "tip.received"
+	webhookEventLivecommentReported = "livecomment.reported"
+	webhookEventLivestreamReserved  = "livestream.reserved"
+	webhookEventLivestreamModerated = "livestream.moderated"
+	// 購読とは関係なく、テスト送信でだけ使う
+	webhookEventPing = "ping"
+
+	maxWebhookSubscriptions = 10
+	maxWebhookDeliveryLimit = 100
+)
+
+var webhookEventTypes = map[string]struct{}{
+	webhookEventTipReceived:         {},
+	webhookEventLivecommentReported: {},
+	webhookEventLivestreamReserved:  {},
+	webhookEventLivestreamModerated: {},
+}
+
+type WebhookSubscription struct {
+	ID         int64    `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	CreatedAt  int64    `json:"created_at"`
+	// Secret は作成時のレスポンスにだけ含める
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             int64  `json:"id"`
+	EventType      string `json:"event_type"`
+	Payload        string `json:"payload"`
+	Status         string `json:"status"`
+	Attempts       int64  `json:"attempts"`
+	NextAttemptAt  int64  `json:"next_attempt_at"`
+	LastStatusCode int64  `json:"last_status_code"`
+	LastError      string `json:"last_error"`
+	CreatedAt      int64  `json:"created_at"`
+	DeliveredAt    int64  `json:"delivered_at"`
+}
+
+type PostWebhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// WebhookEvent は受信側に送るJSONの形
+type WebhookEvent struct {
+	Event     string `json:"event"`
+	CreatedAt int64  `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+type TipReceivedWebhookData struct {
+	LivestreamID  int64  `json:"livestream_id"`
+	LivecommentID int64  `json:"livecomment_id"`
+	UserID        int64  `json:"user_id"`
+	Comment       string `json:"comment"`
+	Tip           int64  `json:"tip"`
+}
+
+type LivecommentReportedWebhookData struct {
+	LivestreamID  int64 `json:"livestream_id"`
+	LivecommentID int64 `json:"livecomment_id"`
+	ReportID      int64 `json:"report_id"`
+	ReporterID    int64 `json:"reporter_id"`
+}
+
+type LivestreamReservedWebhookData struct {
+	LivestreamID int64  `json:"livestream_id"`
+	Title        string `json:"title"`
+	StartAt      int64  `json:"start_at"`
+	EndAt        int64  `json:"end_at"`
+}
+
+type LivestreamModeratedWebhookData struct {
+	LivestreamID         int64   `json:"livestream_id"`
+	NGWordID             int64   `json:"ng_word_id"`
+	NGWord               string  `json:"ng_word"`
+	HiddenLivecommentIDs []int64 `json:"hidden_livecomment_ids"`
+}
+
+func fillWebhookSubscriptionResponse(subscriptionModel WebhookSubscriptionModel) WebhookSubscription {
+	return WebhookSubscription{
+		ID:         subscriptionModel.ID,
+		URL:        subscriptionModel.URL,
+		EventTypes: strings.Split(subscriptionModel.EventTypes, ","),
+		CreatedAt:  subscriptionModel.CreatedAt,
+	}
+}
+
+func fillWebhookDeliveryResponse(deliveryModel WebhookDeliveryModel) WebhookDelivery {
+	return WebhookDelivery{
+		ID:             deliveryModel.ID,
+		EventType:      deliveryModel.EventType,
+		Payload:        deliveryModel.Payload,
+		Status:         deliveryModel.Status,
+		Attempts:       deliveryModel.Attempts,
+		NextAttemptAt:  deliveryModel.NextAttemptAt,
+		LastStatusCode: deliveryModel.LastStatusCode,
+		LastError:      deliveryModel.LastError,
+		CreatedAt:      deliveryModel.CreatedAt,
+		DeliveredAt:    deliveryModel.DeliveredAt,
+	}
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	// 送るときにも接続先のアドレスで弾くが、明らかに内部を指すものは登録させない
+	if !webhookAllowPrivate {
+		host := u.Hostname()
+		if strings.EqualFold(host, "localhost") {
+			return fmt.Errorf("host is not allowed")
+		}
+		if ip := net.ParseIP(host); ip != nil && !isWebhookDestinationAllowed(ip) {
+			return fmt.Errorf("host is not allowed")
+		}
+	}
+	return nil
+}
+
+func marshalWebhookEvent(eventType string, data any, now int64) (string, error) {
+	b, err := json.Marshal(WebhookEvent{
+		Event:     eventType,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal webhook event: %w", err)
+	}
+	return string(b), nil
+}
+
+// enqueueWebhookEvent はイベントを購読しているユーザのWebhookすべてに配送を積む
+// 送信はWebhookDispatcherが行うので、コミット後に webhookDispatcher.Wake() を呼ぶ
+func enqueueWebhookEvent(ctx context.Context, tx sqlx.ExecerContext, userID int64, eventType string, data any, now int64) error {
+	payload, err := marshalWebhookEvent(eventType, data, now)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO webhook_deliveries (subscription_id, user_id, event_type, payload, status, next_attempt_at, last_error, created_at) SELECT id, user_id, ?, ?, ?, ?, '', ? FROM webhook_subscriptions WHERE user_id = ? AND FIND_IN_SET(?, event_types) > 0", eventType, payload, webhookStatusPending, now, now, userID, eventType); err != nil {
+		return fmt.Errorf("failed to enqueue webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+func getWebhookSubscription(ctx context.Context, tx SqlxConn, userID int64, webhookIDParam string) (WebhookSubscriptionModel, error) {
+	webhookID, err := strconv.ParseInt(webhookIDParam, 10, 64)
+	if err != nil {
+		return WebhookSubscriptionModel{}, echo.NewHTTPError(http.StatusBadRequest, "webhook_id in path must be integer")
+	}
+
+	var subscriptionModel WebhookSubscriptionModel
+	if err := tx.GetContext(ctx, &subscriptionModel, "SELECT * FROM webhook_subscriptions WHERE id = ? AND user_id = ?", webhookID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebhookSubscriptionModel{}, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return WebhookSubscriptionModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook: "+err.Error())
+	}
+	return subscriptionModel, nil
+}
+
+// Webhook登録API
+// POST /api/user/me/webhooks
+func postWebhookSubscriptionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := currentUser(c).ID
+
+	var req *PostWebhookSubscriptionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid url: "+err.Error())
+	}
+	if len(req.EventTypes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one event type is required")
+	}
+	for _, eventType := range req.EventTypes {
+		if _, ok := webhookEventTypes[eventType]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown event type: "+eventType)
+		}
+	}
+
+	var count int64
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM webhook_subscriptions WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count webhooks: "+err.Error())
+	}
+	if count >= maxWebhookSubscriptions {
+		return echo.NewHTTPError(http.StatusBadRequest, "too many webhooks")
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate secret: "+err.Error())
+	}
+
+	subscriptionModel := WebhookSubscriptionModel{
+		UserID:     userID,
+		URL:        req.URL,
+		Secret:     secret,
+		EventTypes: strings.Join(req.EventTypes, ","),
+		CreatedAt:  time.Now().Unix(),
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO webhook_subscriptions (user_id, url, secret, event_types, created_at) VALUES (:user_id, :url, :secret, :event_types, :created_at)", &subscriptionModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook: "+err.Error())
+	}
+	subscriptionID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted webhook id: "+err.Error())
+	}
+	subscriptionModel.ID = subscriptionID
+
+	res := fillWebhookSubscriptionResponse(subscriptionModel)
+	res.Secret = secret
+	return c.JSON(http.StatusCreated, res)
+}
+
+// Webhook一覧API
+// GET /api/user/me/webhooks
+func getWebhookSubscriptionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	var subscriptionModels []WebhookSubscriptionModel
+	if err := dbConn.SelectContext(ctx, &subscriptionModels, "SELECT * FROM webhook_subscriptions WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhooks: "+err.Error())
+	}
+
+	subscriptions := make([]WebhookSubscription, len(subscriptionModels))
+	for i := range subscriptionModels {
+		subscriptions[i] = fillWebhookSubscriptionResponse(subscriptionModels[i])
+	}
+	return c.JSON(http.StatusOK, subscriptions)
+}
+
+// Webhook削除API
+// DELETE /api/user/me/webhooks/:webhook_id
+func deleteWebhookSubscriptionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	subscriptionModel, err := getWebhookSubscription(ctx, tx, userID, c.Param("webhook_id"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE subscription_id = ?", subscriptionModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook deliveries: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_subscriptions WHERE id = ?", subscriptionModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Webhook配送ログAPI
+// GET /api/user/me/webhooks/:webhook_id/deliveries
+func getWebhookDeliveriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	limit := maxWebhookDeliveryLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = min(l, maxWebhookDeliveryLimit)
+	}
+
+	subscriptionModel, err := getWebhookSubscription(ctx, dbConn, userID, c.Param("webhook_id"))
+	if err != nil {
+		return err
+	}
+
+	var deliveryModels []WebhookDeliveryModel
+	if err := dbConn.SelectContext(ctx, &deliveryModels, "SELECT * FROM webhook_deliveries WHERE subscription_id = ? ORDER BY id DESC LIMIT ?", subscriptionModel.ID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook deliveries: "+err.Error())
+	}
+
+	deliveries := make([]WebhookDelivery, len(deliveryModels))
+	for i := range deliveryModels {
+		deliveries[i] = fillWebhookDeliveryResponse(deliveryModels[i])
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+// Webhookテスト送信API
+// POST /api/user/me/webhooks/:webhook_id/test
+func testWebhookSubscriptionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := currentUser(c).ID
+
+	subscriptionModel, err := getWebhookSubscription(ctx, dbConn, userID, c.Param("webhook_id"))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	payload, err := marshalWebhookEvent(webhookEventPing, map[string]int64{"webhook_id": subscriptionModel.ID}, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	deliveryModel := WebhookDeliveryModel{
+		SubscriptionID: subscriptionModel.ID,
+		UserID:         userID,
+		EventType:      webhookEventPing,
+		Payload:        payload,
+		Status:         webhookStatusPending,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO webhook_deliveries (subscription_id, user_id, event_type, payload, status, next_attempt_at, last_error, created_at) VALUES (:subscription_id, :user_id, :event_type, :payload, :status, :next_attempt_at, :last_error, :created_at)", &deliveryModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook delivery: "+err.Error())
+	}
+	deliveryID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted webhook delivery id: "+err.Error())
+	}
+	deliveryModel.ID = deliveryID
+
+	webhookDispatcher.Wake()
+
+	return c.JSON(http.StatusAccepted, fillWebhookDeliveryResponse(deliveryModel))
+}
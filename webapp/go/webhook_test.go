@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSenderSignsPayload(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	subscription := WebhookSubscriptionModel{ID: 1, Secret: "s3cret"}
+	delivery := WebhookDeliveryModel{ID: 42, EventType: webhookEventTipReceived, Payload: `{"event":"tip.received"}`}
+
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	subscription.URL = srv.URL
+
+	sender := &WebhookSender{Client: srv.Client(), Now: func() time.Time { return now }}
+	statusCode, err := sender.Send(context.Background(), subscription, delivery)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, statusCode)
+
+	assert.Equal(t, delivery.Payload, string(body))
+	assert.Equal(t, webhookEventTipReceived, got.Header.Get(webhookEventHeader))
+	assert.Equal(t, "42", got.Header.Get(webhookDeliveryHeader))
+	assert.Equal(t, strconv.FormatInt(now.Unix(), 10), got.Header.Get(webhookTimestampHeader))
+	assert.Equal(t, signWebhookPayload("s3cret", now.Unix(), body), got.Header.Get(webhookSignatureHeader))
+	assert.NotEqual(t, signWebhookPayload("other", now.Unix(), body), got.Header.Get(webhookSignatureHeader))
+}
+
+func TestWebhookSenderRejectsNon2xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	sender := &WebhookSender{Client: srv.Client(), Now: time.Now}
+	statusCode, err := sender.Send(context.Background(), WebhookSubscriptionModel{URL: srv.URL}, WebhookDeliveryModel{Payload: "{}"})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, statusCode)
+}
+
+func TestWebhookHTTPClientBlocksPrivateDestinations(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// httptest のサーバはループバックなので届かない
+	sender := &WebhookSender{Client: newWebhookHTTPClient(false), Now: time.Now}
+	statusCode, err := sender.Send(context.Background(), WebhookSubscriptionModel{URL: srv.URL}, WebhookDeliveryModel{Payload: "{}"})
+	assert.ErrorContains(t, err, "is not allowed")
+	assert.Equal(t, 0, statusCode)
+
+	sender.Client = newWebhookHTTPClient(true)
+	statusCode, err = sender.Send(context.Background(), WebhookSubscriptionModel{URL: srv.URL}, WebhookDeliveryModel{Payload: "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, statusCode)
+}
+
+func TestWebhookHTTPClientDoesNotFollowRedirects(t *testing.T) {
+	var redirected bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			redirected = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, "/internal", http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	sender := &WebhookSender{Client: newWebhookHTTPClient(true), Now: time.Now}
+	statusCode, err := sender.Send(context.Background(), WebhookSubscriptionModel{URL: srv.URL}, WebhookDeliveryModel{Payload: "{}"})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, statusCode)
+	assert.False(t, redirected)
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	assert.NoError(t, validateWebhookURL("https://example.com/hook"))
+	assert.NoError(t, validateWebhookURL("http://203.0.113.1:8080/hook"))
+	for _, rawURL := range []string{
+		"ftp://example.com/hook",
+		"https:///hook",
+		"http://localhost/hook",
+		"http://127.0.0.1/hook",
+		"http://10.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+	} {
+		assert.Error(t, validateWebhookURL(rawURL), rawURL)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, webhookBackoff(1))
+	assert.Equal(t, 20*time.Second, webhookBackoff(2))
+	assert.Equal(t, 40*time.Second, webhookBackoff(3))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(100))
+}
+
+func TestNextWebhookDeliveryState(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	delivery := WebhookDeliveryModel{Status: webhookStatusPending}
+
+	// 失敗したら間隔を空けて再送する
+	delivery = nextWebhookDeliveryState(delivery, http.StatusBadGateway, errors.New("bad gateway"), now)
+	assert.Equal(t, webhookStatusPending, delivery.Status)
+	assert.Equal(t, int64(1), delivery.Attempts)
+	assert.Equal(t, now.Add(webhookBackoff(1)).Unix(), delivery.NextAttemptAt)
+	assert.Equal(t, int64(http.StatusBadGateway), delivery.LastStatusCode)
+
+	succeeded := nextWebhookDeliveryState(delivery, http.StatusOK, nil, now)
+	assert.Equal(t, webhookStatusSucceeded, succeeded.Status)
+	assert.Equal(t, now.Unix(), succeeded.DeliveredAt)
+	assert.Empty(t, succeeded.LastError)
+
+	// 上限まで失敗したら諦める
+	for delivery.Attempts < webhookMaxAttempts {
+		delivery = nextWebhookDeliveryState(delivery, 0, errors.New("connection refused"), now)
+	}
+	assert.Equal(t, webhookStatusFailed, delivery.Status)
+	assert.Equal(t, "connection refused", delivery.LastError)
+}
@@ -68,6 +68,9 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < initial_livecomments.sql
 
-bash ../pdns/init_zone.sh 
+# Go実装はDNSレコードのバックエンドで自分で初期化する
+if [ "${ISUCON13_SKIP_ZONE_INIT:-}" != "1" ]; then
+	bash ../pdns/init_zone.sh
+fi
 
 
@@ -10,6 +10,30 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+TRUNCATE TABLE user_deletion_tasks;
+TRUNCATE TABLE user_export_jobs;
+TRUNCATE TABLE personal_access_tokens;
+TRUNCATE TABLE user_totp;
+TRUNCATE TABLE user_recovery_codes;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE livestream_start_notifications;
+TRUNCATE TABLE webhook_subscriptions;
+TRUNCATE TABLE webhook_deliveries;
+TRUNCATE TABLE livestream_unique_viewers;
+TRUNCATE TABLE livestream_viewer_stats;
+TRUNCATE TABLE watch_history;
+TRUNCATE TABLE watch_history_pauses;
+TRUNCATE TABLE user_stats;
+TRUNCATE TABLE livestream_stats;
+TRUNCATE TABLE user_emoji_stats;
+TRUNCATE TABLE livestream_minutely_stats;
+TRUNCATE TABLE livestream_minutely_emoji_stats;
+TRUNCATE TABLE livestream_tippers;
+TRUNCATE TABLE tip_ledger;
+TRUNCATE TABLE idempotency_keys;
+TRUNCATE TABLE held_tips;
+TRUNCATE TABLE custom_emojis;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
@@ -22,4 +46,14 @@ ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `user_deletion_tasks` auto_increment = 1;
+ALTER TABLE `user_export_jobs` auto_increment = 1;
+ALTER TABLE `personal_access_tokens` auto_increment = 1;
+ALTER TABLE `user_recovery_codes` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `webhook_subscriptions` auto_increment = 1;
+ALTER TABLE `webhook_deliveries` auto_increment = 1;
+ALTER TABLE `tip_ledger` auto_increment = 1;
+ALTER TABLE `held_tips` auto_increment = 1;
+ALTER TABLE `custom_emojis` auto_increment = 1;
\ No newline at end of file
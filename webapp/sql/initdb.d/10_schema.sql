@@ -103,4 +103,285 @@ CREATE TABLE `reactions` (
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
   `created_at` BIGINT NOT NULL
-) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
\ No newline at end of file
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 退会したユーザのDB以外の後始末 (アイコンファイル、DNSレコード、キャッシュ)
+CREATE TABLE `user_deletion_tasks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 個人データのエクスポート
+CREATE TABLE `user_export_jobs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- pending, running, done, failed
+  `status` VARCHAR(16) NOT NULL,
+  `file_path` VARCHAR(255) NOT NULL DEFAULT '',
+  `error` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `finished_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_user_export_jobs_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ボットやオーバーレイ向けのパーソナルアクセストークン
+CREATE TABLE `personal_access_tokens` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  -- トークン本体のsha256
+  `token_hash` CHAR(64) NOT NULL,
+  -- カンマ区切り (livecomment:read, livecomment:write, moderate)
+  `scopes` VARCHAR(255) NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  `revoked_at` BIGINT NOT NULL DEFAULT 0,
+  `last_used_at` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_personal_access_tokens_token_hash` (`token_hash`),
+  INDEX `idx_personal_access_tokens_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- TOTPによる二要素認証
+CREATE TABLE `user_totp` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  -- base32エンコードした共有鍵
+  `secret` VARCHAR(64) NOT NULL,
+  `enabled` BOOLEAN NOT NULL DEFAULT FALSE,
+  -- 同じコードを再利用させないため、最後に受け付けたタイムステップを持つ
+  `last_used_step` BIGINT NOT NULL DEFAULT 0,
+  `failed_attempts` INT NOT NULL DEFAULT 0,
+  `locked_until` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 二要素認証のリカバリーコード (一度だけ使える)
+CREATE TABLE `user_recovery_codes` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- リカバリーコードのsha256
+  `code_hash` CHAR(64) NOT NULL,
+  `used_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_user_recovery_codes_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者のフォロー
+CREATE TABLE `follows` (
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`follower_id`, `followee_id`),
+  INDEX `idx_follows_followee_id` (`followee_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- アプリ内通知
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- livestream_reserved, livestream_starting, tip_received, livecomment_hidden
+  `type` VARCHAR(32) NOT NULL,
+  -- 通知のきっかけになったユーザ (なければ0)
+  `actor_id` BIGINT NOT NULL DEFAULT 0,
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `livecomment_id` BIGINT NOT NULL DEFAULT 0,
+  `amount` BIGINT NOT NULL DEFAULT 0,
+  `is_read` BOOLEAN NOT NULL DEFAULT FALSE,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_notifications_user_id_id` (`user_id`, `id`),
+  INDEX `idx_notifications_user_id_is_read` (`user_id`, `is_read`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信開始前の通知を送った配信
+CREATE TABLE `livestream_start_notifications` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Webhookの購読
+CREATE TABLE `webhook_subscriptions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `url` VARCHAR(1024) NOT NULL,
+  -- 署名用の共有鍵
+  `secret` VARCHAR(64) NOT NULL,
+  -- カンマ区切り (tip.received, livecomment.reported, livestream.reserved, livestream.moderated)
+  `event_types` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_webhook_subscriptions_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Webhookの配送ログ (配送待ちのキューも兼ねる)
+CREATE TABLE `webhook_deliveries` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `subscription_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `event_type` VARCHAR(64) NOT NULL,
+  `payload` TEXT NOT NULL,
+  -- pending, succeeded, failed
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL,
+  `last_status_code` INT NOT NULL DEFAULT 0,
+  `last_error` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `delivered_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_webhook_deliveries_status_next_attempt_at` (`status`, `next_attempt_at`),
+  INDEX `idx_webhook_deliveries_subscription_id` (`subscription_id`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのユニーク視聴者
+CREATE TABLE `livestream_unique_viewers` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`),
+  INDEX `idx_livestream_unique_viewers_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの視聴者数の集計 (同時視聴者数の最大値、ユニーク視聴者数)
+CREATE TABLE `livestream_viewer_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `peak_viewers` BIGINT NOT NULL DEFAULT 0,
+  `peak_at` BIGINT NOT NULL DEFAULT 0,
+  `unique_viewers` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザごとの配信の視聴履歴 (視聴時間を合算する)
+CREATE TABLE `watch_history` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `first_watched_at` BIGINT NOT NULL,
+  `last_watched_at` BIGINT NOT NULL,
+  `watch_seconds` BIGINT NOT NULL DEFAULT 0,
+  `entered_at` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`user_id`, `livestream_id`),
+  INDEX `idx_watch_history_user_id_last_watched_at` (`user_id`, `last_watched_at`, `livestream_id`),
+  INDEX `idx_watch_history_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 視聴履歴の記録を一時停止しているユーザ
+CREATE TABLE `watch_history_pauses` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者ごとの集計 (ライブコメント・リアクション・モデレーションのたびに更新する)
+CREATE TABLE `user_stats` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `total_reactions` BIGINT NOT NULL DEFAULT 0,
+  `total_livecomments` BIGINT NOT NULL DEFAULT 0,
+  `total_tip` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの集計
+CREATE TABLE `livestream_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `total_reactions` BIGINT NOT NULL DEFAULT 0,
+  `total_livecomments` BIGINT NOT NULL DEFAULT 0,
+  `total_tip` BIGINT NOT NULL DEFAULT 0,
+  `max_tip` BIGINT NOT NULL DEFAULT 0,
+  `total_reports` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_livestream_stats_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者ごとの絵文字別リアクション数
+CREATE TABLE `user_emoji_stats` (
+  `user_id` BIGINT NOT NULL,
+  `emoji_name` VARCHAR(255) NOT NULL,
+  `count` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`user_id`, `emoji_name`),
+  INDEX `idx_user_emoji_stats_user_id_count` (`user_id`, `count`, `emoji_name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信の1分ごとの集計 (minute は分の開始時刻)
+CREATE TABLE `livestream_minutely_stats` (
+  `livestream_id` BIGINT NOT NULL,
+  `minute` BIGINT NOT NULL,
+  `livecomments` BIGINT NOT NULL DEFAULT 0,
+  `tips` BIGINT NOT NULL DEFAULT 0,
+  `reactions` BIGINT NOT NULL DEFAULT 0,
+  `reports` BIGINT NOT NULL DEFAULT 0,
+  `peak_viewers` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`livestream_id`, `minute`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信の1分ごとの絵文字別リアクション数
+CREATE TABLE `livestream_minutely_emoji_stats` (
+  `livestream_id` BIGINT NOT NULL,
+  `minute` BIGINT NOT NULL,
+  `emoji_name` VARCHAR(255) NOT NULL,
+  `count` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`livestream_id`, `minute`, `emoji_name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのユーザ別チップ合計 (非表示になったコメントのチップは含めない)
+CREATE TABLE `livestream_tippers` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `total_tip` BIGINT NOT NULL DEFAULT 0,
+  `last_tipped_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`),
+  INDEX `idx_livestream_tippers_livestream_id_total_tip` (`livestream_id`, `total_tip` DESC)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チップの台帳 (追記のみ)
+-- amount は配信者の残高に対する増減。チップと復元は正、返金と支払いは負
+CREATE TABLE `tip_ledger` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `kind` VARCHAR(16) NOT NULL,
+  `streamer_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL DEFAULT 0,
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `livecomment_id` BIGINT NOT NULL DEFAULT 0,
+  `amount` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_tip_ledger_streamer_id_created_at` (`streamer_id`, `created_at`),
+  INDEX `idx_tip_ledger_livecomment_id` (`livecomment_id`),
+  INDEX `idx_tip_ledger_kind_created_at` (`kind`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Idempotency-Key つきリクエストの結果 (ハンドラのトランザクションで書くのでコミットされたものだけが残る)
+-- 保持期間を過ぎた行は定期的に消す
+CREATE TABLE `idempotency_keys` (
+  `user_id` BIGINT NOT NULL,
+  `idempotency_key` VARCHAR(255) NOT NULL,
+  `request_hash` CHAR(64) NOT NULL,
+  `status_code` INT NOT NULL DEFAULT 0,
+  `content_type` VARCHAR(255) NOT NULL DEFAULT '',
+  `response_body` MEDIUMBLOB NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `idempotency_key`),
+  INDEX `idx_idempotency_keys_created_at` (`created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 不正の疑いで保留したチップ (承認されるまでライブコメントの tip は0のまま)
+CREATE TABLE `held_tips` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livecomment_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `amount` BIGINT NOT NULL,
+  `reason` VARCHAR(32) NOT NULL,
+  -- pending, approved, rejected
+  `status` VARCHAR(16) NOT NULL DEFAULT 'pending',
+  `created_at` BIGINT NOT NULL,
+  `reviewed_by` BIGINT NOT NULL DEFAULT 0,
+  `reviewed_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_held_tips_livecomment_id` (`livecomment_id`),
+  INDEX `idx_held_tips_status_id` (`status`, `id`),
+  INDEX `idx_held_tips_user_id_created_at` (`user_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者のカスタム絵文字 (その配信者の配信でだけリアクションに使える)
+-- name は :shortcode: の形。画像は icons と同じくファイルにも置く
+CREATE TABLE `custom_emojis` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(64) NOT NULL,
+  `content_type` VARCHAR(32) NOT NULL,
+  `image` MEDIUMBLOB NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_custom_emojis_user_id_name` (`user_id`, `name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -8,3 +8,8 @@ alter table ng_words add index idx_ngwords_livestreamid (livestream_id);
 alter table livecomments add column `is_deleted` tinyint(1) default 0;
 alter table livecomments add index idx_livecomments_livestreamid_isdeleted_createdat (livestream_id, is_deleted, created_at desc);
 alter table reservation_slots add index idx_reservationslots_startat (start_at);
+alter table livestreams add index idx_livestreams_userid_startat (user_id, start_at);
+alter table livestreams add index idx_livestreams_startat (start_at);
+alter table livestreams add column `state` varchar(16) not null default 'scheduled';
+alter table livestreams add column `tip_goal` bigint not null default 0;
+alter table livecomments add index idx_livecomments_userid_createdat (user_id, created_at);